@@ -1,9 +1,18 @@
 package aggregator
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/fault"
 	"github.com/jacksontj/dnms/graph"
 )
 
@@ -11,45 +20,295 @@ import (
 // peerMap is a mapping of peerName -> peergraphmap (which keeps track of what
 // items in the graph where due to the given peer)
 type AggGraphMap struct {
+	// our name on the aggregator hash ring
+	name   string
+	config *Config
+	// path of the event stream we subscribe to on each peer
+	eventsPath string
+
 	// map of peer -> routes -> ourRefcount
 	peerMap map[string]*PeerGraphMap
 	mapLock *sync.RWMutex
 
+	// when sharding, all the peers we know about (peer -> HTTP addr) and the
+	// ring of aggregators to decide which ones we own
+	candidates map[string]string
+	ring       *HashRing
+	// peers we no longer own, which we'll remove once the handoff is done
+	handoffs map[string]*time.Timer
+
 	Graph *graph.NetworkGraph
+	// which routes the peers use
+	RouteMap *AggRouteMap
+
+	// fault localization on the aggregated graph
+	Faults *fault.Locator
+
+	// cancelled once we stop
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewAggGraphMap() *AggGraphMap {
-	return &AggGraphMap{
-		peerMap: make(map[string]*PeerGraphMap),
-		mapLock: &sync.RWMutex{},
-		Graph:   graph.Create(),
+func NewAggGraphMap(name string, cfg *Config, graphCfg *graph.Config, faultCfg *fault.Config) *AggGraphMap {
+	g := graph.CreateWithConfig(graphCfg)
+	a := &AggGraphMap{
+		name:       name,
+		config:     cfg,
+		eventsPath: "/v1/events/graph",
+		peerMap:    make(map[string]*PeerGraphMap),
+		mapLock:    &sync.RWMutex{},
+		candidates: make(map[string]string),
+		ring:       NewHashRing(),
+		handoffs:   make(map[string]*time.Timer),
+		Graph:      g,
+		RouteMap:   NewAggRouteMap(),
+		Faults:     fault.NewLocator(g, faultCfg),
 	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	a.Faults.Start(a.ctx)
+	return a
 }
 
-func (p *AggGraphMap) AddPeer(peer string) {
+// Stop aggregating: drop all the peers (and their push connections) and stop
+// the graph, which closes the channels of everyone subscribed to it
+func (p *AggGraphMap) Stop() {
 	p.mapLock.Lock()
 	defer p.mapLock.Unlock()
-	_, ok := p.peerMap[peer]
-	if !ok {
-		p.peerMap[peer] = NewPeerGraphMap(peer, p.Graph)
+	p.cancel()
+	for peer := range p.peerMap {
+		p.removePeer(peer)
+	}
+	p.candidates = make(map[string]string)
+	p.Graph.Stop()
+}
+
+// Done is closed once we are stopped
+func (p *AggGraphMap) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// NewSuperAggGraphMap creates a map which aggregates the graphs of the (shard)
+// aggregators, instead of the peers. Each aggregator is just a peer as far as
+// the refcounting is concerned
+func NewSuperAggGraphMap(name string, cfg *Config, graphCfg *graph.Config, faultCfg *fault.Config) *AggGraphMap {
+	// we always subscribe to every aggregator
+	superCfg := *cfg
+	superCfg.Push = false
+	superCfg.Shard = false
+
+	a := NewAggGraphMap(name, &superCfg, graphCfg, faultCfg)
+	a.eventsPath = "/v1/aggregator/events/graph"
+	return a
+}
+
+// Add a peer to aggregate, `addr` is the host:port of the peer's HTTP API (if
+// empty we assume it is on the peer's name and the configured PeerPort)
+func (p *AggGraphMap) AddPeer(peer, addr string) {
+	// if peers push to us, they'll show up once they connect
+	if p.config.Push {
+		return
+	}
+	if addr == "" {
+		addr = net.JoinHostPort(peer, strconv.Itoa(p.config.PeerPort))
+	}
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+	if p.ctx.Err() != nil {
+		return
 	}
+	p.candidates[peer] = addr
+	p.balancePeer(peer)
 }
 
 // remove all routes associated with a peer
 func (p *AggGraphMap) RemovePeer(peer string) {
 	p.mapLock.Lock()
 	defer p.mapLock.Unlock()
+	delete(p.candidates, peer)
+	p.removePeer(peer)
+}
+
+// callers must hold mapLock
+func (p *AggGraphMap) removePeer(peer string) {
+	if t, ok := p.handoffs[peer]; ok {
+		t.Stop()
+		delete(p.handoffs, peer)
+	}
 	pmap, ok := p.peerMap[peer]
 	if !ok {
 		logrus.Warningf("Attempting to remove a peer which isn't in the map: %v", peer)
 		return
 	}
 
+	pmap.pushLock.Lock()
 	pmap.cleanup()
 	pmap.Stop()
+	// any push connection from the peer is no longer current
+	pmap.pushGen++
+	pmap.pushLock.Unlock()
 	delete(p.peerMap, peer)
 }
 
+// Add (or re-weight) an aggregator on the hash ring
+func (p *AggGraphMap) AddAggregator(name string, weight int) {
+	if p.ring.Add(name, weight) {
+		p.rebalance()
+	}
+}
+
+func (p *AggGraphMap) RemoveAggregator(name string) {
+	if p.ring.Remove(name) {
+		p.rebalance()
+	}
+}
+
+// whether we should be aggregating `peer`
+func (p *AggGraphMap) owns(peer string) bool {
+	if !p.config.Shard || p.ring.Len() == 0 {
+		return true
+	}
+	return p.ring.Get(peer) == p.name
+}
+
+func (p *AggGraphMap) rebalance() {
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+	for peer := range p.candidates {
+		p.balancePeer(peer)
+	}
+}
+
+// Start or stop aggregating `peer` based on whether we own it. Callers must
+// hold mapLock
+func (p *AggGraphMap) balancePeer(peer string) {
+	_, aggregating := p.peerMap[peer]
+	if p.owns(peer) {
+		// if we were handing it off, we aren't anymore
+		if t, ok := p.handoffs[peer]; ok {
+			t.Stop()
+			delete(p.handoffs, peer)
+		}
+		if !aggregating {
+			logrus.Infof("Aggregating peer %s", peer)
+			p.peerMap[peer] = NewPeerGraphMap(peer, "http://"+p.candidates[peer]+p.eventsPath, p.Graph, p.RouteMap)
+		}
+		return
+	}
+
+	if !aggregating {
+		return
+	}
+	if _, ok := p.handoffs[peer]; ok {
+		return
+	}
+	// Keep the peer for a bit, so the new owner has time to load the peer's
+	// graph before we drop ours
+	logrus.Infof("Peer %s moved to aggregator %s, handing off in %v", peer, p.ring.Get(peer), p.config.HandoffDelay)
+	p.handoffs[peer] = time.AfterFunc(p.config.HandoffDelay, func() {
+		p.mapLock.Lock()
+		defer p.mapLock.Unlock()
+		// by now we might own it again
+		if _, ok := p.handoffs[peer]; !ok {
+			return
+		}
+		delete(p.handoffs, peer)
+		if !p.owns(peer) {
+			p.removePeer(peer)
+		}
+	})
+}
+
+// Consume a push connection from `peer` until it closes
+func (p *AggGraphMap) HandlePush(peer string, body io.Reader) error {
+	p.mapLock.Lock()
+	if p.ctx.Err() != nil {
+		p.mapLock.Unlock()
+		return fmt.Errorf("aggregator is stopped")
+	}
+	pmap, ok := p.peerMap[peer]
+	if !ok {
+		pmap = NewPeerGraphMap(peer, "", p.Graph, p.RouteMap)
+		p.peerMap[peer] = pmap
+	}
+	pmap.pushLock.Lock()
+	p.mapLock.Unlock()
+	pmap.pushGen++
+	gen := pmap.pushGen
+	// Every connection starts with a full dump of the peer's graph, so we
+	// need to remove everything from the last one
+	pmap.cleanup()
+	pmap.pushLock.Unlock()
+
+	// apply the event if we are still the current connection
+	apply := func(msg *pushMessage) bool {
+		pmap.pushLock.Lock()
+		defer pmap.pushLock.Unlock()
+		if pmap.pushGen != gen {
+			return false
+		}
+		pmap.HandleEvent(msg)
+		return true
+	}
+	defer func() {
+		// if there is a newer connection, it owns the state now
+		pmap.pushLock.Lock()
+		defer pmap.pushLock.Unlock()
+		if pmap.pushGen == gen {
+			pmap.cleanup()
+		}
+	}()
+
+	dec := json.NewDecoder(body)
+	for {
+		msg := &pushMessage{}
+		if err := dec.Decode(msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !apply(msg) {
+			return fmt.Errorf("push connection from %s was replaced by a newer one", peer)
+		}
+	}
+}
+
+// What we know about a peer we are aggregating
+type PeerInfo struct {
+	Name string `json:"name"`
+	// event stream we subscribe to, empty if the peer pushes to us
+	URL          string `json:"url,omitempty"`
+	Push         bool   `json:"push"`
+	RouteOptions int    `json:"route_options"`
+	// whether we are handing the peer off to another aggregator
+	HandingOff bool `json:"handing_off,omitempty"`
+}
+
+// Peers returns all the peers we are aggregating, sorted by name
+func (p *AggGraphMap) Peers() []*PeerInfo {
+	p.mapLock.RLock()
+	defer p.mapLock.RUnlock()
+	ret := make([]*PeerInfo, 0, len(p.peerMap))
+	for name, pmap := range p.peerMap {
+		_, handingOff := p.handoffs[name]
+		ret = append(ret, &PeerInfo{
+			Name:         name,
+			URL:          pmap.URL,
+			Push:         pmap.URL == "",
+			RouteOptions: pmap.GetRouteOptionCount(),
+			HandingOff:   handingOff,
+		})
+	}
+	sort.Sort(peerInfoByName(ret))
+	return ret
+}
+
+type peerInfoByName []*PeerInfo
+
+func (s peerInfoByName) Len() int           { return len(s) }
+func (s peerInfoByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s peerInfoByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func (p *AggGraphMap) GetPeerMap(peer string) *PeerGraphMap {
 	p.mapLock.RLock()
 	defer p.mapLock.RUnlock()
@@ -0,0 +1,77 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// Push a node from the peer on `w`
+func pushNode(t *testing.T, w io.Writer, name string) {
+	buf, err := json.Marshal(graph.NewNetworkNode(name, nil))
+	if err != nil {
+		t.Fatalf("Unable to marshal node: %v", err)
+	}
+	if err := json.NewEncoder(w).Encode(&pushMessage{Type: "addNodeEvent", Payload: buf}); err != nil {
+		t.Fatalf("Unable to push node: %v", err)
+	}
+}
+
+func waitNodes(t *testing.T, g *graph.NetworkGraph, count int) {
+	for deadline := time.Now().Add(time.Second); g.GetNodeCount() != count; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d nodes, got %d", count, g.GetNodeCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandlePushOverlapping(t *testing.T) {
+	a := NewAggGraphMap("agg", DefaultConfig(), graph.DefaultConfig(), fault.DefaultConfig())
+	defer a.Stop()
+
+	push := func() (*io.PipeWriter, chan error) {
+		r, w := io.Pipe()
+		errC := make(chan error, 1)
+		go func() { errC <- a.HandlePush("peer", r) }()
+		return w, errC
+	}
+
+	first, firstErr := push()
+	pushNode(t, first, "a")
+	waitNodes(t, a.Graph, 1)
+
+	// the peer reconnects before the old connection is gone, the new one
+	// starts from scratch
+	second, secondErr := push()
+	pushNode(t, second, "b")
+	waitNodes(t, a.Graph, 1)
+	if a.Graph.GetNode("b") == nil {
+		t.Fatalf("Expected only the new connection's node")
+	}
+
+	// and the old one can't add anything anymore
+	pushNode(t, first, "c")
+	select {
+	case err := <-firstErr:
+		if err == nil {
+			t.Errorf("Expected the old connection to be replaced")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Old connection never ended")
+	}
+	if a.Graph.GetNode("c") != nil {
+		t.Errorf("Old connection added a node after it was replaced")
+	}
+
+	// once the current connection is gone, so is what it pushed
+	second.Close()
+	if err := <-secondErr; err != nil {
+		t.Errorf("Unexpected error from the push connection: %v", err)
+	}
+	waitNodes(t, a.Graph, 0)
+}
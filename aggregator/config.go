@@ -0,0 +1,45 @@
+package aggregator
+
+import (
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	// peers push their graph events to us, instead of us subscribing to them.
+	// Peers only push if they are configured to, so this is off by default
+	Push bool `yaml:"push"`
+
+	// only aggregate the peers we own on the hash ring of aggregators (when
+	// peers push to us, they decide which aggregator they push to)
+	Shard bool `yaml:"shard"`
+	// our weight on the hash ring, relative to the other aggregators
+	Weight int `yaml:"weight"`
+	// how long we keep aggregating a peer after it moves to another aggregator
+	HandoffDelay time.Duration `yaml:"handoff_delay"`
+
+	// port the peers' HTTP APIs are listening on (for subscribing to them),
+	// only used for peers which don't advertise it
+	PeerPort int `yaml:"peer_port"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Weight:       1,
+		HandoffDelay: time.Second * 10,
+		PeerPort:     12345,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Weight <= 0 {
+		return fmt.Errorf("weight must be > 0, got %d", c.Weight)
+	}
+	if c.HandoffDelay < 0 {
+		return fmt.Errorf("handoff_delay must be >= 0, got %v", c.HandoffDelay)
+	}
+	if c.PeerPort <= 0 || c.PeerPort > 65535 {
+		return fmt.Errorf("peer_port must be a valid port, got %d", c.PeerPort)
+	}
+	return nil
+}
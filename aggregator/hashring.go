@@ -0,0 +1,116 @@
+package aggregator
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Number of points on the ring for each unit of weight
+const hashRingReplicas = 64
+
+// HashRing is a weighted consistent hash ring, used to shard peers across
+// aggregators. Adding or removing a member only moves the keys owned by that
+// member
+type HashRing struct {
+	// member -> weight
+	members map[string]int
+
+	// sorted hashes of all the points on the ring
+	points []uint32
+	// point -> member
+	owners map[uint32]string
+
+	lock *sync.RWMutex
+}
+
+func NewHashRing() *HashRing {
+	return &HashRing{
+		members: make(map[string]int),
+		owners:  make(map[uint32]string),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+// Add (or re-weight) a member, returns whether the ring changed
+func (h *HashRing) Add(member string, weight int) bool {
+	if weight <= 0 {
+		weight = 1
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if w, ok := h.members[member]; ok && w == weight {
+		return false
+	}
+	h.members[member] = weight
+	h.build()
+	return true
+}
+
+// Remove a member, returns whether the ring changed
+func (h *HashRing) Remove(member string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.members[member]; !ok {
+		return false
+	}
+	delete(h.members, member)
+	h.build()
+	return true
+}
+
+// Get the member which owns `key`, or "" if the ring is empty
+func (h *HashRing) Get(key string) string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= hash })
+	// wrap around
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+func (h *HashRing) Len() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.members)
+}
+
+// rebuild the points on the ring, callers must hold the lock
+func (h *HashRing) build() {
+	h.points = h.points[:0]
+	h.owners = make(map[uint32]string)
+	for member, weight := range h.members {
+		for i := 0; i < weight*hashRingReplicas; i++ {
+			hash := hashKey(member + "#" + strconv.Itoa(i))
+			// on a collision the lowest name wins, so every node agrees
+			if owner, ok := h.owners[hash]; ok && owner < member {
+				continue
+			}
+			if _, ok := h.owners[hash]; !ok {
+				h.points = append(h.points, hash)
+			}
+			h.owners[hash] = member
+		}
+	}
+	sort.Sort(uint32Slice(h.points))
+}
+
+// crc32 and friends spread similar keys (like IPs) poorly, so we use md5
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,64 @@
+package aggregator
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingEmpty(t *testing.T) {
+	h := NewHashRing()
+	if owner := h.Get("foo"); owner != "" {
+		t.Errorf("empty ring returned an owner: %s", owner)
+	}
+}
+
+// Adding a member should only move keys to the new member
+func TestHashRingConsistent(t *testing.T) {
+	h := NewHashRing()
+	h.Add("a", 1)
+	h.Add("b", 1)
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "peer" + strconv.Itoa(i)
+		before[key] = h.Get(key)
+	}
+
+	h.Add("c", 1)
+	moved := 0
+	for key, owner := range before {
+		newOwner := h.Get(key)
+		if newOwner != owner {
+			if newOwner != "c" {
+				t.Errorf("key %s moved from %s to %s, instead of the new member", key, owner, newOwner)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Errorf("no keys moved to the new member")
+	}
+
+	// removing it should put everything back
+	h.Remove("c")
+	for key, owner := range before {
+		if newOwner := h.Get(key); newOwner != owner {
+			t.Errorf("key %s owned by %s instead of %s after removal", key, newOwner, owner)
+		}
+	}
+}
+
+func TestHashRingWeight(t *testing.T) {
+	h := NewHashRing()
+	h.Add("a", 1)
+	h.Add("b", 3)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[h.Get("peer"+strconv.Itoa(i))]++
+	}
+	// b should have roughly 3x as many, leave lots of room for hashing
+	if counts["b"] < counts["a"]*2 {
+		t.Errorf("weights not respected a=%d b=%d", counts["a"], counts["b"])
+	}
+}
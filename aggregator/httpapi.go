@@ -1,34 +1,40 @@
 package aggregator
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/eventstream"
 	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/graphapi"
 	"github.com/jacksontj/dnms/mapper"
-	"github.com/jacksontj/eventsource"
 )
 
 type HTTPApi struct {
 	p *AggGraphMap
 
-	eventBroker *eventsource.Server
+	events  *eventstream.Server
+	queries *graphapi.Queries
 }
 
 func NewHTTPApi(p *AggGraphMap) *HTTPApi {
 	api := &HTTPApi{
-		p:           p,
-		eventBroker: eventsource.NewServer(),
+		p:       p,
+		events:  eventstream.NewServer(p.Graph, p.RouteMap, p.Faults),
+		queries: graphapi.NewQueries(p.Graph, p.RouteMap),
 	}
 
 	// TODO: config
-	api.eventBroker.AllowCORS = true
+	api.events.AllowCORS = true
 
 	return api
 }
 
-func (h *HTTPApi) Start(mux *http.ServeMux) {
+// Register our endpoints on `mux` and start streaming events, until `ctx` is
+// done
+func (h *HTTPApi) Start(ctx context.Context, mux *http.ServeMux) {
 	// TODO: think more about the namespacing of this API. Most thing belong to "mapper"
 	// but probably want to separate by "topology" "routing" or something like that
 
@@ -37,30 +43,34 @@ func (h *HTTPApi) Start(mux *http.ServeMux) {
 	mux.HandleFunc("/v1/aggregator/graph/nodes", h.showNodes)
 	mux.HandleFunc("/v1/aggregator/graph/edges", h.showEdges)
 	mux.HandleFunc("/v1/aggregator/graph/routes", h.showRoutes)
-
-	// TODO: aggregate mapper data
+	mux.HandleFunc("/v1/aggregator/graph/roundtrips", h.showRoundTrips)
+	// queries, so we don't need the whole graph to find out what uses a node
+	h.queries.Register(mux, "/v1/aggregator/graph")
+	// how the graph's event subscribers are keeping up
+	mux.HandleFunc("/v1/aggregator/graph/subscribers", h.showSubscribers)
+
+	// Mapper endpoints
+	// all the peers we are aggregating
+	mux.HandleFunc("/v1/aggregator/peers", h.showPeers)
+	// routemap endpoints
+	mux.HandleFunc("/v1/aggregator/routemap", h.showRouteMap)
+	// which routes src -> dst use
+	mux.HandleFunc("/v1/aggregator/routemap/routes", h.showRouteMapRoutes)
+	// which src -> dst pairs go over a link
+	mux.HandleFunc("/v1/aggregator/routemap/link", h.showRouteMapLink)
+
+	// peers push their graph events here
+	mux.HandleFunc("/v1/aggregator/push", h.handlePush)
+
+	// Fault endpoints
+	mux.HandleFunc("/v1/aggregator/faults", h.showFaults)
 
 	// event endpoint
-	mux.HandleFunc("/v1/aggregator/events/graph", h.eventStreamGraph)
-	// Create event listener to pull events from mapper and push into eventBroker
+	mux.Handle("/v1/aggregator/events/graph", h.events)
+	// disconnect everyone streaming events once we are done
 	go func() {
-		for {
-			// TODO: configurable buffer size?
-			c := make(chan *graph.Event, 100)
-			// subscriber
-			h.p.Graph.Subscribe(c)
-
-			for {
-				event, closed := <-c
-				// TODO: something to catch up? we'll have dropped events at least :/
-				if !closed {
-					logrus.Infof("Graph subscriber channel was closed, we might drop some messages")
-					break
-				}
-				h.eventBroker.Publish([]string{"mapper"}, event)
-			}
-		}
-
+		<-ctx.Done()
+		h.events.Close()
 	}()
 }
 
@@ -116,47 +126,122 @@ func (h *HTTPApi) showRoutes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *HTTPApi) showRoundTrips(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.p.Graph.RoundTrips())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Graph.RoundTrips: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+func (h *HTTPApi) showSubscribers(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.p.Graph.Subscriptions())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Graph.Subscriptions: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
 func (h *HTTPApi) showPeers(w http.ResponseWriter, r *http.Request) {
-	// TODO
-	/*
-		peers := make([]*mapper.Peer, 0)
-		for peer := range h.p.IterPeers() {
-			peers = append(peers, peer)
-		}
-		ret, err := json.Marshal(peers)
-		if err != nil {
-			logrus.Errorf("Unable to marshal Peers: %v", err)
-		} else {
-			h.setCommonHeaders(w)
-			w.Write(ret)
-		}
-	*/
+	ret, err := json.Marshal(h.p.Peers())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Peers: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
 }
 
-// TODO: have an event stream per API endpoint?
-func (h *HTTPApi) eventStreamGraph(w http.ResponseWriter, r *http.Request) {
-	graphC := h.p.Graph.EventDumpChannel()
-	preloadChannel := make(chan eventsource.Event, 0)
+func (h *HTTPApi) showRouteMap(w http.ResponseWriter, r *http.Request) {
+	options := make(map[string]*mapper.RouteOption)
+	for _, o := range h.p.RouteMap.Options() {
+		options[o.Key] = o
+	}
+	ret, err := json.Marshal(options)
+	if err != nil {
+		logrus.Errorf("Unable to marshal RouteMap: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
 
-	// goroutine to Convert graph.Event to eventsource.Event
-	go func() {
-		for {
-			e, ok := <-graphC
-			if !ok {
-				break
-			}
-			preloadChannel <- e
+// A route and the src -> dst pairs which use it
+type routeUsage struct {
+	// nil if the route isn't in our graph (yet)
+	Route *graph.NetworkRoute `json:"route,omitempty"`
+	// keys of the route options
+	Options []string `json:"options"`
+}
+
+// ?src=name[:port]&dst=name[:port], either can be left out to match all
+func (h *HTTPApi) showRouteMapRoutes(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	usage := make(map[string]*routeUsage)
+	for _, o := range h.p.RouteMap.Between(q.Get("src"), q.Get("dst")) {
+		u, ok := usage[o.Route]
+		if !ok {
+			u = &routeUsage{Route: h.p.Graph.GetRoute(o.Path)}
+			usage[o.Route] = u
 		}
-		close(preloadChannel)
-	}()
-	handler := h.eventBroker.Handler("mapper", preloadChannel)
-	handler(w, r)
+		u.Options = append(u.Options, o.Key)
+	}
+	ret, err := json.Marshal(usage)
+	if err != nil {
+		logrus.Errorf("Unable to marshal routes: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+// ?src=node&dst=node of the link
+func (h *HTTPApi) showRouteMapLink(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("src") == "" || q.Get("dst") == "" {
+		http.Error(w, "src and dst are required", http.StatusBadRequest)
+		return
+	}
+	ret, err := json.Marshal(h.p.RouteMap.Traversing(q.Get("src"), q.Get("dst")))
+	if err != nil {
+		logrus.Errorf("Unable to marshal route options: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
 }
 
-func httpAPI(m *mapper.Mapper) {
-	// Create helpful HTTP endpoint for debugging
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func (h *HTTPApi) showFaults(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.p.Faults.Faults())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Faults: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+func (h *HTTPApi) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "push requires a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	peer := r.URL.Query().Get("peer")
+	if peer == "" {
+		http.Error(w, "missing peer", http.StatusBadRequest)
+		return
+	}
 
-	})
-	go http.ListenAndServe(":12345", nil)
+	logrus.Infof("peer %s connected to push", peer)
+	err := h.p.HandlePush(peer, r.Body)
+	if err != nil {
+		logrus.Infof("push connection from %s closed: %v", peer, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else {
+		logrus.Infof("push connection from %s closed", peer)
+	}
 }
@@ -5,12 +5,22 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
 )
 
 // This wraps graph.NetworkGraph to keep track of a given peer's refcounts on the
 // graph, so that when a peer goes away we can cleanup after it
 type PeerGraphMap struct {
-	Name      string
+	Name string
+	// event stream of the peer's graph, empty if the peer pushes to us
+	URL string
+	// number of push connections we've had from the peer, so we know which
+	// one is the current one. pushLock is held while a push connection checks
+	// it's current and applies an event, so a replaced one can't race the new
+	// one's cleanup
+	pushGen  int
+	pushLock *sync.Mutex
+
 	nodesMap  map[*graph.NetworkNode]int
 	nodesLock *sync.RWMutex
 
@@ -20,15 +30,26 @@ type PeerGraphMap struct {
 	routesMap  map[*graph.NetworkRoute]int
 	routesLock *sync.RWMutex
 
+	// the peer's RouteMap entries (key -> option)
+	optionsMap map[string]*mapper.RouteOption
+	// options we had before the peer started sending its RouteMap again,
+	// which it hasn't sent yet
+	staleOptions map[string]bool
+	optionsLock  *sync.RWMutex
+
 	// pointer to the graph for us to use
 	Graph *graph.NetworkGraph
+	// and the aggregated RouteMap
+	RouteMap *AggRouteMap
 
 	subscriberExit chan bool
 }
 
-func NewPeerGraphMap(name string, g *graph.NetworkGraph) *PeerGraphMap {
+func NewPeerGraphMap(name, url string, g *graph.NetworkGraph, rm *AggRouteMap) *PeerGraphMap {
 	p := &PeerGraphMap{
 		Name:       name,
+		URL:        url,
+		pushLock:   &sync.Mutex{},
 		nodesMap:   make(map[*graph.NetworkNode]int),
 		nodesLock:  &sync.RWMutex{},
 		linksMap:   make(map[*graph.NetworkLink]int),
@@ -36,13 +57,18 @@ func NewPeerGraphMap(name string, g *graph.NetworkGraph) *PeerGraphMap {
 		routesMap:  make(map[*graph.NetworkRoute]int),
 		routesLock: &sync.RWMutex{},
 
-		Graph: g,
+		optionsMap:   make(map[string]*mapper.RouteOption),
+		staleOptions: make(map[string]bool),
+		optionsLock:  &sync.RWMutex{},
+
+		Graph:    g,
+		RouteMap: rm,
 	}
 
 	// subscribe
-	c := Subscribe(p)
-
-	p.subscriberExit = c
+	if url != "" {
+		p.subscriberExit = Subscribe(p)
+	}
 
 	return p
 }
@@ -92,6 +118,8 @@ func (p *PeerGraphMap) addLink(l *graph.NetworkLink) {
 		p.linksMap[link] = 0
 	}
 	p.linksMap[link]++
+	// each peer has its own view of the link's health
+	link.MergeReport(p.Name, l.LinkMetrics)
 }
 
 func (p *PeerGraphMap) RemoveLink(l *graph.NetworkLink) {
@@ -104,6 +132,11 @@ func (p *PeerGraphMap) removeLink(l *graph.NetworkLink) {
 	link, removed := p.Graph.DecrLink(l.SrcName, l.DstName)
 	p.linksMap[link]--
 
+	// once we no longer reference the link, our view of its health goes away
+	if link != nil && !removed && p.linksMap[link] == 0 {
+		link.RemoveReport(p.Name)
+	}
+
 	if removed && p.linksMap[link] != 0 {
 		logrus.Warningf("link removed from graph, even when we have %d refcounts to it!", p.linksMap[link])
 	}
@@ -147,8 +180,70 @@ func (p *PeerGraphMap) removeRoute(r *graph.NetworkRoute) {
 
 }
 
+func (p *PeerGraphMap) AddRouteOption(o *mapper.RouteOption) {
+	p.optionsLock.Lock()
+	defer p.optionsLock.Unlock()
+	// the peer only has one route per key, so this is just a new route
+	if _, ok := p.optionsMap[o.Key]; ok {
+		p.RouteMap.UpdateOption(o)
+	} else {
+		p.RouteMap.IncrOption(o)
+	}
+	p.optionsMap[o.Key] = o
+	delete(p.staleOptions, o.Key)
+}
+
+func (p *PeerGraphMap) RemoveRouteOption(o *mapper.RouteOption) {
+	p.optionsLock.Lock()
+	defer p.optionsLock.Unlock()
+	if _, ok := p.optionsMap[o.Key]; !ok {
+		return
+	}
+	p.RouteMap.DecrOption(o.Key)
+	delete(p.optionsMap, o.Key)
+	delete(p.staleOptions, o.Key)
+}
+
+// The peer is about to send us its whole RouteMap again, anything it doesn't
+// send was removed while we weren't listening
+func (p *PeerGraphMap) markOptionsStale() {
+	p.optionsLock.Lock()
+	defer p.optionsLock.Unlock()
+	for key := range p.optionsMap {
+		p.staleOptions[key] = true
+	}
+}
+
+// Remove the options the peer didn't send again
+func (p *PeerGraphMap) sweepOptions() {
+	p.optionsLock.Lock()
+	defer p.optionsLock.Unlock()
+	for key := range p.staleOptions {
+		if _, ok := p.optionsMap[key]; ok {
+			p.RouteMap.DecrOption(key)
+			delete(p.optionsMap, key)
+		}
+		delete(p.staleOptions, key)
+	}
+}
+
+func (p *PeerGraphMap) GetRouteOptionCount() int {
+	p.optionsLock.RLock()
+	defer p.optionsLock.RUnlock()
+	return len(p.optionsMap)
+}
+
 // remove all routes associated with this peer
 func (p *PeerGraphMap) cleanup() {
+	// remove all route options
+	p.optionsLock.Lock()
+	for key := range p.optionsMap {
+		p.RouteMap.DecrOption(key)
+		delete(p.optionsMap, key)
+	}
+	p.staleOptions = make(map[string]bool)
+	p.optionsLock.Unlock()
+
 	// remove all routes
 	p.routesLock.Lock()
 	for route, count := range p.routesMap {
@@ -181,5 +276,7 @@ func (p *PeerGraphMap) cleanup() {
 }
 
 func (p *PeerGraphMap) Stop() {
-	p.subscriberExit <- false
+	if p.subscriberExit != nil {
+		close(p.subscriberExit)
+	}
 }
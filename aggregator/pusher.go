@@ -0,0 +1,221 @@
+package aggregator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+	"github.com/jacksontj/eventsource"
+)
+
+// How often we send a heartbeat down an idle push connection, so a dead
+// aggregator is noticed even when the graph isn't changing
+const pushHeartbeatInterval = time.Second * 10
+
+// Longest we'll wait between reconnect attempts
+const pushMaxBackoff = time.Second * 30
+
+// A single event on a push connection. Connections are a stream of these as
+// newline delimited JSON
+type pushMessage struct {
+	Type    string          `json:"event"`
+	Payload json.RawMessage `json:"data,omitempty"`
+}
+
+// implement eventsource.Event so the receiving side can treat these the same
+// as events it pulled
+func (m *pushMessage) Id() string {
+	return ""
+}
+
+func (m *pushMessage) Event() string {
+	return m.Type
+}
+
+func (m *pushMessage) Data() string {
+	return string(m.Payload)
+}
+
+// Pusher keeps a persistent connection to an aggregator, pushing the events of
+// our graph (and RouteMap) to it. Every (re)connection starts with a full dump
+// so the aggregator can resync
+type Pusher struct {
+	// name the aggregator knows us by
+	Name string
+	// push endpoint of the aggregator
+	URL string
+
+	Graph *graph.NetworkGraph
+	// optional
+	RouteMap *mapper.RouteMap
+
+	exitChan chan bool
+}
+
+func NewPusher(name, url string, g *graph.NetworkGraph, rm *mapper.RouteMap) *Pusher {
+	return &Pusher{
+		Name:     name,
+		URL:      url,
+		Graph:    g,
+		RouteMap: rm,
+		exitChan: make(chan bool),
+	}
+}
+
+func (p *Pusher) Start() {
+	go p.run()
+}
+
+func (p *Pusher) Stop() {
+	close(p.exitChan)
+}
+
+func (p *Pusher) run() {
+	backoff := time.Second
+	for {
+		logrus.Infof("pushing graph to aggregator: %v", p.URL)
+		start := time.Now()
+		err := p.push()
+
+		select {
+		case <-p.exitChan:
+			return
+		default:
+		}
+
+		// if the connection was up for a while, this is a new failure
+		if time.Since(start) > pushMaxBackoff {
+			backoff = time.Second
+		}
+		logrus.Errorf("Push connection to %s failed, reconnecting in %v: %v", p.URL, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-p.exitChan:
+			return
+		}
+		backoff *= 2
+		if backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+}
+
+// Run a single push connection, until it breaks
+func (p *Pusher) push() error {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	req, err := http.NewRequest("POST", p.URL+"?peer="+url.QueryEscape(p.Name), pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	respErr := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("aggregator closed the connection: %s", resp.Status)
+		}
+		// make sure the writes below don't block forever
+		pr.CloseWithError(err)
+		respErr <- err
+	}()
+
+	// The subscription starts right after the snapshot we dump, so we don't
+	// miss (or repeat) anything that happens during the dump
+	sub, snap := p.Graph.SubscribeFrom("pusher "+p.URL, "")
+	defer sub.Close()
+	// nil channel if we have no RouteMap, so we never select it
+	var rc chan *mapper.Event
+	if p.RouteMap != nil {
+		rc = make(chan *mapper.Event, 100)
+		p.RouteMap.Subscribe(rc)
+		defer p.RouteMap.Unsubscribe(rc)
+	}
+
+	enc := json.NewEncoder(pw)
+	send := func(e eventsource.Event) error {
+		return enc.Encode(&pushMessage{
+			Type:    e.Event(),
+			Payload: json.RawMessage(e.Data()),
+		})
+	}
+
+	// the aggregator drops what it had from us on a reset, so it takes the
+	// RouteMap along with it
+	sendSnapshot := func(snap *graph.Snapshot) error {
+		if snap.Reset {
+			if err := send(graph.NewResetEvent()); err != nil {
+				return err
+			}
+		}
+		for _, e := range snap.Events {
+			if err := send(e); err != nil {
+				return err
+			}
+		}
+		// not EventDumpChannel, bailing out of that would leave its goroutine
+		// blocked forever
+		if p.RouteMap != nil {
+			for _, o := range p.RouteMap.Options() {
+				if err := send(&mapper.Event{E: mapper.AddEvent, Item: o}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := sendSnapshot(snap); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(pushHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return fmt.Errorf("graph subscription is over")
+			}
+			// we've missed events, so we need to start over to get the
+			// aggregator back in sync
+			if e.Resync() {
+				logrus.Infof("Pusher fell behind on graph events, resyncing")
+				snap := sub.Resync()
+				if snap == nil {
+					return fmt.Errorf("graph subscription is over")
+				}
+				if err := sendSnapshot(snap); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case e, ok := <-rc:
+			if !ok {
+				return fmt.Errorf("routemap subscriber channel was closed, resyncing")
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := enc.Encode(&pushMessage{Type: "heartbeat"}); err != nil {
+				return err
+			}
+		case err := <-respErr:
+			return err
+		case <-p.exitChan:
+			return nil
+		}
+	}
+}
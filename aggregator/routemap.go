@@ -0,0 +1,170 @@
+package aggregator
+
+import (
+	"sync"
+
+	"github.com/jacksontj/dnms/mapper"
+)
+
+// AggRouteMap is the aggregated RouteMap of the cluster: which route every
+// src:port -> dst:port pair the peers map uses. Entries are refcounted, as
+// during a handoff two aggregators can tell a super aggregator about the same
+// peer
+type AggRouteMap struct {
+	// key -> option
+	options map[string]*mapper.RouteOption
+	// key -> number of peers which reported it
+	refs map[string]int
+	lock *sync.RWMutex
+
+	// event stuff
+	eventChannels map[chan *mapper.Event]bool
+	eventLock     *sync.Mutex
+	// subscribers we've kicked off for not keeping up
+	dropped int
+}
+
+func NewAggRouteMap() *AggRouteMap {
+	return &AggRouteMap{
+		options:       make(map[string]*mapper.RouteOption),
+		refs:          make(map[string]int),
+		lock:          &sync.RWMutex{},
+		eventChannels: make(map[chan *mapper.Event]bool),
+		eventLock:     &sync.Mutex{},
+	}
+}
+
+// Add a reference to the option, replacing whatever route we had for its key
+func (r *AggRouteMap) IncrOption(o *mapper.RouteOption) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refs[o.Key]++
+	r.options[o.Key] = o
+	r.publish(&mapper.Event{E: mapper.AddEvent, Item: o})
+}
+
+// Replace the route of an option we already have a reference to
+func (r *AggRouteMap) UpdateOption(o *mapper.RouteOption) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.options[o.Key]; !ok {
+		return
+	}
+	r.options[o.Key] = o
+	r.publish(&mapper.Event{E: mapper.AddEvent, Item: o})
+}
+
+// Drop a reference to the option, returns whether it was removed
+func (r *AggRouteMap) DecrOption(key string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	o, ok := r.options[key]
+	if !ok {
+		return false
+	}
+	r.refs[key]--
+	if r.refs[key] > 0 {
+		return false
+	}
+	delete(r.refs, key)
+	delete(r.options, key)
+	r.publish(&mapper.Event{E: mapper.RemoveEvent, Item: o})
+	return true
+}
+
+func (r *AggRouteMap) GetOption(key string) *mapper.RouteOption {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	o, _ := r.options[key]
+	return o
+}
+
+func (r *AggRouteMap) Options() []*mapper.RouteOption {
+	return r.filter(func(o *mapper.RouteOption) bool { return true })
+}
+
+// Options from src to dst. Either can be a node name, or name:port to only
+// match that port. Empty matches everything
+func (r *AggRouteMap) Between(src, dst string) []*mapper.RouteOption {
+	return r.filter(func(o *mapper.RouteOption) bool {
+		return endpointMatches(src, o.Src, o.SrcName()) && endpointMatches(dst, o.Dst, o.DstName())
+	})
+}
+
+// Options whose route goes over the link src -> dst
+func (r *AggRouteMap) Traversing(src, dst string) []*mapper.RouteOption {
+	return r.filter(func(o *mapper.RouteOption) bool {
+		return o.Traverses(src, dst)
+	})
+}
+
+func (r *AggRouteMap) filter(f func(*mapper.RouteOption) bool) []*mapper.RouteOption {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]*mapper.RouteOption, 0)
+	for _, o := range r.options {
+		if f(o) {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+func endpointMatches(want, hostport, host string) bool {
+	return want == "" || want == hostport || want == host
+}
+
+// callers must hold the lock, so events go out in the order things changed
+func (r *AggRouteMap) publish(e *mapper.Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	for c := range r.eventChannels {
+		select {
+		case c <- e:
+		default:
+			delete(r.eventChannels, c)
+			close(c)
+			r.dropped++
+		}
+	}
+}
+
+// Number of subscribers we've dropped because they couldn't keep up
+func (r *AggRouteMap) DroppedSubscribers() int {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	return r.dropped
+}
+
+// add subscriber to our events
+func (r *AggRouteMap) Subscribe(c chan *mapper.Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	r.eventChannels[c] = true
+}
+
+// remove a subscriber, closing its channel
+func (r *AggRouteMap) Unsubscribe(c chan *mapper.Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	if _, ok := r.eventChannels[c]; ok {
+		delete(r.eventChannels, c)
+		close(c)
+	}
+}
+
+// Dump all the options into a channel
+func (r *AggRouteMap) EventDumpChannel() chan *mapper.Event {
+	options := r.Options()
+	c := make(chan *mapper.Event)
+	go func() {
+		for _, o := range options {
+			c <- &mapper.Event{
+				E:    mapper.AddEvent,
+				Item: o,
+			}
+		}
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,69 @@
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/jacksontj/dnms/mapper"
+)
+
+func option(src, dst string, path ...string) *mapper.RouteOption {
+	return &mapper.RouteOption{
+		Key:  src + "," + dst,
+		Src:  src,
+		Dst:  dst,
+		Path: path,
+	}
+}
+
+func TestAggRouteMapRefcount(t *testing.T) {
+	r := NewAggRouteMap()
+	o := option("a:1", "b:2", "r1", "r2")
+	r.IncrOption(o)
+	r.IncrOption(o)
+
+	if r.DecrOption(o.Key) {
+		t.Fatalf("option removed while still referenced")
+	}
+	if r.GetOption(o.Key) == nil {
+		t.Fatalf("option missing while still referenced")
+	}
+	if !r.DecrOption(o.Key) {
+		t.Fatalf("option not removed after last reference")
+	}
+	if r.GetOption(o.Key) != nil {
+		t.Fatalf("option still there after being removed")
+	}
+	// updates don't add anything that isn't there
+	r.UpdateOption(o)
+	if r.GetOption(o.Key) != nil {
+		t.Fatalf("update added an option")
+	}
+}
+
+func TestAggRouteMapQueries(t *testing.T) {
+	r := NewAggRouteMap()
+	r.IncrOption(option("a:1", "b:2", "r1", "r2"))
+	r.IncrOption(option("a:3", "b:2", "r1", "r3"))
+	r.IncrOption(option("b:2", "a:1", "r2", "r1"))
+
+	if n := len(r.Between("a", "b")); n != 2 {
+		t.Errorf("expected 2 options a -> b, got %d", n)
+	}
+	if n := len(r.Between("a:3", "b")); n != 1 {
+		t.Errorf("expected 1 option a:3 -> b, got %d", n)
+	}
+	if n := len(r.Between("", "a")); n != 1 {
+		t.Errorf("expected 1 option to a, got %d", n)
+	}
+
+	// links are directional
+	if n := len(r.Traversing("r1", "r2")); n != 1 {
+		t.Errorf("expected 1 option over r1 -> r2, got %d", n)
+	}
+	if n := len(r.Traversing("r2", "r1")); n != 1 {
+		t.Errorf("expected 1 option over r2 -> r1, got %d", n)
+	}
+	if n := len(r.Traversing("r2", "r3")); n != 0 {
+		t.Errorf("expected no options over r2 -> r3, got %d", n)
+	}
+}
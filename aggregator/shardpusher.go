@@ -0,0 +1,102 @@
+package aggregator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+)
+
+// ShardedPusher pushes our graph to whichever aggregator owns us on the hash
+// ring of aggregators, moving to the new owner as aggregators come and go
+type ShardedPusher struct {
+	// our name on the ring
+	Name     string
+	Graph    *graph.NetworkGraph
+	RouteMap *mapper.RouteMap
+
+	// how long we keep pushing to the old owner after ownership moves
+	handoffDelay time.Duration
+
+	ring *HashRing
+	// aggregator -> push URL
+	urls map[string]string
+
+	// who we are currently pushing to
+	owner   string
+	url     string
+	current *Pusher
+	// once stopped we don't push anywhere anymore
+	stopped bool
+
+	lock *sync.Mutex
+}
+
+func NewShardedPusher(name string, g *graph.NetworkGraph, rm *mapper.RouteMap, handoffDelay time.Duration) *ShardedPusher {
+	return &ShardedPusher{
+		Name:         name,
+		Graph:        g,
+		RouteMap:     rm,
+		handoffDelay: handoffDelay,
+		ring:         NewHashRing(),
+		urls:         make(map[string]string),
+		lock:         &sync.Mutex{},
+	}
+}
+
+// Add (or update) an aggregator we could push to
+func (s *ShardedPusher) AddAggregator(name, url string, weight int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.urls[name] = url
+	s.ring.Add(name, weight)
+	s.update()
+}
+
+func (s *ShardedPusher) RemoveAggregator(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.urls, name)
+	s.ring.Remove(name)
+	s.update()
+}
+
+// Make sure we are pushing to the owner, callers must hold the lock
+func (s *ShardedPusher) update() {
+	if s.stopped {
+		return
+	}
+	owner := s.ring.Get(s.Name)
+	if owner == s.owner && s.urls[owner] == s.url {
+		return
+	}
+	logrus.Infof("Aggregator for %s moved from %q to %q", s.Name, s.owner, owner)
+
+	old := s.current
+	s.owner = owner
+	s.url = s.urls[owner]
+	s.current = nil
+	if owner != "" {
+		s.current = NewPusher(s.Name, s.url, s.Graph, s.RouteMap)
+		s.current.Start()
+	}
+
+	// keep the old one around for a bit, so the new owner can load our graph
+	// before the old one drops it
+	if old != nil {
+		time.AfterFunc(s.handoffDelay, old.Stop)
+	}
+}
+
+// Stop pushing, without waiting for a handoff
+func (s *ShardedPusher) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	if s.current != nil {
+		s.current.Stop()
+		s.current = nil
+	}
+}
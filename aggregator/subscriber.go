@@ -6,6 +6,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
 	"github.com/jacksontj/eventsource"
 )
 
@@ -14,116 +15,190 @@ import (
 func Subscribe(p *PeerGraphMap) chan bool {
 	exitChan := make(chan bool)
 	go func() {
-		var stream *eventsource.Stream
+		// defer a removal in case the peer goes away
+		defer p.cleanup()
+
+		// last event we've applied, so a reconnect can pick up from there
+		// instead of the peer sending us everything again
+		lastID := ""
 		for {
-			logrus.Infof("connecting to peer: %v", p.Name)
-			var err error
-			stream, err = eventsource.Subscribe("http://"+p.Name+":12345/v1/events/graph", "")
-			if err != nil {
-				logrus.Errorf("Error subscribing, retrying: %v", err)
-				time.Sleep(time.Second)
+			stream := connect(p, lastID, exitChan)
+			if stream == nil {
+				return
+			}
+			if lastID == "" {
+				// the new connection will re-seed everything, so we need to
+				// remove what we know about this peer
+				p.cleanup()
 			} else {
-				break
+				p.markOptionsStale()
+			}
+
+			// TODO: handle cases where we missed an event (update event will show up with no data
+			// in that case we should probably disconnect and reconnect-- assuming that
+			// we somehow missed the event
+		events:
+			for {
+				select {
+				// handle errors-- all of these mean a disconnect/reconnect
+				case err, ok := <-stream.Errors:
+					logrus.Debugf("stream error, reconnecting: %v %v", err, ok)
+					break events
+				case ev := <-stream.Events:
+					switch {
+					case ev.Event() == "resetGraphEvent":
+						// we are getting a whole dump, if we get disconnected
+						// before it is done we need to start over
+						lastID = ""
+					case ev.Id() != "":
+						lastID = ev.Id()
+					}
+					p.HandleEvent(ev)
+				case <-exitChan:
+					stream.Close()
+					return
+				}
 			}
+			// we reconnect ourselves, so we pick the event to resume from
+			stream.Close()
 		}
+	}()
+	return exitChan
+}
 
-		// defer a removal in case the peer disconnects (or blips)
-		defer p.cleanup()
+// Connect to the peer's event stream, resuming after `lastID`. Returns nil if
+// we are told to exit first
+func connect(p *PeerGraphMap, lastID string, exitChan chan bool) *eventsource.Stream {
+	for {
+		logrus.Infof("connecting to peer: %v", p.Name)
+		stream, err := eventsource.Subscribe(p.URL, lastID)
+		if err == nil {
+			return stream
+		}
+		logrus.Errorf("Error subscribing, retrying: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-exitChan:
+			return nil
+		}
+	}
+}
 
-		// TODO: handle cases where we missed an event (update event will show up with no data
-		// in that case we should probably disconnect and reconnect-- assuming that
-		// we somehow missed the event
-		for {
-			select {
-			// handle errors-- all of these mean a disconnect/reconnect
-			case err, ok := <-stream.Errors:
-				logrus.Debugf("stream error, reconnecting: %v %v", err, ok)
-				// we need to remove everything we know about this peer-- since
-				// the new connection will re-seed on the new connection
-				p.cleanup()
-			case ev := <-stream.Events:
-				switch ev.Event() {
+// Apply an event from the peer's graph to our refcounts
+func (p *PeerGraphMap) HandleEvent(ev eventsource.Event) {
+	switch ev.Event() {
 
-				// Node events
-				case "addNodeEvent":
-					n := graph.NetworkNode{}
-					err := json.Unmarshal([]byte(ev.Data()), &n)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal node: %v", err)
-					}
-					p.AddNode(&n)
-				case "updateNodeEvent":
-					n := graph.NetworkNode{}
-					err := json.Unmarshal([]byte(ev.Data()), &n)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal node: %v", err)
-					}
-					node := p.Graph.GetNode(n.Name)
-					// TODO: some sort of "merge" method
-					if node != nil {
-						node.DNSNames = n.DNSNames
-					}
-				case "removeNodeEvent":
-					n := graph.NetworkNode{}
-					err := json.Unmarshal([]byte(ev.Data()), &n)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal node: %v", err)
-					}
-					p.RemoveNode(&n)
+	// stream markers
+	case "resetGraphEvent":
+		p.cleanup()
+	case "syncGraphEvent":
+		// the peer has re-sent its RouteMap by now
+		p.sweepOptions()
 
-				// Link events
-				case "addLinkEvent":
-					l := graph.NetworkLink{}
-					err := json.Unmarshal([]byte(ev.Data()), &l)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal link: %v", err)
-					}
-					p.AddLink(&l)
-				// TODO: update event
-				case "updateLinkEvent":
-					// TODO: implement
-					// TODO: some sort of "merge" method
-				case "removeLinkEvent":
-					l := graph.NetworkLink{}
-					err := json.Unmarshal([]byte(ev.Data()), &l)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal link: %v", err)
-					}
-					p.RemoveLink(&l)
+	// Node events
+	case "addNodeEvent":
+		n := graph.NetworkNode{}
+		err := json.Unmarshal([]byte(ev.Data()), &n)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal node: %v", err)
+		}
+		p.AddNode(&n)
+	case "updateNodeEvent":
+		n := graph.NetworkNode{}
+		err := json.Unmarshal([]byte(ev.Data()), &n)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal node: %v", err)
+		}
+		node := p.Graph.GetNode(n.Name)
+		// TODO: some sort of "merge" method
+		if node != nil {
+			node.DNSNames = n.DNSNames
+			if n.Kind != "" {
+				node.SetKind(n.Kind)
+			}
+		}
+	case "removeNodeEvent":
+		n := graph.NetworkNode{}
+		err := json.Unmarshal([]byte(ev.Data()), &n)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal node: %v", err)
+		}
+		p.RemoveNode(&n)
 
-				// route events
-				case "addRouteEvent":
-					r := graph.NetworkRoute{}
-					err := json.Unmarshal([]byte(ev.Data()), &r)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal route: %v", err)
-					}
-					p.AddRoute(&r)
-				case "updateRouteEvent":
-					r := graph.NetworkRoute{}
-					err := json.Unmarshal([]byte(ev.Data()), &r)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal route: %v", err)
-					}
-					route := p.Graph.GetRoute(r.Hops())
+	// Link events
+	case "addLinkEvent":
+		l := graph.NetworkLink{}
+		err := json.Unmarshal([]byte(ev.Data()), &l)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal link: %v", err)
+		}
+		p.AddLink(&l)
+	case "updateLinkEvent":
+		l := graph.NetworkLink{}
+		err := json.Unmarshal([]byte(ev.Data()), &l)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal link: %v", err)
+		}
+		link := p.Graph.GetLink(l.Key())
+		if link != nil {
+			link.MergeReport(p.Name, l.LinkMetrics)
+		}
+	case "removeLinkEvent":
+		l := graph.NetworkLink{}
+		err := json.Unmarshal([]byte(ev.Data()), &l)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal link: %v", err)
+		}
+		p.RemoveLink(&l)
 
-					if route != nil {
-						// TODO: some sort of "merge" method
-						route.State = r.State
-					}
-				case "removeRouteEvent":
-					r := graph.NetworkRoute{}
-					err := json.Unmarshal([]byte(ev.Data()), &r)
-					if err != nil {
-						logrus.Warningf("unable to unmarshal route: %v", err)
-					}
-					p.RemoveRoute(&r)
+	// route events
+	case "addRouteEvent":
+		r := graph.NetworkRoute{}
+		err := json.Unmarshal([]byte(ev.Data()), &r)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal route: %v", err)
+		}
+		p.AddRoute(&r)
+	case "updateRouteEvent":
+		r := graph.NetworkRoute{}
+		err := json.Unmarshal([]byte(ev.Data()), &r)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal route: %v", err)
+		}
+		route := p.Graph.GetRoute(r.Hops())
 
-				}
-			case <-exitChan:
-				return
+		if route != nil {
+			// TODO: some sort of "merge" method
+			route.SetState(r.State)
+			if r.ReversePath != nil {
+				route.SetReversePath(r.ReversePath)
 			}
 		}
-	}()
-	return exitChan
+	case "removeRouteEvent":
+		r := graph.NetworkRoute{}
+		err := json.Unmarshal([]byte(ev.Data()), &r)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal route: %v", err)
+		}
+		p.RemoveRoute(&r)
+
+	// routemap events
+	case "addRouteOptionEvent":
+		o := mapper.RouteOption{}
+		err := json.Unmarshal([]byte(ev.Data()), &o)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal route option: %v", err)
+			return
+		}
+		p.AddRouteOption(&o)
+	case "removeRouteOptionEvent":
+		o := mapper.RouteOption{}
+		err := json.Unmarshal([]byte(ev.Data()), &o)
+		if err != nil {
+			logrus.Warningf("unable to unmarshal route option: %v", err)
+			return
+		}
+		p.RemoveRouteOption(&o)
+
+	}
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/jacksontj/dnms/aggregator"
+	"github.com/jacksontj/dnms/coordinate"
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+	"github.com/jacksontj/dnms/metrics"
+	"gopkg.in/yaml.v2"
+)
+
+// Config for the whole daemon. This is loaded from a YAML (or JSON, since that
+// is valid YAML) file-- anything not in the file keeps its default
+type Config struct {
+	Memberlist MemberlistConfig `yaml:"memberlist"`
+	HTTP       HTTPConfig       `yaml:"http"`
+	Mapper     *mapper.Config   `yaml:"mapper"`
+	Pinger     PingerConfig     `yaml:"pinger"`
+	Graph      *graph.Config    `yaml:"graph"`
+	Aggregator AggregatorConfig `yaml:"aggregator"`
+	Push       PushConfig       `yaml:"push"`
+	Metrics    *metrics.Config  `yaml:"metrics"`
+
+	Coordinates *coordinate.Config `yaml:"coordinates"`
+
+	// fault localization, on our graph and any we aggregate
+	Faults *fault.Config `yaml:"faults"`
+
+	SuperAggregator SuperAggregatorConfig `yaml:"super_aggregator"`
+
+	// labels we advertise to the rest of the cluster (datacenter, rack, etc.)
+	Labels map[string]string `yaml:"labels"`
+}
+
+type MemberlistConfig struct {
+	// port to gossip on
+	BindPort int `yaml:"bind_port"`
+	// address to advertise gossip on, defaults to the first non-loopback address
+	AdvertiseAddr string `yaml:"advertise_addr"`
+	// addresses to gossip with on startup
+	Peers []string `yaml:"peers"`
+}
+
+type HTTPConfig struct {
+	// address for the HTTP API to listen on
+	Addr string `yaml:"addr"`
+}
+
+type PingerConfig struct {
+	// how often we check for routes which are due to be pinged
+	PeerInterval time.Duration `yaml:"peer_interval"`
+	// how often each route is pinged
+	RouteInterval time.Duration `yaml:"route_interval"`
+	// number of pings in flight at once, and the packets per second budget
+	// they share (0 is unlimited)
+	Concurrency      int     `yaml:"concurrency"`
+	PacketsPerSecond float64 `yaml:"packets_per_second"`
+	// how long to wait for an ack
+	Timeout time.Duration `yaml:"timeout"`
+	// number of pings to send down each route at once, and the time between
+	// them. Bursts let us measure jitter, reordering and duplicates
+	BurstSize     int           `yaml:"burst_size"`
+	BurstInterval time.Duration `yaml:"burst_interval"`
+
+	// protocol to ping with (udp or tcp), and overrides per peer name. Pings
+	// take the path of the traceroute which found the route, so we only ping
+	// the routes the mapper found with this protocol (tcp needs a tcp probe)
+	Protocol      string            `yaml:"protocol"`
+	PeerProtocols map[string]string `yaml:"peer_protocols"`
+	// port of our TCP echo server for TCP pings, 0 to disable it
+	TCPPort int `yaml:"tcp_port"`
+}
+
+// The protocol we should ping `peer` with
+func (c *PingerConfig) ProtocolFor(peer string) string {
+	if protocol, ok := c.PeerProtocols[peer]; ok {
+		return protocol
+	}
+	return c.Protocol
+}
+
+type AggregatorConfig struct {
+	// are we an aggregator node?
+	Enabled           bool `yaml:"enabled"`
+	aggregator.Config `yaml:",inline"`
+}
+
+type SuperAggregatorConfig struct {
+	// are we a super aggregator? If so we aggregate the graphs of all the
+	// aggregators instead of probing
+	Enabled bool `yaml:"enabled"`
+}
+
+type PushConfig struct {
+	// HTTP addresses (host:port) of the aggregators to push our graph to
+	Aggregators []string `yaml:"aggregators"`
+	// push to the aggregator (discovered through memberlist) which owns us on
+	// the hash ring of aggregators
+	Shard bool `yaml:"shard"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Memberlist: MemberlistConfig{
+			BindPort: 33434,
+		},
+		HTTP: HTTPConfig{
+			Addr: ":12345",
+		},
+		Mapper: mapper.DefaultConfig(),
+		Pinger: PingerConfig{
+			PeerInterval:  time.Millisecond * 100,
+			RouteInterval: time.Second,
+			Timeout:       time.Second,
+			Concurrency:   64,
+			BurstSize:     1,
+			BurstInterval: time.Millisecond * 10,
+			Protocol:      UDPProtocol,
+			TCPPort:       33433,
+		},
+		Graph:       graph.DefaultConfig(),
+		Metrics:     metrics.DefaultConfig(),
+		Coordinates: coordinate.DefaultConfig(),
+		Faults:      fault.DefaultConfig(),
+		Aggregator: AggregatorConfig{
+			Config: *aggregator.DefaultConfig(),
+		},
+	}
+}
+
+// Load the config file at `path` on top of the defaults
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(buf, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	// an empty section in the file leaves us without one
+	switch {
+	case c.Mapper == nil:
+		return fmt.Errorf("mapper can't be empty")
+	case c.Graph == nil:
+		return fmt.Errorf("graph can't be empty")
+	case c.Metrics == nil:
+		return fmt.Errorf("metrics can't be empty")
+	case c.Coordinates == nil:
+		return fmt.Errorf("coordinates can't be empty")
+	case c.Faults == nil:
+		return fmt.Errorf("faults can't be empty")
+	}
+	if c.Memberlist.BindPort <= 0 || c.Memberlist.BindPort > 65535 {
+		return fmt.Errorf("memberlist.bind_port must be a valid port, got %d", c.Memberlist.BindPort)
+	}
+	if c.HTTP.Addr == "" {
+		return fmt.Errorf("http.addr is required")
+	}
+	if c.Pinger.PeerInterval < 0 {
+		return fmt.Errorf("pinger.peer_interval must be >= 0, got %v", c.Pinger.PeerInterval)
+	}
+	if c.Pinger.RouteInterval < 0 {
+		return fmt.Errorf("pinger.route_interval must be >= 0, got %v", c.Pinger.RouteInterval)
+	}
+	if c.Pinger.Timeout <= 0 {
+		return fmt.Errorf("pinger.timeout must be > 0, got %v", c.Pinger.Timeout)
+	}
+	if c.Pinger.Concurrency < 1 {
+		return fmt.Errorf("pinger.concurrency must be >= 1, got %d", c.Pinger.Concurrency)
+	}
+	if c.Pinger.PacketsPerSecond < 0 {
+		return fmt.Errorf("pinger.packets_per_second must be >= 0, got %v", c.Pinger.PacketsPerSecond)
+	}
+	if c.Pinger.BurstSize < 1 {
+		return fmt.Errorf("pinger.burst_size must be >= 1, got %d", c.Pinger.BurstSize)
+	}
+	if c.Pinger.BurstInterval < 0 {
+		return fmt.Errorf("pinger.burst_interval must be >= 0, got %v", c.Pinger.BurstInterval)
+	}
+	if !validProtocol(c.Pinger.Protocol) {
+		return fmt.Errorf("pinger.protocol must be udp or tcp, got %q", c.Pinger.Protocol)
+	}
+	for peer, protocol := range c.Pinger.PeerProtocols {
+		if !validProtocol(protocol) {
+			return fmt.Errorf("pinger.peer_protocols: %s must be udp or tcp, got %q", peer, protocol)
+		}
+	}
+	if c.Pinger.TCPPort < 0 || c.Pinger.TCPPort > 65535 {
+		return fmt.Errorf("pinger.tcp_port must be a valid port or 0, got %d", c.Pinger.TCPPort)
+	}
+	if c.Aggregator.Enabled && c.SuperAggregator.Enabled {
+		return fmt.Errorf("aggregator.enabled and super_aggregator.enabled are mutually exclusive")
+	}
+	for _, addr := range c.Push.Aggregators {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("push.aggregators: invalid address %s: %v", addr, err)
+		}
+	}
+	if err := c.Mapper.Validate(); err != nil {
+		return fmt.Errorf("mapper.%v", err)
+	}
+	if err := c.Graph.Validate(); err != nil {
+		return fmt.Errorf("graph.%v", err)
+	}
+	if err := c.Aggregator.Validate(); err != nil {
+		return fmt.Errorf("aggregator.%v", err)
+	}
+	if err := c.Metrics.Validate(); err != nil {
+		return fmt.Errorf("metrics.%v", err)
+	}
+	if err := c.Coordinates.Validate(); err != nil {
+		return fmt.Errorf("coordinates.%v", err)
+	}
+	if err := c.Faults.Validate(); err != nil {
+		return fmt.Errorf("faults.%v", err)
+	}
+	return nil
+}
+
+func validProtocol(p string) bool {
+	return p == UDPProtocol || p == TCPProtocol
+}
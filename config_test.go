@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigExample(t *testing.T) {
+	cfg, err := LoadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatalf("Unable to load the example config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Example config isn't valid: %v", err)
+	}
+}
+
+func TestLoadConfigEmptySection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnms")
+	if err != nil {
+		t.Fatalf("Unable to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("mapper:\naggregator:\n  weight: 2\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unable to load config: %v", err)
+	}
+	if cfg.Aggregator.Weight != 2 || cfg.Aggregator.PeerPort != 12345 {
+		t.Errorf("Expected the aggregator weight on top of the defaults, got %+v", cfg.Aggregator)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Expected an empty mapper section to be invalid")
+	}
+}
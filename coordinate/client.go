@@ -0,0 +1,169 @@
+package coordinate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Client keeps our own coordinate, updating it with every RTT we measure to
+// another node
+type Client struct {
+	coord  *Coordinate
+	origin *Coordinate
+	config *Config
+
+	// last AdjustmentWindowSize differences between the RTT we measured and
+	// the one we estimated
+	adjustmentIndex   int
+	adjustmentSamples []float64
+
+	// node -> last LatencyFilterSize RTTs (s) we measured to it
+	latencyFilterSamples map[string][]float64
+
+	lock *sync.RWMutex
+}
+
+func NewClient(config *Config) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Client{
+		coord:                NewCoordinate(config),
+		origin:               NewCoordinate(config),
+		config:               config,
+		adjustmentSamples:    make([]float64, config.AdjustmentWindowSize),
+		latencyFilterSamples: make(map[string][]float64),
+		lock:                 &sync.RWMutex{},
+	}, nil
+}
+
+// A copy of our coordinate
+func (c *Client) GetCoordinate() *Coordinate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.coord.Clone()
+}
+
+func (c *Client) SetCoordinate(coord *Coordinate) error {
+	if err := c.checkCoordinate(coord); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.coord = coord.Clone()
+	return nil
+}
+
+// Drop the RTTs we have for `node`, for when it goes away
+func (c *Client) ForgetNode(node string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.latencyFilterSamples, node)
+}
+
+// Estimated RTT from us to `other`
+func (c *Client) DistanceTo(other *Coordinate) time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.coord.DistanceTo(other)
+}
+
+// Update our coordinate with the `rtt` we measured to `node`, which is at
+// `other`. Returns our new coordinate
+func (c *Client) Update(node string, other *Coordinate, rtt time.Duration) (*Coordinate, error) {
+	if err := c.checkCoordinate(other); err != nil {
+		return nil, err
+	}
+	// a zero RTT would put us right on top of the other node
+	if rtt <= 0 || rtt > 10*time.Second {
+		return nil, fmt.Errorf("RTT %s out of range", rtt)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	rttSeconds := c.latencyFilter(node, rtt.Seconds())
+	c.updateVivaldi(other, rttSeconds)
+	c.updateAdjustment(other, rttSeconds)
+	c.updateGravity()
+	if !c.coord.IsValid() {
+		c.coord = NewCoordinate(c.config)
+		return nil, fmt.Errorf("coordinate went invalid, reset it")
+	}
+	return c.coord.Clone(), nil
+}
+
+func (c *Client) checkCoordinate(coord *Coordinate) error {
+	if !c.coord.IsCompatibleWith(coord) {
+		return fmt.Errorf("dimensions aren't compatible")
+	}
+	if !coord.IsValid() {
+		return fmt.Errorf("coordinate is invalid")
+	}
+	return nil
+}
+
+// Median of the last few RTTs to `node`, including `rtt`
+func (c *Client) latencyFilter(node string, rtt float64) float64 {
+	samples := append(c.latencyFilterSamples[node], rtt)
+	if len(samples) > c.config.LatencyFilterSize {
+		samples = samples[1:]
+	}
+	c.latencyFilterSamples[node] = samples
+
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+func (c *Client) updateVivaldi(other *Coordinate, rtt float64) {
+	dist := c.coord.rawDistanceTo(other)
+	if rtt < zeroThreshold {
+		rtt = zeroThreshold
+	}
+	wrongness := math.Abs(dist-rtt) / rtt
+
+	// how much to trust the sample, depending on the error of both sides
+	totalError := c.coord.Error + other.Error
+	if totalError < zeroThreshold {
+		totalError = zeroThreshold
+	}
+	weight := c.coord.Error / totalError
+
+	c.coord.Error = c.config.VivaldiCE*weight*wrongness + c.coord.Error*(1.0-c.config.VivaldiCE*weight)
+	if c.coord.Error > c.config.VivaldiErrorMax {
+		c.coord.Error = c.config.VivaldiErrorMax
+	}
+
+	delta := c.config.VivaldiCC * weight
+	force := delta * (rtt - dist)
+	c.coord = c.coord.applyForce(c.config, force, other)
+}
+
+func (c *Client) updateAdjustment(other *Coordinate, rtt float64) {
+	if c.config.AdjustmentWindowSize == 0 {
+		return
+	}
+	// the adjustment is half the average of what the raw distance is off by,
+	// the other half being on the other node
+	dist := c.coord.rawDistanceTo(other)
+	c.adjustmentSamples[c.adjustmentIndex] = rtt - dist
+	c.adjustmentIndex = (c.adjustmentIndex + 1) % c.config.AdjustmentWindowSize
+
+	sum := 0.0
+	for _, sample := range c.adjustmentSamples {
+		sum += sample
+	}
+	c.coord.Adjustment = sum / (2.0 * float64(c.config.AdjustmentWindowSize))
+}
+
+// Pull us back towards the origin, harder the further out we are
+func (c *Client) updateGravity() {
+	dist := c.origin.rawDistanceTo(c.coord)
+	force := -1.0 * math.Pow(dist/c.config.GravityRho, 2.0)
+	c.coord = c.coord.applyForce(c.config, force, c.origin)
+}
@@ -0,0 +1,66 @@
+package coordinate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestConverge(t *testing.T) {
+	// nodes on a line, 10ms apart
+	names := []string{"a", "b", "c", "d"}
+	clients := make([]*Client, len(names))
+	for i := range clients {
+		c, err := NewClient(DefaultConfig())
+		if err != nil {
+			t.Fatalf("Unable to create client: %v", err)
+		}
+		clients[i] = c
+	}
+	rtt := func(i, j int) time.Duration {
+		return time.Duration(math.Abs(float64(i-j))) * 10 * time.Millisecond
+	}
+
+	for round := 0; round < 200; round++ {
+		for i, c := range clients {
+			for j, other := range clients {
+				if i == j {
+					continue
+				}
+				if _, err := c.Update(names[j], other.GetCoordinate(), rtt(i, j)); err != nil {
+					t.Fatalf("Unable to update: %v", err)
+				}
+			}
+		}
+	}
+
+	for i, c := range clients {
+		for j, other := range clients {
+			if i == j {
+				continue
+			}
+			estimate := c.DistanceTo(other.GetCoordinate())
+			if diff := math.Abs(float64(estimate - rtt(i, j))); diff > float64(3*time.Millisecond) {
+				t.Errorf("Estimate from %s to %s is %s, expected %s", names[i], names[j], estimate, rtt(i, j))
+			}
+		}
+	}
+}
+
+func TestUpdateInvalid(t *testing.T) {
+	c, _ := NewClient(DefaultConfig())
+	other := NewCoordinate(DefaultConfig())
+	other.Vec[0] = math.NaN()
+	if _, err := c.Update("a", other, time.Millisecond); err == nil {
+		t.Errorf("Expected an invalid coordinate to be rejected")
+	}
+
+	config := DefaultConfig()
+	config.Dimensionality = 2
+	if _, err := c.Update("a", NewCoordinate(config), time.Millisecond); err == nil {
+		t.Errorf("Expected an incompatible coordinate to be rejected")
+	}
+	if _, err := c.Update("a", NewCoordinate(DefaultConfig()), 0); err == nil {
+		t.Errorf("Expected a zero RTT to be rejected")
+	}
+}
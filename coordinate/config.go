@@ -0,0 +1,72 @@
+package coordinate
+
+import (
+	"fmt"
+)
+
+// Tuning of the Vivaldi algorithm, the defaults are the ones Serf uses
+type Config struct {
+	// dimensions of the coordinate space
+	Dimensionality int `yaml:"dimensionality"`
+
+	// the highest (worst) error a coordinate can have, new ones start here
+	VivaldiErrorMax float64 `yaml:"vivaldi_error_max"`
+	// how fast the error and the coordinate react to new RTTs
+	VivaldiCE float64 `yaml:"vivaldi_ce"`
+	VivaldiCC float64 `yaml:"vivaldi_cc"`
+
+	// number of RTTs the adjustment term is averaged over, 0 disables it
+	AdjustmentWindowSize int `yaml:"adjustment_window_size"`
+
+	// smallest height (s) a coordinate can have
+	HeightMin float64 `yaml:"height_min"`
+
+	// number of RTTs per node we take the median of, to filter out spikes
+	LatencyFilterSize int `yaml:"latency_filter_size"`
+
+	// pull towards the origin (s), so the coordinates don't drift off
+	GravityRho float64 `yaml:"gravity_rho"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Dimensionality:       8,
+		VivaldiErrorMax:      1.5,
+		VivaldiCE:            0.25,
+		VivaldiCC:            0.25,
+		AdjustmentWindowSize: 20,
+		HeightMin:            10.0e-6,
+		LatencyFilterSize:    3,
+		GravityRho:           150.0,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Dimensionality <= 0 {
+		return fmt.Errorf("dimensionality must be > 0, got %d", c.Dimensionality)
+	}
+	if c.VivaldiErrorMax <= 0 {
+		return fmt.Errorf("vivaldi_error_max must be > 0, got %f", c.VivaldiErrorMax)
+	}
+	for name, v := range map[string]float64{
+		"vivaldi_ce": c.VivaldiCE,
+		"vivaldi_cc": c.VivaldiCC,
+	} {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %f", name, v)
+		}
+	}
+	if c.AdjustmentWindowSize < 0 {
+		return fmt.Errorf("adjustment_window_size must be >= 0, got %d", c.AdjustmentWindowSize)
+	}
+	if c.HeightMin < 0 {
+		return fmt.Errorf("height_min must be >= 0, got %f", c.HeightMin)
+	}
+	if c.LatencyFilterSize <= 0 {
+		return fmt.Errorf("latency_filter_size must be > 0, got %d", c.LatencyFilterSize)
+	}
+	if c.GravityRho <= 0 {
+		return fmt.Errorf("gravity_rho must be > 0, got %f", c.GravityRho)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Vivaldi network coordinates, along the lines of Serf's
+// (https://www.serf.io/docs/internals/coordinates.html). Every node places
+// itself in a euclidean space (plus a height, for the access link) such that
+// the distance between two coordinates estimates the RTT between the nodes
+package coordinate
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Coordinate is a point in the network coordinate space. Distances are in
+// seconds
+type Coordinate struct {
+	Vec []float64 `json:"vec"`
+	// how confident we are in the coordinate, lower is better
+	Error float64 `json:"error"`
+	// correction (averaged over a window of RTTs) for what the euclidean
+	// model can't capture
+	Adjustment float64 `json:"adjustment"`
+	// latency of the access link, which every RTT of the node includes
+	Height float64 `json:"height"`
+}
+
+// Anything closer than this is considered to be on top of each other
+const zeroThreshold = 1.0e-6
+
+func NewCoordinate(config *Config) *Coordinate {
+	return &Coordinate{
+		Vec:        make([]float64, config.Dimensionality),
+		Error:      config.VivaldiErrorMax,
+		Adjustment: 0,
+		Height:     config.HeightMin,
+	}
+}
+
+func (c *Coordinate) Clone() *Coordinate {
+	vec := make([]float64, len(c.Vec))
+	copy(vec, c.Vec)
+	return &Coordinate{
+		Vec:        vec,
+		Error:      c.Error,
+		Adjustment: c.Adjustment,
+		Height:     c.Height,
+	}
+}
+
+// Whether all the components are real numbers, so a bad coordinate from the
+// network can't poison ours
+func (c *Coordinate) IsValid() bool {
+	for _, v := range c.Vec {
+		if !validFloat(v) {
+			return false
+		}
+	}
+	return validFloat(c.Error) && validFloat(c.Adjustment) && validFloat(c.Height)
+}
+
+func (c *Coordinate) IsCompatibleWith(other *Coordinate) bool {
+	return len(c.Vec) == len(other.Vec)
+}
+
+// Estimated RTT to `other`
+func (c *Coordinate) DistanceTo(other *Coordinate) time.Duration {
+	dist := c.rawDistanceTo(other)
+	adjusted := dist + c.Adjustment + other.Adjustment
+	// the adjustments can't take us below the euclidean distance
+	if adjusted > 0 {
+		dist = adjusted
+	}
+	return time.Duration(dist * float64(time.Second))
+}
+
+// distance (s) without the adjustments
+func (c *Coordinate) rawDistanceTo(other *Coordinate) float64 {
+	return magnitude(diff(c.Vec, other.Vec)) + c.Height + other.Height
+}
+
+// Move the coordinate by `force` (s) away from `other`, or towards it if the
+// force is negative
+func (c *Coordinate) applyForce(config *Config, force float64, other *Coordinate) *Coordinate {
+	ret := c.Clone()
+	unit, mag := unitVectorAt(c.Vec, other.Vec)
+	ret.Vec = add(ret.Vec, mul(unit, force))
+	if mag > zeroThreshold {
+		ret.Height = (ret.Height+other.Height)*force/mag + ret.Height
+		ret.Height = math.Max(ret.Height, config.HeightMin)
+	}
+	return ret
+}
+
+func validFloat(f float64) bool {
+	return !math.IsInf(f, 0) && !math.IsNaN(f)
+}
+
+func add(a, b []float64) []float64 {
+	ret := make([]float64, len(a))
+	for i := range ret {
+		ret[i] = a[i] + b[i]
+	}
+	return ret
+}
+
+func diff(a, b []float64) []float64 {
+	ret := make([]float64, len(a))
+	for i := range ret {
+		ret[i] = a[i] - b[i]
+	}
+	return ret
+}
+
+func mul(v []float64, factor float64) []float64 {
+	ret := make([]float64, len(v))
+	for i := range v {
+		ret[i] = v[i] * factor
+	}
+	return ret
+}
+
+func magnitude(v []float64) float64 {
+	sum := 0.0
+	for _, x := range v {
+		sum += x * x
+	}
+	return math.Sqrt(sum)
+}
+
+// Unit vector pointing from `b` to `a`, and the distance between them. If
+// they are on top of each other we pick a random direction
+func unitVectorAt(a, b []float64) ([]float64, float64) {
+	ret := diff(a, b)
+	if mag := magnitude(ret); mag > zeroThreshold {
+		return mul(ret, 1.0/mag), mag
+	}
+
+	for i := range ret {
+		ret[i] = rand.Float64() - 0.5
+	}
+	if mag := magnitude(ret); mag > zeroThreshold {
+		return mul(ret, 1.0/mag), 0
+	}
+	// we managed to pick all zeros, so just go along the first axis
+	ret = make([]float64, len(ret))
+	ret[0] = 1
+	return ret, 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/jacksontj/dnms/coordinate"
+)
+
+// Version of the coordinate state we gossip on push/pull
+const coordinateStateVersion = 1
+
+// Coordinates keeps our network coordinate (updated from the RTTs the Pinger
+// measures) and the ones of the rest of the cluster, so we can estimate the
+// RTT between any two nodes
+type Coordinates struct {
+	Name   string
+	Client *coordinate.Client
+
+	// node name -> its coordinate
+	coords map[string]*coordinate.Coordinate
+	// nodes we got the coordinate of from the node itself, instead of
+	// second hand through someone else's state
+	direct map[string]bool
+	// node name -> last RTT we measured to it
+	rtts map[string]time.Duration
+	lock *sync.RWMutex
+}
+
+func NewCoordinates(name string, config *coordinate.Config) (*Coordinates, error) {
+	client, err := coordinate.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Coordinates{
+		Name:   name,
+		Client: client,
+		coords: make(map[string]*coordinate.Coordinate),
+		direct: make(map[string]bool),
+		rtts:   make(map[string]time.Duration),
+		lock:   &sync.RWMutex{},
+	}, nil
+}
+
+// Our own coordinate
+func (c *Coordinates) Local() *coordinate.Coordinate {
+	return c.Client.GetCoordinate()
+}
+
+// The coordinate of `name`, if we know it
+func (c *Coordinates) Get(name string) *coordinate.Coordinate {
+	if name == c.Name {
+		return c.Local()
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if coord, ok := c.coords[name]; ok {
+		return coord.Clone()
+	}
+	return nil
+}
+
+// Set the coordinate `name` told us it is at
+func (c *Coordinates) Set(name string, coord *coordinate.Coordinate) {
+	if name == c.Name || !c.usable(coord) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.coords[name] = coord.Clone()
+	c.direct[name] = true
+}
+
+// Forget about `name`, for when it leaves
+func (c *Coordinates) Remove(name string) {
+	c.lock.Lock()
+	delete(c.coords, name)
+	delete(c.direct, name)
+	delete(c.rtts, name)
+	c.lock.Unlock()
+	c.Client.ForgetNode(name)
+}
+
+// Update our coordinate with an `rtt` we measured to `name`
+func (c *Coordinates) Update(name string, rtt time.Duration) {
+	c.lock.Lock()
+	c.rtts[name] = rtt
+	coord, ok := c.coords[name]
+	c.lock.Unlock()
+	// we can't place ourselves relative to it until we know where it is
+	if !ok {
+		return
+	}
+	if _, err := c.Client.Update(name, coord, rtt); err != nil {
+		logrus.Debugf("Unable to update coordinate with RTT to %s: %v", name, err)
+	}
+}
+
+// Estimated RTT between `src` and `dst`
+func (c *Coordinates) EstimateRTT(src, dst string) (time.Duration, error) {
+	srcCoord := c.Get(src)
+	if srcCoord == nil {
+		return 0, fmt.Errorf("no coordinate for %s", src)
+	}
+	dstCoord := c.Get(dst)
+	if dstCoord == nil {
+		return 0, fmt.Errorf("no coordinate for %s", dst)
+	}
+	return srcCoord.DistanceTo(dstCoord), nil
+}
+
+// How a peer's estimated RTT compares to the one we measured
+type CoordinateStatus struct {
+	Name       string                 `json:"name"`
+	Coordinate *coordinate.Coordinate `json:"coordinate"`
+	// RTTs from us (ns), measured is 0 if we don't ping it
+	Estimated time.Duration `json:"estimated"`
+	Measured  time.Duration `json:"measured"`
+	// (measured - estimated) / measured
+	Divergence float64 `json:"divergence"`
+}
+
+type coordinateStatusList []CoordinateStatus
+
+func (l coordinateStatusList) Len() int           { return len(l) }
+func (l coordinateStatusList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l coordinateStatusList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// Status of all the nodes we have a coordinate for
+func (c *Coordinates) Status() []CoordinateStatus {
+	local := c.Local()
+	c.lock.RLock()
+	ret := make(coordinateStatusList, 0, len(c.coords))
+	for name, coord := range c.coords {
+		status := CoordinateStatus{
+			Name:       name,
+			Coordinate: coord.Clone(),
+			Estimated:  local.DistanceTo(coord),
+			Measured:   c.rtts[name],
+		}
+		if status.Measured > 0 {
+			status.Divergence = float64(status.Measured-status.Estimated) / float64(status.Measured)
+		}
+		ret = append(ret, status)
+	}
+	c.lock.RUnlock()
+	sort.Sort(ret)
+	return ret
+}
+
+// Whether `coord` is something we can compute distances with
+func (c *Coordinates) usable(coord *coordinate.Coordinate) bool {
+	return coord != nil && coord.IsValid() && c.Local().IsCompatibleWith(coord)
+}
+
+// What we gossip on push/pull: our coordinate, and all the ones we know
+type coordinateState struct {
+	Name   string
+	Coords map[string]*coordinate.Coordinate
+}
+
+func (c *Coordinates) LocalState() ([]byte, error) {
+	state := coordinateState{
+		Name:   c.Name,
+		Coords: make(map[string]*coordinate.Coordinate),
+	}
+	c.lock.RLock()
+	for name, coord := range c.coords {
+		state.Coords[name] = coord
+	}
+	c.lock.RUnlock()
+	state.Coords[c.Name] = c.Local()
+
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(coordinateStateVersion)
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	err := enc.Encode(state)
+	return buf.Bytes(), err
+}
+
+// Merge the state of another node. Its own coordinate is authoritative, the
+// others are only taken if they are still `members` and we haven't heard from
+// the node itself
+func (c *Coordinates) MergeRemoteState(buf []byte, members map[string]bool) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	if buf[0] != coordinateStateVersion {
+		return fmt.Errorf("unknown coordinate state version %d", buf[0])
+	}
+	state := coordinateState{}
+	if err := decode(buf[1:], &state); err != nil {
+		return err
+	}
+
+	if coord, ok := state.Coords[state.Name]; ok {
+		c.Set(state.Name, coord)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, coord := range state.Coords {
+		if name == c.Name || name == state.Name || c.direct[name] || !members[name] || !c.usable(coord) {
+			continue
+		}
+		c.coords[name] = coord
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jacksontj/dnms/aggregator"
@@ -15,22 +17,63 @@ type DNMSDelegate struct {
 
 	// for aggregation
 	AggMap *aggregator.AggGraphMap
+	// for pushing to the aggregator that owns us
+	Pusher *aggregator.ShardedPusher
+	// for super aggregation (aggregating the aggregators)
+	SuperMap *aggregator.AggGraphMap
 
 	Mlist *memberlist.Memberlist
+
+	// our network coordinate, and the cluster's
+	Coords *Coordinates
+
+	// encoded NodeMeta we advertise
+	meta     []byte
+	metaLock *sync.RWMutex
+
+	// what the other nodes have advertised: nodeName -> meta
+	nodeMeta     map[string]*NodeMeta
+	nodeMetaLock *sync.Mutex
 }
 
 func NewDNMSDelegate(m *mapper.Mapper, a *aggregator.AggGraphMap) *DNMSDelegate {
 	return &DNMSDelegate{
-		Mapper: m,
-		AggMap: a,
+		Mapper:       m,
+		AggMap:       a,
+		metaLock:     &sync.RWMutex{},
+		nodeMeta:     make(map[string]*NodeMeta),
+		nodeMetaLock: &sync.Mutex{},
+	}
+}
+
+// Set the meta we advertise to the rest of the cluster
+func (d *DNMSDelegate) SetMeta(meta *NodeMeta) error {
+	buf, err := encodeMeta(meta)
+	if err != nil {
+		return err
+	}
+	d.metaLock.Lock()
+	d.meta = buf
+	d.metaLock.Unlock()
+
+	// let everyone know it changed
+	if d.Mlist != nil {
+		return d.Mlist.UpdateNode(time.Second)
 	}
+	return nil
 }
 
 // NodeMeta is used to retrieve meta-data about the current node
 // when broadcasting an alive message. It's length is limited to
 // the given byte size. This metadata is available in the Node structure.
 func (d *DNMSDelegate) NodeMeta(limit int) []byte {
-	return nil
+	d.metaLock.RLock()
+	defer d.metaLock.RUnlock()
+	if len(d.meta) > limit {
+		logrus.Errorf("NodeMeta is %d bytes, which is over the limit of %d. Not sending any", len(d.meta), limit)
+		return nil
+	}
+	return d.meta
 }
 
 // NotifyMsg is called when a user-data message is received.
@@ -53,6 +96,15 @@ func (d *DNMSDelegate) NotifyMsg(buf []byte) {
 
 		a := ack{
 			PingTimeNS: p.PingTimeNS,
+			Burst:      p.Burst,
+			Seq:        p.Seq,
+		}
+		if d.Coords != nil {
+			a.Coord = d.Coords.Local()
+		}
+		// let them know which way the acks come back
+		if d.Mapper != nil {
+			a.Path = d.Mapper.ReversePath(p.SrcName, p.Path)
 		}
 
 		// Encode as a user message
@@ -91,7 +143,15 @@ func (d *DNMSDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 // data can be sent here. See MergeRemoteState as well. The `join`
 // boolean indicates this is for a join instead of a push/pull.
 func (d *DNMSDelegate) LocalState(join bool) []byte {
-	return nil
+	if d.Coords == nil {
+		return nil
+	}
+	buf, err := d.Coords.LocalState()
+	if err != nil {
+		logrus.Errorf("Unable to encode coordinates: %v", err)
+		return nil
+	}
+	return buf
 }
 
 // MergeRemoteState is invoked after a TCP Push/Pull. This is the
@@ -99,7 +159,75 @@ func (d *DNMSDelegate) LocalState(join bool) []byte {
 // remote side's LocalState call. The 'join'
 // boolean indicates this is for a join instead of a push/pull.
 func (d *DNMSDelegate) MergeRemoteState(buf []byte, join bool) {
+	if d.Coords == nil || d.Mlist == nil {
+		return
+	}
+	members := make(map[string]bool)
+	for _, n := range d.Mlist.Members() {
+		members[n.Addr.String()] = true
+	}
+	if err := d.Coords.MergeRemoteState(buf, members); err != nil {
+		logrus.Warningf("Unable to merge coordinates: %v", err)
+	}
+}
+
+// Decode the meta of a node-- falling back to the defaults if we can't
+func (d *DNMSDelegate) decodeNodeMeta(n *memberlist.Node) *NodeMeta {
+	meta, err := decodeMeta(n.Meta)
+	if err != nil {
+		logrus.Debugf("Unable to decode meta of %s, using defaults: %v", n.Addr.String(), err)
+		return defaultNodeMeta()
+	}
+	return meta
+}
+
+func peerFor(n *memberlist.Node, meta *NodeMeta) mapper.Peer {
+	return mapper.Peer{
+		Name:    n.Addr.String(),
+		Port:    int(n.Port),
+		TCPPort: meta.TCPPingPort,
+		Labels:  meta.Labels,
+	}
+}
 
+// Whether we should be mapping the node
+func (d *DNMSDelegate) maps(n *memberlist.Node, meta *NodeMeta) bool {
+	return meta.Probes() && d.Mapper.Selects(peerFor(n, meta))
+}
+
+// Whether we should be aggregating the node
+func (d *DNMSDelegate) aggregates(meta *NodeMeta) bool {
+	return d.AggMap != nil && meta.Probes()
+}
+
+// Keep track of the aggregators in the cluster, for sharding
+func (d *DNMSDelegate) updateAggregator(n *memberlist.Node, oldMeta, newMeta *NodeMeta) {
+	name := n.Addr.String()
+	if newMeta != nil && newMeta.Role == AggregatorRole {
+		if d.AggMap != nil {
+			d.AggMap.AddAggregator(name, newMeta.Weight)
+		}
+		if d.Pusher != nil {
+			d.Pusher.AddAggregator(name, newMeta.PushURL(name), newMeta.Weight)
+		}
+		if d.SuperMap != nil {
+			// if it moved, start over
+			if oldMeta != nil && oldMeta.Role == AggregatorRole && oldMeta.HTTPEndpoint(name) != newMeta.HTTPEndpoint(name) {
+				d.SuperMap.RemovePeer(name)
+			}
+			d.SuperMap.AddPeer(name, newMeta.HTTPEndpoint(name))
+		}
+	} else if oldMeta != nil && oldMeta.Role == AggregatorRole {
+		if d.AggMap != nil {
+			d.AggMap.RemoveAggregator(name)
+		}
+		if d.Pusher != nil {
+			d.Pusher.RemoveAggregator(name)
+		}
+		if d.SuperMap != nil {
+			d.SuperMap.RemovePeer(name)
+		}
+	}
 }
 
 // Event delegate methods
@@ -110,36 +238,86 @@ func (d *DNMSDelegate) NotifyJoin(n *memberlist.Node) {
 	if d.Mlist == nil {
 		return
 	}
-	logrus.Infof("Node joined %s", n.Addr.String())
+	meta := d.decodeNodeMeta(n)
+	d.nodeMetaLock.Lock()
+	d.nodeMeta[n.Name] = meta
+	d.nodeMetaLock.Unlock()
+
+	logrus.Infof("Node joined %s role=%s version=%s", n.Addr.String(), meta.Role, meta.Version)
 	// TOOD: check it isn't us? shouldn't be as that should be covered by our
 	// workaround up top
-	go d.Mapper.AddPeer(mapper.Peer{
-		Name: n.Addr.String(),
-		Port: int(n.Port),
-	})
+	if d.maps(n, meta) {
+		go d.Mapper.AddPeer(peerFor(n, meta))
+	}
 
 	// if we are an aggregator
-	if d.AggMap != nil {
-		d.AggMap.AddPeer(n.Addr.String())
+	if d.aggregates(meta) {
+		d.AggMap.AddPeer(n.Addr.String(), meta.HTTPEndpoint(n.Addr.String()))
 	}
+	d.updateAggregator(n, nil, meta)
 }
 
 // NotifyLeave is invoked when a node is detected to have left.
 // The Node argument must not be modified.
 func (d *DNMSDelegate) NotifyLeave(n *memberlist.Node) {
 	logrus.Infof("Node left %s", n.Addr.String())
-	go d.Mapper.RemovePeer(mapper.Peer{
-		Name: n.Addr.String(),
-		Port: int(n.Port),
-	})
+	d.nodeMetaLock.Lock()
+	meta, ok := d.nodeMeta[n.Name]
+	delete(d.nodeMeta, n.Name)
+	d.nodeMetaLock.Unlock()
+	if !ok {
+		meta = d.decodeNodeMeta(n)
+	}
+
+	if d.maps(n, meta) {
+		go d.Mapper.RemovePeer(peerFor(n, meta))
+	}
 	// if we are an aggregator
-	if d.AggMap != nil {
+	if d.aggregates(meta) {
 		d.AggMap.RemovePeer(n.Addr.String())
 	}
+	d.updateAggregator(n, meta, nil)
+	if d.Coords != nil {
+		d.Coords.Remove(n.Addr.String())
+	}
 }
 
 // NotifyUpdate is invoked when a node is detected to have
 // updated, usually involving the meta data. The Node argument
 // must not be modified.
-func (d *DNMSDelegate) NotifyUpdate(*memberlist.Node) {
+func (d *DNMSDelegate) NotifyUpdate(n *memberlist.Node) {
+	if d.Mlist == nil {
+		return
+	}
+	newMeta := d.decodeNodeMeta(n)
+	d.nodeMetaLock.Lock()
+	oldMeta, ok := d.nodeMeta[n.Name]
+	d.nodeMeta[n.Name] = newMeta
+	d.nodeMetaLock.Unlock()
+	// if we didn't know about it, this is effectively a join
+	if !ok {
+		oldMeta = &NodeMeta{}
+	}
+	logrus.Infof("Node updated %s role=%s version=%s", n.Addr.String(), newMeta.Role, newMeta.Version)
+
+	wasMapped, isMapped := d.maps(n, oldMeta), d.maps(n, newMeta)
+	switch {
+	case wasMapped && !isMapped:
+		go d.Mapper.RemovePeer(peerFor(n, oldMeta))
+	case !wasMapped && isMapped:
+		go d.Mapper.AddPeer(peerFor(n, newMeta))
+	case isMapped:
+		go d.Mapper.UpdatePeer(peerFor(n, newMeta))
+	}
+
+	name := n.Addr.String()
+	wasAggregated, isAggregated := d.aggregates(oldMeta), d.aggregates(newMeta)
+	endpointChanged := oldMeta.HTTPEndpoint(name) != newMeta.HTTPEndpoint(name)
+	if wasAggregated && (!isAggregated || endpointChanged) {
+		d.AggMap.RemovePeer(name)
+	}
+	if isAggregated && (!wasAggregated || endpointChanged) {
+		d.AggMap.AddPeer(name, newMeta.HTTPEndpoint(name))
+	}
+	d.updateAggregator(n, oldMeta, newMeta)
 }
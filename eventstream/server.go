@@ -0,0 +1,170 @@
+package eventstream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+	"github.com/jacksontj/eventsource"
+)
+
+// The RouteMap of the graph, the peer's or the aggregated one
+type RouteMap interface {
+	Subscribe(c chan *mapper.Event)
+	Unsubscribe(c chan *mapper.Event)
+	EventDumpChannel() chan *mapper.Event
+}
+
+// Server streams a graph's events (along with its RouteMap and faults) as
+// server-sent events. Every client gets its own subscriptions, so it sees
+// every graph event exactly once: what it missed since its Last-Event-ID (or
+// the whole graph if we can't replay that) and then everything after it
+type Server struct {
+	Graph    *graph.NetworkGraph
+	RouteMap RouteMap
+	Faults   *fault.Locator
+
+	// buffer of each client's RouteMap and fault subscriptions (the graph's
+	// queue_size by default). If the RouteMap one fills up the client is
+	// disconnected and has to resume, the faults (like graph events, which are
+	// queued by the graph) are reset in place instead
+	BufferSize int
+	AllowCORS  bool
+
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func NewServer(g *graph.NetworkGraph, rm RouteMap, f *fault.Locator) *Server {
+	return &Server{
+		Graph:      g,
+		RouteMap:   rm,
+		Faults:     f,
+		BufferSize: g.GetQueueSize(),
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+}
+
+// Disconnect everyone
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe to the RouteMap and faults before we dump them, so nothing
+	// can happen in between (getting something twice is fine)
+	routeC := make(chan *mapper.Event, s.BufferSize)
+	s.RouteMap.Subscribe(routeC)
+	defer s.RouteMap.Unsubscribe(routeC)
+	faultC := make(chan *fault.Event, s.BufferSize)
+	s.Faults.Subscribe(faultC)
+	defer s.Faults.Unsubscribe(faultC)
+	sub, snap := s.Graph.SubscribeFrom("eventstream "+r.RemoteAddr, r.Header.Get("Last-Event-ID"))
+	defer sub.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Connection", "keep-alive")
+	if s.AllowCORS {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// once a write fails the client is gone, but we still need to drain the
+	// dumps
+	var err error
+	send := func(e eventsource.Event) {
+		if err == nil {
+			err = writeEvent(w, e)
+		}
+	}
+	sendSnapshot := func(snap *graph.Snapshot) {
+		if snap.Reset {
+			send(graph.NewResetEvent())
+		}
+		for _, e := range snap.Events {
+			send(e)
+		}
+		// then which peers use which routes
+		for e := range s.RouteMap.EventDumpChannel() {
+			send(e)
+		}
+		// once the graph is loaded, send the faults in it
+		for e := range s.Faults.EventDumpChannel() {
+			send(e)
+		}
+		send(graph.NewSyncEvent(snap.ID))
+		flusher.Flush()
+	}
+	sendSnapshot(snap)
+
+	for err == nil {
+		// a closed channel means we didn't keep up (or we are stopping), the
+		// client can resume from the last event it got
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			// the client missed events, so it starts over with everything
+			if e.Resync() {
+				snap := sub.Resync()
+				if snap == nil {
+					return
+				}
+				sendSnapshot(snap)
+				continue
+			}
+			send(e)
+		case e, ok := <-routeC:
+			if !ok {
+				return
+			}
+			send(e)
+		case e, ok := <-faultC:
+			if !ok {
+				return
+			}
+			send(e)
+			// the client missed some, so it gets all of them again
+			if e.Reset() {
+				for e := range s.Faults.EventDumpChannel() {
+					send(e)
+				}
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Write `e` in the event stream format
+func writeEvent(w io.Writer, e eventsource.Event) error {
+	buf := &bytes.Buffer{}
+	if id := e.Id(); id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	buf.WriteString("event: " + e.Event() + "\n")
+	for _, line := range strings.Split(e.Data(), "\n") {
+		buf.WriteString("data: " + line + "\n")
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,81 @@
+package eventstream
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+)
+
+// Read events off the stream until the sync event, returning "id event" for
+// each of them
+func readUntilSync(t *testing.T, url, lastID string) []string {
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	ret := make([]string, 0)
+	id, name := "", ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case line == "":
+			ret = append(ret, strings.TrimSpace(id+" "+name))
+			if name == "syncGraphEvent" {
+				return ret
+			}
+			id, name = "", ""
+		}
+	}
+	t.Fatalf("Stream ended before the sync event: %v", ret)
+	return nil
+}
+
+func TestResume(t *testing.T) {
+	g := graph.Create()
+	defer g.Stop()
+	g.IncrNode("10.0.0.1", nil)
+	s := NewServer(g, mapper.NewRouteMap(), fault.NewLocator(g, fault.DefaultConfig()))
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// a new client gets everything
+	events := readUntilSync(t, srv.URL, "")
+	if len(events) != 3 || events[0] != "resetGraphEvent" || events[1] != "addNodeEvent" {
+		t.Fatalf("Expected a reset, the node and a sync, got %v", events)
+	}
+	lastID := strings.Fields(events[2])[0]
+
+	// and when it comes back, just what it missed
+	g.IncrNode("10.0.0.2", nil)
+	events = readUntilSync(t, srv.URL, lastID)
+	if len(events) != 2 || !strings.HasSuffix(events[0], " addNodeEvent") {
+		t.Fatalf("Expected just the new node and a sync, got %v", events)
+	}
+	if events[0] == lastID+" addNodeEvent" {
+		t.Errorf("Expected the new event to have a new ID, got %v", events)
+	}
+
+	// unless it is too far behind
+	events = readUntilSync(t, srv.URL, "1")
+	if events[0] != "resetGraphEvent" {
+		t.Errorf("Expected a reset for an ID we don't have, got %v", events)
+	}
+}
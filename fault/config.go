@@ -0,0 +1,32 @@
+package fault
+
+import (
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	// minimum confidence (0-1) for an item to be reported as a fault
+	MinConfidence float64 `yaml:"min_confidence"`
+
+	// how often we recompute the faults, if routes changed. A single link
+	// failing flips a lot of routes at once, so we batch them up
+	Interval time.Duration `yaml:"interval"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MinConfidence: 0.5,
+		Interval:      time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.MinConfidence < 0 || c.MinConfidence > 1 {
+		return fmt.Errorf("min_confidence must be between 0 and 1, got %f", c.MinConfidence)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be > 0, got %v", c.Interval)
+	}
+	return nil
+}
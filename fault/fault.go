@@ -0,0 +1,272 @@
+package fault
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// What kind of graph item a Fault points at
+const (
+	LinkFault = "link"
+	NodeFault = "node"
+)
+
+// Which leg of the failing round trips an item is on
+const (
+	ForwardDirection = "forward"
+	ReverseDirection = "reverse"
+	BothDirections   = "both"
+)
+
+// How much a Suspect route counts against the items on it, compared to a Down
+// route (which counts as 1)
+const suspectWeight = 0.5
+
+// A Fault is a link or node we think is responsible for some failing routes
+type Fault struct {
+	Kind string `json:"kind"`
+	// key of the item in the graph (node name, or "src;dst" for links)
+	Name string `json:"name"`
+
+	// 0-1 score of how sure we are this item is at fault
+	Confidence float64 `json:"confidence"`
+
+	// number of failing (down or suspect) routes that traverse this item
+	FailingRoutes int `json:"failing_routes"`
+	// number of healthy routes that traverse this item
+	HealthyRoutes int `json:"healthy_routes"`
+
+	// whether the item is on the way there or back of the failing routes we
+	// know the reverse path of, empty if we don't know any
+	Direction string `json:"direction,omitempty"`
+}
+
+func (f *Fault) Key() string {
+	return f.Kind + ":" + f.Name
+}
+
+// A RouteSample is the part of a graph.NetworkRoute we need to do localization
+type RouteSample struct {
+	Path []string
+	// path the replies take back, nil if we don't know it
+	Reverse []string
+	// 0 for a healthy route, 1 for a route that is down
+	Badness float64
+}
+
+func SampleRoute(r *graph.NetworkRoute) RouteSample {
+	s := RouteSample{Path: r.Hops(), Reverse: r.GetReversePath()}
+	switch r.GetState() {
+	case graph.Suspect:
+		s.Badness = suspectWeight
+	case graph.Down:
+		s.Badness = 1
+	}
+	return s
+}
+
+type tally struct {
+	bad     float64
+	failing int
+	healthy int
+	// failing round trips which have the item only on the way there, or
+	// only on the way back
+	forward int
+	reverse int
+}
+
+func (t *tally) add(s RouteSample, forward, reverse bool) {
+	if s.Badness > 0 {
+		t.bad += s.Badness
+		t.failing++
+		if s.Reverse != nil {
+			switch {
+			case forward && !reverse:
+				t.forward++
+			case reverse && !forward:
+				t.reverse++
+			}
+		}
+	} else {
+		t.healthy++
+	}
+}
+
+func (t *tally) direction() string {
+	switch {
+	case t.forward > 0 && t.reverse > 0:
+		return BothDirections
+	case t.forward > 0:
+		return ForwardDirection
+	case t.reverse > 0:
+		return ReverseDirection
+	}
+	return ""
+}
+
+// which legs of the round trip each item of `s` is on
+type legs struct {
+	forward, reverse bool
+}
+
+func sampleItems(s RouteSample) (map[string]*legs, map[string]*legs) {
+	nodes := make(map[string]*legs)
+	links := make(map[string]*legs)
+	walk := func(path []string, reverse bool) {
+		for i, hop := range path {
+			mark(nodes, hop, reverse)
+			if i-1 >= 0 {
+				mark(links, path[i-1]+";"+hop, reverse)
+			}
+		}
+	}
+	walk(s.Path, false)
+	walk(s.Reverse, true)
+	return nodes, links
+}
+
+func mark(m map[string]*legs, key string, reverse bool) {
+	l, ok := m[key]
+	if !ok {
+		l = &legs{}
+		m[key] = l
+	}
+	if reverse {
+		l.reverse = true
+	} else {
+		l.forward = true
+	}
+}
+
+// Localize takes a set of routes and returns the links and nodes which we
+// suspect are at fault, ranked from most to least likely.
+//
+// This is boolean network tomography: a link (or node) which is on a failing
+// route is a candidate, and every healthy route which also traverses it is
+// evidence that it is actually fine. So the confidence for a candidate is the
+// share of (weighted) failing routes out of all routes traversing it.
+// Candidates with the same confidence are ranked by how many failing routes
+// they explain, since a link shared by many failing routes is more likely the
+// culprit than one only on a single failing route.
+//
+// Pings are round trips, so a route we know the reverse path of traverses the
+// items on the way back as well-- which is how we tell whether a fault is on
+// the way there or back.
+func Localize(routes []RouteSample, minConfidence float64) []*Fault {
+	links := make(map[string]*tally)
+	nodes := make(map[string]*tally)
+	add := func(m map[string]*tally, items map[string]*legs, route RouteSample) {
+		for key, l := range items {
+			t, ok := m[key]
+			if !ok {
+				t = &tally{}
+				m[key] = t
+			}
+			t.add(route, l.forward, l.reverse)
+		}
+	}
+
+	for _, route := range routes {
+		routeNodes, routeLinks := sampleItems(route)
+		add(nodes, routeNodes, route)
+		add(links, routeLinks, route)
+	}
+
+	ret := make([]*Fault, 0)
+	collect := func(kind string, m map[string]*tally) {
+		for name, t := range m {
+			if t.failing == 0 {
+				continue
+			}
+			confidence := t.bad / (t.bad + float64(t.healthy))
+			if confidence < minConfidence {
+				continue
+			}
+			ret = append(ret, &Fault{
+				Kind:          kind,
+				Name:          name,
+				Confidence:    confidence,
+				FailingRoutes: t.failing,
+				HealthyRoutes: t.healthy,
+				Direction:     t.direction(),
+			})
+		}
+	}
+	collect(LinkFault, links)
+	collect(NodeFault, nodes)
+
+	sort.Sort(byRank(ret))
+	return ret
+}
+
+type byRank []*Fault
+
+func (b byRank) Len() int      { return len(b) }
+func (b byRank) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRank) Less(i, j int) bool {
+	if b[i].Confidence != b[j].Confidence {
+		return b[i].Confidence > b[j].Confidence
+	}
+	if b[i].FailingRoutes != b[j].FailingRoutes {
+		return b[i].FailingRoutes > b[j].FailingRoutes
+	}
+	return b[i].Key() < b[j].Key()
+}
+
+type eventType uint8
+
+const (
+	addEvent eventType = iota
+	removeEvent
+	updateEvent
+	// a subscriber missed events, and needs to re-read all the faults
+	resetEvent
+)
+
+// Event is fired whenever a Fault is found, changes or is cleared. It implements
+// eventsource.Event so it can be sent down the same streams as graph events
+type Event struct {
+	E    eventType
+	Item *Fault
+}
+
+func (e Event) Id() string {
+	return ""
+}
+
+// Whether the subscriber has missed events, and needs to drop the faults it
+// has and load them again (from Locator.EventDumpChannel)
+func (e Event) Reset() bool {
+	return e.E == resetEvent
+}
+
+func (e Event) Event() string {
+	switch e.E {
+	case addEvent:
+		return "addFaultEvent"
+	case removeEvent:
+		return "removeFaultEvent"
+	case updateEvent:
+		return "updateFaultEvent"
+	case resetEvent:
+		return "resetFaultEvent"
+	}
+	logrus.Warning("Unknown event type!")
+	return "unknown"
+}
+
+func (e Event) Data() string {
+	if e.Item == nil {
+		return ""
+	}
+	ret, err := json.Marshal(e.Item)
+	if err != nil {
+		logrus.Warningf("Unable to marshal event: %v", err)
+		return ""
+	} else {
+		return string(ret)
+	}
+}
@@ -0,0 +1,84 @@
+package fault
+
+import (
+	"testing"
+)
+
+// A single bad link shared by 2 failing routes, with healthy routes covering
+// everything else, should be the top (and only) link fault
+func TestLocalizeSharedLink(t *testing.T) {
+	routes := []RouteSample{
+		{Path: []string{"1", "2", "3", "4"}, Badness: 1},
+		{Path: []string{"5", "2", "3", "6"}, Badness: 1},
+		{Path: []string{"1", "2", "7", "4"}},
+		{Path: []string{"5", "2", "8", "6"}},
+		{Path: []string{"9", "3", "4"}},
+		{Path: []string{"9", "3", "6"}},
+	}
+
+	faults := Localize(routes, 0.5)
+	if len(faults) == 0 {
+		t.Fatalf("no faults found")
+	}
+
+	if faults[0].Kind != LinkFault || faults[0].Name != "2;3" {
+		t.Errorf("wrong top fault expected=link:2;3 actual=%s", faults[0].Key())
+	}
+	if faults[0].Confidence != 1 {
+		t.Errorf("wrong confidence expected=1 actual=%f", faults[0].Confidence)
+	}
+
+	// everything else has been seen on a healthy route
+	for _, f := range faults[1:] {
+		if f.Kind == LinkFault && f.Confidence >= faults[0].Confidence {
+			t.Errorf("link fault %s ranked as high as the bad link confidence=%f", f.Key(), f.Confidence)
+		}
+	}
+}
+
+// If everything is healthy, there are no faults
+func TestLocalizeHealthy(t *testing.T) {
+	routes := []RouteSample{
+		{Path: []string{"1", "2", "3", "4"}},
+		{Path: []string{"5", "2", "3", "6"}},
+	}
+
+	if faults := Localize(routes, 0); len(faults) != 0 {
+		t.Errorf("expected no faults, got %d", len(faults))
+	}
+}
+
+// A link seen on as many healthy routes as failing routes is below the threshold
+func TestLocalizeExonerated(t *testing.T) {
+	routes := []RouteSample{
+		{Path: []string{"1", "2"}, Badness: 1},
+		{Path: []string{"1", "2"}},
+		{Path: []string{"1", "2"}},
+	}
+
+	if faults := Localize(routes, 0.4); len(faults) != 0 {
+		t.Errorf("expected no faults, got %v", faults)
+	}
+}
+
+// A link only on the way back of the failing round trips is a reverse fault,
+// even though the forward paths are healthy elsewhere
+func TestLocalizeReverse(t *testing.T) {
+	routes := []RouteSample{
+		{Path: []string{"1", "2"}, Reverse: []string{"3", "4"}, Badness: 1},
+		{Path: []string{"5", "2"}, Reverse: []string{"3", "4"}, Badness: 1},
+		{Path: []string{"1", "2"}, Reverse: []string{"2", "1"}},
+		{Path: []string{"5", "2"}, Reverse: []string{"2", "5"}},
+	}
+
+	faults := Localize(routes, 0.5)
+	if len(faults) == 0 {
+		t.Fatalf("no faults found")
+	}
+	if faults[0].Key() != "link:3;4" {
+		t.Errorf("wrong top fault expected=link:3;4 actual=%s", faults[0].Key())
+	}
+	if faults[0].Direction != ReverseDirection {
+		t.Errorf("wrong direction expected=%s actual=%s", ReverseDirection, faults[0].Direction)
+	}
+}
@@ -0,0 +1,231 @@
+package fault
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// Locator watches the route events of a NetworkGraph and maintains the set of
+// links/nodes we currently suspect are at fault
+type Locator struct {
+	Graph  *graph.NetworkGraph
+	config *Config
+
+	// faultKey -> Fault
+	faults    map[string]*Fault
+	faultLock *sync.RWMutex
+
+	// event stuff, subscriber -> whether it fell behind and is owed a reset
+	eventChannels map[chan *Event]bool
+	eventLock     *sync.Mutex
+	// times subscribers fell behind
+	resets int
+	// once we stop, there are no more events for anyone
+	stopped bool
+}
+
+func NewLocator(g *graph.NetworkGraph, cfg *Config) *Locator {
+	return &Locator{
+		Graph:         g,
+		config:        cfg,
+		faults:        make(map[string]*Fault),
+		faultLock:     &sync.RWMutex{},
+		eventChannels: make(map[chan *Event]bool),
+		eventLock:     &sync.Mutex{},
+	}
+}
+
+// Start looking for faults, until `ctx` is done or the graph is stopped
+func (l *Locator) Start(ctx context.Context) {
+	go func() {
+		l.run(ctx)
+		l.stop()
+	}()
+}
+
+// close the channels of all our subscribers
+func (l *Locator) stop() {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	l.stopped = true
+	for c := range l.eventChannels {
+		delete(l.eventChannels, c)
+		close(c)
+	}
+}
+
+// goroutine target to recompute faults whenever routes in the graph change.
+// We batch up changes and recompute at most once an interval, since a single
+// link failing will flip a lot of routes at once
+func (l *Locator) run(ctx context.Context) {
+	sub := l.Graph.Subscribe("locator")
+	defer sub.Close()
+
+	ticker := time.NewTicker(l.config.Interval)
+	defer ticker.Stop()
+
+	dirty := true
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			// the graph is gone, so are we
+			if !ok {
+				return
+			}
+			// we missed events, so we need to re-check. We look at the whole
+			// graph anyways, so we don't need a snapshot
+			if e.Resync() {
+				dirty = true
+				continue
+			}
+			if _, ok := e.Item.(*graph.NetworkRoute); ok {
+				dirty = true
+			}
+		case <-ticker.C:
+			if dirty {
+				l.update()
+				dirty = false
+			}
+			l.resetSubscribers()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recompute the faults and fire events for what changed
+func (l *Locator) update() {
+	l.Graph.RoutesLock.RLock()
+	samples := make([]RouteSample, 0, len(l.Graph.RoutesMap))
+	for _, route := range l.Graph.RoutesMap {
+		samples = append(samples, SampleRoute(route))
+	}
+	l.Graph.RoutesLock.RUnlock()
+
+	newFaults := make(map[string]*Fault)
+	for _, f := range Localize(samples, l.config.MinConfidence) {
+		newFaults[f.Key()] = f
+	}
+
+	l.faultLock.Lock()
+	oldFaults := l.faults
+	l.faults = newFaults
+	l.faultLock.Unlock()
+
+	for key, f := range oldFaults {
+		if _, ok := newFaults[key]; !ok {
+			l.publish(&Event{E: removeEvent, Item: f})
+		}
+	}
+	for key, f := range newFaults {
+		old, ok := oldFaults[key]
+		if !ok {
+			logrus.Infof("Suspected fault %s confidence=%f", key, f.Confidence)
+			l.publish(&Event{E: addEvent, Item: f})
+		} else if *old != *f {
+			l.publish(&Event{E: updateEvent, Item: f})
+		}
+	}
+}
+
+// Faults returns the current faults, ranked from most to least likely
+func (l *Locator) Faults() []*Fault {
+	l.faultLock.RLock()
+	defer l.faultLock.RUnlock()
+	ret := make([]*Fault, 0, len(l.faults))
+	for _, f := range l.faults {
+		ret = append(ret, f)
+	}
+	sort.Sort(byRank(ret))
+	return ret
+}
+
+// Send `e` to all our subscribers. If one is full, it misses events until we
+// can get a reset event to it
+func (l *Locator) publish(e *Event) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	for c, behind := range l.eventChannels {
+		// the faults it re-reads after the reset have `e` in them
+		if behind {
+			l.sendReset(c)
+			continue
+		}
+		select {
+		case c <- e:
+		default:
+			l.eventChannels[c] = true
+			l.resets++
+		}
+	}
+}
+
+// Retry the resets of the subscribers which are behind, since there may not be
+// another event for a while. Called periodically by run
+func (l *Locator) resetSubscribers() {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	for c, behind := range l.eventChannels {
+		if behind {
+			l.sendReset(c)
+		}
+	}
+}
+
+// callers must hold eventLock
+func (l *Locator) sendReset(c chan *Event) {
+	select {
+	case c <- &Event{E: resetEvent}:
+		l.eventChannels[c] = false
+	default:
+	}
+}
+
+// Number of times subscribers fell behind and had to reset
+func (l *Locator) SubscriberResets() int {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	return l.resets
+}
+
+// add subscriber to our events
+func (l *Locator) Subscribe(c chan *Event) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	if l.stopped {
+		close(c)
+		return
+	}
+	l.eventChannels[c] = false
+}
+
+// remove a subscriber, closing its channel
+func (l *Locator) Unsubscribe(c chan *Event) {
+	l.eventLock.Lock()
+	defer l.eventLock.Unlock()
+	if _, ok := l.eventChannels[c]; ok {
+		delete(l.eventChannels, c)
+		close(c)
+	}
+}
+
+// Dump all current faults into a channel
+func (l *Locator) EventDumpChannel() chan *Event {
+	faults := l.Faults()
+	c := make(chan *Event)
+	go func() {
+		for _, f := range faults {
+			c <- &Event{
+				E:    addEvent,
+				Item: f,
+			}
+		}
+		close(c)
+	}()
+	return c
+}
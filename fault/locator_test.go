@@ -0,0 +1,39 @@
+package fault
+
+import (
+	"testing"
+
+	"github.com/jacksontj/dnms/graph"
+)
+
+func TestLocatorSubscriberReset(t *testing.T) {
+	g := graph.Create()
+	defer g.Stop()
+	l := NewLocator(g, DefaultConfig())
+	c := make(chan *Event, 1)
+	l.Subscribe(c)
+	defer l.Unsubscribe(c)
+
+	f := &Fault{Kind: LinkFault, Name: "a;b"}
+	l.publish(&Event{E: addEvent, Item: f})
+	// no room for this one, so the subscriber is behind
+	l.publish(&Event{E: updateEvent, Item: f})
+	if e := <-c; e.E != addEvent {
+		t.Fatalf("Expected the add event, got %v", e.Event())
+	}
+
+	// instead of the events it missed, it gets a reset
+	l.resetSubscribers()
+	if e := <-c; !e.Reset() {
+		t.Fatalf("Expected a reset, got %v", e.Event())
+	}
+	if n := l.SubscriberResets(); n != 1 {
+		t.Errorf("Expected 1 reset, got %d", n)
+	}
+
+	// and then it's back to normal
+	l.publish(&Event{E: removeEvent, Item: f})
+	if e := <-c; e.E != removeEvent {
+		t.Errorf("Expected the remove event, got %v", e.Event())
+	}
+}
@@ -0,0 +1,82 @@
+package graph
+
+// A single reply to a burst of pings, in the order they arrived
+type ProbeReply struct {
+	// sequence number of the ping within the burst
+	Seq int
+	// how long the reply took (ns)
+	Latency int64
+}
+
+// SummarizeBurst turns the replies to a burst of `sent` pings into a single
+// point for the metric ring. Latency is the average of the unique replies,
+// `timeout` is used if there were none
+func SummarizeBurst(sent int, replies []ProbeReply, timeout int64) RoutePingResponse {
+	point := RoutePingResponse{Sent: sent}
+
+	seen := make(map[int]bool, len(replies))
+	maxSeq := -1
+	var totalLatency int64
+	for _, reply := range replies {
+		// we didn't send it, so it isn't ours
+		if reply.Seq < 0 || reply.Seq >= sent {
+			continue
+		}
+		if seen[reply.Seq] {
+			point.Duplicates++
+			continue
+		}
+		seen[reply.Seq] = true
+		point.Received++
+		totalLatency += reply.Latency
+
+		// anything arriving after a later sequence number is out of order
+		if reply.Seq < maxSeq {
+			point.Reordered++
+		} else {
+			maxSeq = reply.Seq
+		}
+	}
+
+	point.Pass = point.Received > 0
+	if point.Pass {
+		point.Latency = totalLatency / int64(point.Received)
+	} else {
+		point.Latency = timeout
+	}
+	return point
+}
+
+// Interarrival jitter as defined in RFC 3550 (section 6.4.1). Since we measure
+// the latency of each packet on the same clock it was sent with, the
+// difference in transit times is just the difference in latencies
+type jitterEstimator struct {
+	Jitter float64
+
+	lastTransit int64
+	haveTransit bool
+}
+
+func (j *jitterEstimator) add(transit int64) {
+	if j.haveTransit {
+		d := float64(transit - j.lastTransit)
+		if d < 0 {
+			d = -d
+		}
+		j.Jitter += (d - j.Jitter) / 16
+	}
+	j.lastTransit = transit
+	j.haveTransit = true
+}
+
+// Feed the unique replies of a burst, in the order they arrived
+func (j *jitterEstimator) addReplies(sent int, replies []ProbeReply) {
+	seen := make(map[int]bool, len(replies))
+	for _, reply := range replies {
+		if reply.Seq < 0 || reply.Seq >= sent || seen[reply.Seq] {
+			continue
+		}
+		seen[reply.Seq] = true
+		j.add(reply.Latency)
+	}
+}
@@ -0,0 +1,97 @@
+package graph
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarizeBurst(t *testing.T) {
+	replies := []ProbeReply{
+		{Seq: 0, Latency: 10},
+		{Seq: 2, Latency: 30},
+		{Seq: 1, Latency: 20}, // out of order
+		{Seq: 2, Latency: 40}, // duplicate
+		{Seq: 7, Latency: 10}, // not ours
+	}
+	point := SummarizeBurst(4, replies, 1000)
+	if !point.Pass {
+		t.Errorf("burst with replies should pass")
+	}
+	if point.Sent != 4 || point.Received != 3 {
+		t.Errorf("expected 3/4 received, got %d/%d", point.Received, point.Sent)
+	}
+	if point.Duplicates != 1 {
+		t.Errorf("expected 1 duplicate, got %d", point.Duplicates)
+	}
+	if point.Reordered != 1 {
+		t.Errorf("expected 1 reordered, got %d", point.Reordered)
+	}
+	if point.Latency != 20 {
+		t.Errorf("expected average latency of 20, got %d", point.Latency)
+	}
+	if lost, sent := point.Loss(); lost != 1 || sent != 4 {
+		t.Errorf("expected 1/4 lost, got %d/%d", lost, sent)
+	}
+
+	point = SummarizeBurst(4, nil, 1000)
+	if point.Pass || point.Latency != 1000 {
+		t.Errorf("burst without replies should fail with the timeout, got %+v", point)
+	}
+}
+
+func TestJitterEstimator(t *testing.T) {
+	j := jitterEstimator{}
+	// constant latency has no jitter
+	for i := 0; i < 10; i++ {
+		j.add(100)
+	}
+	if j.Jitter != 0 {
+		t.Errorf("expected no jitter, got %f", j.Jitter)
+	}
+
+	// alternating latency converges on the difference
+	for i := 0; i < 500; i++ {
+		j.add(int64(100 + (i%2)*16))
+	}
+	if math.Abs(j.Jitter-16) > 0.01 {
+		t.Errorf("expected jitter of ~16, got %f", j.Jitter)
+	}
+}
+
+func TestRouteBurstMetrics(t *testing.T) {
+	g := Create()
+	route, _ := g.IncrRoute([]string{"a", "b"}, nil)
+
+	route.HandleBurst(4, []ProbeReply{{Seq: 0, Latency: 10}, {Seq: 1, Latency: 10}}, 1000)
+	route.HandleBurst(4, []ProbeReply{{Seq: 0, Latency: 10}, {Seq: 1, Latency: 10}, {Seq: 3, Latency: 10}, {Seq: 2, Latency: 10}}, 1000)
+
+	m := route.Metrics()
+	if m.NumPoints != 2 {
+		t.Errorf("expected 2 points, got %d", m.NumPoints)
+	}
+	// loss is per packet, not per burst
+	if m.LossRate != 0.25 {
+		t.Errorf("expected a loss rate of 0.25, got %f", m.LossRate)
+	}
+	if m.ReorderRate != 1.0/6 {
+		t.Errorf("expected a reorder rate of 1/6, got %f", m.ReorderRate)
+	}
+}
+
+func TestRouteTCPBurstMetrics(t *testing.T) {
+	g := Create()
+	route, _ := g.IncrRoute([]string{"a", "b"}, nil)
+
+	route.HandleTCPBurst(100, 2, []ProbeReply{{Seq: 0, Latency: 10}, {Seq: 1, Latency: 10}}, 1000)
+	route.HandleTCPBurst(300, 2, []ProbeReply{{Seq: 0, Latency: 10}, {Seq: 1, Latency: 10}}, 1000)
+	// failed to connect, doesn't count towards the handshake
+	route.HandleTCPBurst(0, 2, nil, 1000)
+
+	m := route.Metrics()
+	if m.HandshakeAverage != 200 {
+		t.Errorf("expected a handshake average of 200, got %f", m.HandshakeAverage)
+	}
+	if m.LossRate != 2.0/6 {
+		t.Errorf("expected a loss rate of 1/3, got %f", m.LossRate)
+	}
+}
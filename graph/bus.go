@@ -0,0 +1,223 @@
+package graph
+
+import (
+	"sort"
+	"sync"
+)
+
+// Subscription is a subscriber's feed of the graph's events. Each one has its
+// own bounded queue, so a slow subscriber only holds up itself: repeated
+// updates of an item are coalesced while they wait in the queue, and if it
+// still fills up the subscriber gets a resync event (see Resync) instead of
+// silently missing events
+type Subscription struct {
+	Name string
+
+	g *NetworkGraph
+	// events go out on c, which is closed once the subscription is over
+	c chan *Event
+
+	lock  *sync.Mutex
+	queue []*Event
+	size  int
+	// items with an update event in the queue
+	updates map[interface{}]bool
+	// we dropped events since the last resync event went out
+	resync bool
+
+	coalesced int64
+	dropped   int64
+	resyncs   int64
+
+	// poked whenever something is queued
+	ready chan struct{}
+	// requests for a new snapshot
+	resyncRequests chan chan *Snapshot
+	done           chan struct{}
+	stopOnce       *sync.Once
+}
+
+func newSubscription(name string, g *NetworkGraph) *Subscription {
+	s := &Subscription{
+		Name:           name,
+		g:              g,
+		c:              make(chan *Event),
+		lock:           &sync.Mutex{},
+		queue:          make([]*Event, 0),
+		size:           g.queueSize,
+		updates:        make(map[interface{}]bool),
+		ready:          make(chan struct{}, 1),
+		resyncRequests: make(chan chan *Snapshot),
+		done:           make(chan struct{}),
+		stopOnce:       &sync.Once{},
+	}
+	go s.run()
+	return s
+}
+
+// The events, closed once we are unsubscribed or the graph is stopped
+func (s *Subscription) Events() <-chan *Event {
+	return s.c
+}
+
+// Get a dump of the whole graph, and start over with the events after it.
+// This is what to do after a resync event, since the subscriber has missed
+// some. Returns nil if the subscription is over
+func (s *Subscription) Resync() *Snapshot {
+	reply := make(chan *Snapshot, 1)
+	select {
+	case s.resyncRequests <- reply:
+		return <-reply
+	case <-s.done:
+		return nil
+	}
+}
+
+// Unsubscribe
+func (s *Subscription) Close() {
+	s.g.subscribersLock.Lock()
+	delete(s.g.subscribers, s)
+	s.g.subscribersLock.Unlock()
+	s.stop()
+}
+
+func (s *Subscription) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// goroutine target to hand the queued events to the subscriber
+func (s *Subscription) run() {
+	defer close(s.c)
+	for {
+		e := s.pop()
+		if e == nil {
+			select {
+			case <-s.ready:
+			case reply := <-s.resyncRequests:
+				reply <- s.snapshot()
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		select {
+		case s.c <- e:
+		case reply := <-s.resyncRequests:
+			// `e` is in the snapshot, so it doesn't go out
+			reply <- s.snapshot()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Queue `e`, called by the publisher
+func (s *Subscription) push(e *Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// events are marshalled when they go out, so the update in the queue
+	// will have this one's changes as well
+	if e.E == updateEvent && s.updates[e.Item] {
+		s.coalesced++
+		return
+	}
+	if len(s.queue) >= s.size {
+		s.dropped += int64(len(s.queue))
+		s.queue = make([]*Event, 0)
+		s.updates = make(map[interface{}]bool)
+		if !s.resync {
+			s.resync = true
+			s.resyncs++
+		}
+	}
+	s.queue = append(s.queue, e)
+	if e.E == updateEvent {
+		s.updates[e.Item] = true
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Next event for the subscriber, nil if there isn't one
+func (s *Subscription) pop() *Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the subscriber needs to know it missed something before it gets
+	// anything after that
+	if s.resync {
+		s.resync = false
+		return &Event{E: resyncEvent}
+	}
+	if len(s.queue) == 0 {
+		return nil
+	}
+	e := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	if e.E == updateEvent {
+		delete(s.updates, e.Item)
+	}
+	return e
+}
+
+// Drop everything queued, called by the publisher when we get a new snapshot
+func (s *Subscription) clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queue = make([]*Event, 0)
+	s.updates = make(map[interface{}]bool)
+	s.resync = false
+}
+
+func (s *Subscription) snapshot() *Snapshot {
+	return s.g.subscribe(&subscriptionRequest{
+		sub:      s,
+		resync:   true,
+		snapshot: make(chan *Snapshot, 1),
+	})
+}
+
+// How a subscriber is keeping up
+type SubscriptionStats struct {
+	Name string `json:"name"`
+	// events waiting to go out
+	Queued int `json:"queued"`
+	// updates folded into one already queued
+	Coalesced int64 `json:"coalesced"`
+	// events thrown away because the queue was full, and the number of times
+	// that happened
+	Dropped int64 `json:"dropped"`
+	Resyncs int64 `json:"resyncs"`
+}
+
+func (s *Subscription) Stats() SubscriptionStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SubscriptionStats{
+		Name:      s.Name,
+		Queued:    len(s.queue),
+		Coalesced: s.coalesced,
+		Dropped:   s.dropped,
+		Resyncs:   s.resyncs,
+	}
+}
+
+type subscriptionStatsList []SubscriptionStats
+
+func (l subscriptionStatsList) Len() int           { return len(l) }
+func (l subscriptionStatsList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l subscriptionStatsList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// Stats of all our subscriptions, sorted by name
+func (g *NetworkGraph) Subscriptions() []SubscriptionStats {
+	g.subscribersLock.RLock()
+	ret := make(subscriptionStatsList, 0, len(g.subscribers))
+	for s := range g.subscribers {
+		ret = append(ret, s.Stats())
+	}
+	g.subscribersLock.RUnlock()
+	sort.Sort(ret)
+	return ret
+}
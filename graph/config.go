@@ -0,0 +1,71 @@
+package graph
+
+import (
+	"fmt"
+)
+
+type Config struct {
+	// number of ping results to keep for each route
+	RingSize int `yaml:"ring_size"`
+
+	// number of events to keep for subscribers resuming after a disconnect,
+	// 0 means they always get a whole dump
+	ReplaySize int `yaml:"replay_size"`
+
+	// number of events each subscriber can have waiting, before we drop them
+	// and tell it to resync. Event stream clients get the same buffer for the
+	// RouteMap and faults
+	QueueSize int `yaml:"queue_size"`
+
+	// thresholds used to decide the state of routes
+	State *ThresholdEvaluator `yaml:"state"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		RingSize:   100,
+		ReplaySize: 1000,
+		QueueSize:  1000,
+		State:      DefaultStateEvaluator(),
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.RingSize <= 0 {
+		return fmt.Errorf("ring_size must be > 0, got %d", c.RingSize)
+	}
+	if c.ReplaySize < 0 {
+		return fmt.Errorf("replay_size must be >= 0, got %d", c.ReplaySize)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("queue_size must be > 0, got %d", c.QueueSize)
+	}
+	if c.State == nil {
+		return nil
+	}
+	if c.State.Window <= 0 || c.State.Window > c.RingSize {
+		return fmt.Errorf("state.window must be between 1 and ring_size (%d), got %d", c.RingSize, c.State.Window)
+	}
+	for name, v := range map[string]float64{
+		"state.suspect_loss": c.State.SuspectLoss,
+		"state.down_loss":    c.State.DownLoss,
+	} {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %f", name, v)
+		}
+	}
+	for name, v := range map[string]int{
+		"state.min_points":       c.State.MinPoints,
+		"state.suspect_failures": c.State.SuspectFailures,
+		"state.down_failures":    c.State.DownFailures,
+		"state.recover_passes":   c.State.RecoverPasses,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must be >= 0, got %d", name, v)
+		}
+	}
+	if c.State.SuspectLatency < 0 {
+		return fmt.Errorf("state.suspect_latency must be >= 0, got %v", c.State.SuspectLatency)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package graph
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -14,20 +15,66 @@ const (
 	addEvent eventType = iota
 	updateEvent
 	removeEvent
+	// markers in the event stream, without an item
+	resetEvent
+	syncEvent
+	// a subscriber missed events, and needs to resync
+	resyncEvent
 )
 
 type Event struct {
 	E eventType
 	// Pointer to the thing that changed
 	Item interface{}
+	// sequence number in the graph's events, 0 if it isn't one of them (like
+	// the ones in a dump)
+	ID uint64
+}
+
+// Send `e` on `c`, unless `done` is closed first. Nodes, links and routes
+// don't know whether their graph has been stopped, and nothing reads `c` once
+// it is
+func sendEvent(c chan *Event, done <-chan struct{}, e *Event) {
+	select {
+	case c <- e:
+	case <-done:
+	}
+}
+
+// Sent before a dump of the whole graph, so the subscriber knows to drop
+// everything it had
+func NewResetEvent() *Event {
+	return &Event{E: resetEvent}
+}
+
+// Sent once the subscriber is caught up with the graph's event `id`, so it
+// can resume from there if it gets disconnected
+func NewSyncEvent(id uint64) *Event {
+	return &Event{E: syncEvent, ID: id}
+}
+
+// Whether the subscriber has missed events, and needs to call Resync
+func (e Event) Resync() bool {
+	return e.E == resyncEvent
 }
 
 func (e Event) Id() string {
-	// we don't care about event replay for now
-	return ""
+	if e.ID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(e.ID, 10)
 }
 
 func (e Event) Event() string {
+	switch e.E {
+	case resetEvent:
+		return "resetGraphEvent"
+	case syncEvent:
+		return "syncGraphEvent"
+	case resyncEvent:
+		return "resyncGraphEvent"
+	}
+
 	switch e.Item.(type) {
 	case *NetworkNode:
 		switch e.E {
@@ -63,6 +110,10 @@ func (e Event) Event() string {
 }
 
 func (e Event) Data() string {
+	// clients don't get events without data
+	if e.Item == nil {
+		return "{}"
+	}
 	ret, err := json.Marshal(e.Item)
 	if err != nil {
 		logrus.Warningf("Unable to marshal event: %v", err)
@@ -6,7 +6,10 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -23,13 +26,38 @@ type NetworkGraph struct {
 	RoutesMap  map[string]*NetworkRoute `json:"routes"`
 	RoutesLock *sync.RWMutex            `json:"-"`
 
+	// used to decide the state of all routes in the graph
+	stateEvaluator StateEvaluator
+	// number of ping results to keep per route
+	ringSize int
+
 	// event stuff
-	eventChannels     map[chan *Event]bool
-	eventRegistration chan chan *Event
-	internalEvents    chan *Event
+	subscribers     map[*Subscription]bool
+	subscribersLock *sync.RWMutex
+	subscriptions   chan *subscriptionRequest
+	internalEvents  chan *Event
+	// events a subscriber can have queued before it has to resync
+	queueSize int
+
+	// ID of the last event we published, and the most recent events for
+	// subscribers to catch up on
+	lastID     uint64
+	replay     []*Event
+	replaySize int
+	replayLock *sync.RWMutex
+
+	stopChan chan struct{}
+	stopOnce *sync.Once
+
+	// names of the nodes which are peers, under NodesLock
+	peers map[string]bool
 }
 
 func Create() *NetworkGraph {
+	return CreateWithConfig(DefaultConfig())
+}
+
+func CreateWithConfig(cfg *Config) *NetworkGraph {
 	g := &NetworkGraph{
 		NodesMap:   make(map[string]*NetworkNode),
 		NodesLock:  &sync.RWMutex{},
@@ -38,9 +66,29 @@ func Create() *NetworkGraph {
 		RoutesMap:  make(map[string]*NetworkRoute),
 		RoutesLock: &sync.RWMutex{},
 
-		eventChannels:     make(map[chan *Event]bool),
-		eventRegistration: make(chan chan *Event),
-		internalEvents:    make(chan *Event),
+		stateEvaluator: defaultStateEvaluator,
+		ringSize:       cfg.RingSize,
+
+		subscribers:     make(map[*Subscription]bool),
+		subscribersLock: &sync.RWMutex{},
+		subscriptions:   make(chan *subscriptionRequest),
+		internalEvents:  make(chan *Event),
+		queueSize:       cfg.QueueSize,
+
+		// IDs from before a restart shouldn't look like ours
+		lastID:     uint64(time.Now().UnixNano()),
+		replay:     make([]*Event, 0, cfg.ReplaySize),
+		replaySize: cfg.ReplaySize,
+		replayLock: &sync.RWMutex{},
+
+		stopChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+
+		peers: make(map[string]bool),
+	}
+
+	if cfg.State != nil {
+		g.stateEvaluator = cfg.State
 	}
 
 	go g.publisher()
@@ -48,65 +96,239 @@ func Create() *NetworkGraph {
 	return g
 }
 
-// TODO: buffer messages?
-// goroutine target to do all the publishing of events
+// Change how the state of routes is decided, this applies to all existing
+// routes as well as new ones
+func (g *NetworkGraph) SetStateEvaluator(e StateEvaluator) {
+	g.RoutesLock.Lock()
+	defer g.RoutesLock.Unlock()
+	g.stateEvaluator = e
+	for _, route := range g.RoutesMap {
+		route.mLock.Lock()
+		route.evaluator = e
+		route.mLock.Unlock()
+	}
+}
+
+// goroutine target to do all the publishing of events. Subscribers have their
+// own queues, so this never waits on them
 func (g *NetworkGraph) publisher() {
 	for {
 		select {
-		case newChannel := <-g.eventRegistration:
-			g.eventChannels[newChannel] = true
+		case req := <-g.subscriptions:
+			// nothing is published while we are here, so the subscription
+			// starts right after the last event
+			if req.resync {
+				req.sub.clear()
+			} else {
+				g.subscribersLock.Lock()
+				g.subscribers[req.sub] = true
+				g.subscribersLock.Unlock()
+			}
+			if req.snapshot == nil {
+				continue
+			}
+			snap := &Snapshot{}
+			events, id, ok := g.EventsSince(req.lastID)
+			if ok && !req.resync {
+				snap.Events = events
+				snap.ID = id
+			} else {
+				snap.Reset = true
+				snap.ID = g.LastEventID()
+			}
+			req.snapshot <- snap
 		case newEvent := <-g.internalEvents:
-			//logrus.Infof("got a new event! %v", newEvent)
-			for subscriberChannel := range g.eventChannels {
-				select {
-				case subscriberChannel <- newEvent:
-					//logrus.Infof("sent that event to a channel")
-				default:
-					//logrus.Infof("Unable to send event to that subscriber, killing")
-					delete(g.eventChannels, subscriberChannel)
-					close(subscriberChannel)
-				}
+			g.record(newEvent)
+			g.subscribersLock.RLock()
+			for sub := range g.subscribers {
+				sub.push(newEvent)
+			}
+			g.subscribersLock.RUnlock()
+		case <-g.stopChan:
+			// let all the subscribers know there is nothing more coming
+			g.subscribersLock.Lock()
+			for sub := range g.subscribers {
+				delete(g.subscribers, sub)
+				sub.stop()
 			}
+			g.subscribersLock.Unlock()
+			return
+		}
+	}
+}
+
+// Give `e` the next ID, and keep it for replay
+func (g *NetworkGraph) record(e *Event) {
+	g.replayLock.Lock()
+	defer g.replayLock.Unlock()
+	g.lastID++
+	e.ID = g.lastID
+	if g.replaySize == 0 {
+		return
+	}
+	g.replay = append(g.replay, e)
+	if len(g.replay) > g.replaySize {
+		g.replay = g.replay[1:]
+	}
+}
+
+// ID of the last event we published
+func (g *NetworkGraph) LastEventID() uint64 {
+	g.replayLock.RLock()
+	defer g.replayLock.RUnlock()
+	return g.lastID
+}
+
+// The events after `id` (an Event.Id()), and the ID they go up to. If we don't
+// have all of them (or don't know the ID) we return false, and the subscriber
+// needs a whole dump instead
+func (g *NetworkGraph) EventsSince(id string) ([]*Event, uint64, bool) {
+	since, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+	g.replayLock.RLock()
+	defer g.replayLock.RUnlock()
+	// from the future, probably someone else's graph
+	if since > g.lastID {
+		return nil, 0, false
+	}
+	missed := g.lastID - since
+	if missed > uint64(len(g.replay)) {
+		return nil, 0, false
+	}
+	ret := make([]*Event, missed)
+	copy(ret, g.replay[uint64(len(g.replay))-missed:])
+	return ret, g.lastID, true
+}
+
+// Hand `e` to the publisher, or throw it away if we are stopped
+func (g *NetworkGraph) publish(e *Event) {
+	sendEvent(g.internalEvents, g.stopChan, e)
+}
+
+// Hand `req` to the publisher. Once we are stopped there is nothing to
+// subscribe to, so the subscription is over before it starts
+func (g *NetworkGraph) request(req *subscriptionRequest) {
+	select {
+	case g.subscriptions <- req:
+	case <-g.stopChan:
+		req.sub.stop()
+		if req.snapshot != nil {
+			req.snapshot <- &Snapshot{ID: g.LastEventID(), Reset: true}
 		}
 	}
 }
 
-// TODO: locking here
+// Stop publishing events, closing the channels of all subscribers
+func (g *NetworkGraph) Stop() {
+	g.stopOnce.Do(func() { close(g.stopChan) })
+}
+
+// Done is closed once the graph is stopped
+func (g *NetworkGraph) Done() <-chan struct{} {
+	return g.stopChan
+}
+
 // Dump everything in the NetworkGraph into a channel
 func (g *NetworkGraph) EventDumpChannel() chan *Event {
-	// TODO: buffer?
+	g.RoutesLock.RLock()
+	g.LinksLock.RLock()
+	g.NodesLock.RLock()
+	events := g.dump()
+	g.NodesLock.RUnlock()
+	g.LinksLock.RUnlock()
+	g.RoutesLock.RUnlock()
+
 	c := make(chan *Event)
 	go func(c chan *Event) {
-		// dump nodes
-		for _, n := range g.NodesMap {
-			c <- &Event{
-				E:    addEvent,
-				Item: n,
-			}
-		}
-		// dump links
-		for _, l := range g.LinksMap {
-			c <- &Event{
-				E:    addEvent,
-				Item: l,
-			}
+		for _, e := range events {
+			c <- e
 		}
-		// dump routes
-		for _, route := range g.RoutesMap {
-			c <- &Event{
-				E:    addEvent,
-				Item: route,
-			}
-		}
-
 		close(c)
 	}(c)
 	return c
 }
 
-// add subscriber to our events
-func (g *NetworkGraph) Subscribe(c chan *Event) {
-	g.eventRegistration <- c
+// add events for everything in the graph, callers must hold all the locks
+func (g *NetworkGraph) dump() []*Event {
+	events := make([]*Event, 0, len(g.NodesMap)+len(g.LinksMap)+len(g.RoutesMap))
+	for _, n := range g.NodesMap {
+		events = append(events, &Event{
+			E:    addEvent,
+			Item: n,
+		})
+	}
+	for _, l := range g.LinksMap {
+		events = append(events, &Event{
+			E:    addEvent,
+			Item: l,
+		})
+	}
+	for _, route := range g.RoutesMap {
+		events = append(events, &Event{
+			E:    addEvent,
+			Item: route,
+		})
+	}
+	return events
+}
+
+// Subscribe to our events, `name` is just so we can tell subscribers apart
+func (g *NetworkGraph) Subscribe(name string) *Subscription {
+	sub := newSubscription(name, g)
+	g.request(&subscriptionRequest{sub: sub})
+	return sub
+}
+
+// What a new subscriber needs to be caught up with event ID: the events it
+// missed since the last one it got, or if we can't replay those (Reset) add
+// events for everything in the graph
+type Snapshot struct {
+	ID     uint64
+	Reset  bool
+	Events []*Event
+}
+
+type subscriptionRequest struct {
+	sub *Subscription
+	// Event.Id() of the last event the subscriber got, if any
+	lastID string
+	// whether this is an existing subscriber starting over
+	resync bool
+	// where we send the snapshot, nil if the subscriber doesn't need one
+	snapshot chan *Snapshot
+}
+
+// Subscribe to our events, along with what the subscriber needs to catch up
+// after `lastID` (an Event.Id(), "" for a new subscriber). The subscription
+// gets every event after the snapshot, and none of the ones in it
+func (g *NetworkGraph) SubscribeFrom(name, lastID string) (*Subscription, *Snapshot) {
+	sub := newSubscription(name, g)
+	snap := g.subscribe(&subscriptionRequest{
+		sub:      sub,
+		lastID:   lastID,
+		snapshot: make(chan *Snapshot, 1),
+	})
+	return sub, snap
+}
+
+func (g *NetworkGraph) subscribe(req *subscriptionRequest) *Snapshot {
+	// adds and removes happen under these, so nothing can be added or removed
+	// between the snapshot and the subscription
+	g.RoutesLock.RLock()
+	defer g.RoutesLock.RUnlock()
+	g.LinksLock.RLock()
+	defer g.LinksLock.RUnlock()
+	g.NodesLock.RLock()
+	defer g.NodesLock.RUnlock()
+
+	g.request(req)
+	snap := <-req.snapshot
+	if snap.Reset {
+		snap.Events = g.dump()
+	}
+	return snap
 }
 
 func (g *NetworkGraph) IncrNode(name string, newNode *NetworkNode) (*NetworkNode, bool) {
@@ -116,20 +338,28 @@ func (g *NetworkGraph) IncrNode(name string, newNode *NetworkNode) (*NetworkNode
 	// if this one doesn't exist, lets add it
 	if !ok {
 		if newNode == nil {
-			n = NewNetworkNode(name, g.internalEvents)
+			n = newNetworkNode(name, g.internalEvents, g.stopChan)
 		} else {
 			n = newNode
 			n.updateChan = g.internalEvents
+			n.stopChan = g.stopChan
+			// from before we had kinds
+			if n.Kind == "" {
+				n.Kind = KindOf(name)
+			}
+		}
+		if g.peers[name] {
+			n.Kind = PeerNode
 		}
 		g.NodesMap[name] = n
 
 		// Now that there is a new thing we fire an addEvent.
 		// Note: if the background DNS lookup was initiated an updateEvent
 		// will fire as soon as the lookup completes
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    addEvent,
 			Item: n,
-		}
+		})
 	}
 	n.refCount++
 	return n, !ok
@@ -142,6 +372,30 @@ func (g *NetworkGraph) GetNode(name string) *NetworkNode {
 	return n
 }
 
+// Mark `name` as a peer (or not), which is the kind its node has whenever it
+// is in the graph
+func (g *NetworkGraph) SetPeer(name string, peer bool) {
+	g.NodesLock.Lock()
+	defer g.NodesLock.Unlock()
+	if peer {
+		g.peers[name] = true
+	} else {
+		delete(g.peers, name)
+	}
+	if n, ok := g.NodesMap[name]; ok {
+		if peer {
+			n.SetKind(PeerNode)
+		} else {
+			n.SetKind(KindOf(name))
+		}
+	}
+}
+
+// Number of events each subscriber can have waiting (the queue_size config)
+func (g *NetworkGraph) GetQueueSize() int {
+	return g.queueSize
+}
+
 func (g *NetworkGraph) GetNodeCount() int {
 	g.NodesLock.RLock()
 	defer g.NodesLock.RUnlock()
@@ -161,10 +415,10 @@ func (g *NetworkGraph) DecrNode(name string) (*NetworkNode, bool) {
 	n.refCount--
 	if n.refCount == 0 {
 		delete(g.NodesMap, name)
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    removeEvent,
 			Item: n,
-		}
+		})
 		return n, true
 	}
 	return n, false
@@ -179,25 +433,27 @@ func (g *NetworkGraph) IncrLink(src, dst string, newLink *NetworkLink) (*Network
 		if newLink == nil {
 			srcNode, _ := g.IncrNode(src, nil)
 			dstNode, _ := g.IncrNode(dst, nil)
-			l = &NetworkLink{
-				SrcName: srcNode.Name,
-				srcNode: srcNode,
-				DstName: dstNode.Name,
-				dstNode: dstNode,
-			}
+			l = newNetworkLink(srcNode, dstNode, g.internalEvents, g.stopChan)
 		} else {
 			srcNode, _ := g.IncrNode(src, newLink.srcNode)
 			dstNode, _ := g.IncrNode(dst, newLink.dstNode)
 			// update child pointers
 			newLink.srcNode = srcNode
 			newLink.dstNode = dstNode
+			if newLink.lLock == nil {
+				newLink.init()
+			}
+			newLink.updateChan = g.internalEvents
+			newLink.stopChan = g.stopChan
 			l = newLink
 		}
+		l.srcNode.addLink(l)
+		l.dstNode.addLink(l)
 		g.LinksMap[key] = l
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    addEvent,
 			Item: l,
-		}
+		})
 	}
 	l.refCount++
 	return l, !ok
@@ -216,6 +472,21 @@ func (g *NetworkGraph) GetLinkCount() int {
 	return len(g.LinksMap)
 }
 
+// Record the latencies to each hop in `hops` (as measured by a traceroute) on
+// the links between them
+func (g *NetworkGraph) RecordHopLatencies(hops []string, latencies []int64) {
+	for i := 1; i < len(hops) && i < len(latencies); i++ {
+		// we don't know which nodes the unknown hops are-- so we can't say
+		// anything about the links
+		if strings.Contains(hops[i-1], UNKNOWN_PATH) || strings.Contains(hops[i], UNKNOWN_PATH) {
+			continue
+		}
+		if l := g.GetLink(hops[i-1] + ";" + hops[i]); l != nil {
+			l.RecordHopLatency(latencies[i] - latencies[i-1])
+		}
+	}
+}
+
 func (g *NetworkGraph) DecrLink(src, dst string) (*NetworkLink, bool) {
 	key := src + ";" + dst
 	g.LinksLock.Lock()
@@ -228,14 +499,16 @@ func (g *NetworkGraph) DecrLink(src, dst string) (*NetworkLink, bool) {
 	// decrement ourselves
 	l.refCount--
 	if l.refCount == 0 {
+		l.srcNode.removeLink(l)
+		l.dstNode.removeLink(l)
 		// Decrement our children
 		g.DecrNode(src)
 		g.DecrNode(dst)
 		delete(g.LinksMap, key)
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    removeEvent,
 			Item: l,
-		}
+		})
 		return l, true
 	}
 	return l, false
@@ -261,46 +534,51 @@ func (g *NetworkGraph) IncrRoute(hops []string, newRoute *NetworkRoute) (*Networ
 	if !ok {
 		logrus.Debugf("New Route: key=%s %v", key, hops)
 		if newRoute == nil {
-			path := make([]*NetworkNode, 0, len(hops))
-			for i, hop := range hops {
-				hopNode, _ := g.IncrNode(hop, nil)
-				path = append(path, hopNode)
-				// If there was something prior-- lets add the link as well
-				if i-1 >= 0 {
-					g.IncrLink(hops[i-1], hop, nil)
-				}
-			}
 			route = &NetworkRoute{
 				Path:       hops,
-				path:       path,
 				State:      Up,
-				metricRing: ring.New(100), // TODO: config
+				metricRing: ring.New(g.ringSize),
 				mLock:      &sync.RWMutex{},
-				updateChan: g.internalEvents,
 			}
 		} else {
-			newRoute.path = make([]*NetworkNode, len(newRoute.Path))
-			for i, nodeName := range newRoute.Path {
-				// Increment the node (this will convert the name to a pointer)
-				node, _ := g.IncrNode(nodeName, nil)
-				// set the pointer in our `path`
-				newRoute.path[i] = node
-
-				// If there was something prior-- lets add the link as well
-				if i-1 >= 0 {
-					g.IncrLink(newRoute.path[i-1].Name, nodeName, nil)
-				}
-			}
 			route = newRoute
-			route.updateChan = g.internalEvents
+			if route.metricRing == nil {
+				route.metricRing = ring.New(g.ringSize)
+			}
+		}
+		route.updateChan = g.internalEvents
+		route.stopChan = g.stopChan
+		route.evaluator = g.stateEvaluator
+		if route.lastSeen.IsZero() {
+			route.lastSeen = time.Now()
+		}
+		route.path = make([]*NetworkNode, len(route.Path))
+		route.links = make([]*NetworkLink, 0, len(route.Path))
+		for i, nodeName := range route.Path {
+			// Increment the node (this will convert the name to a pointer)
+			node, _ := g.IncrNode(nodeName, nil)
+			// set the pointer in our `path`
+			route.path[i] = node
+
+			// If there was something prior-- lets add the link as well
+			if i-1 >= 0 {
+				link, _ := g.IncrLink(route.path[i-1].Name, nodeName, nil)
+				route.links = append(route.links, link)
+			}
+		}
+		for _, link := range route.links {
+			link.addRoute(route)
+		}
+		for _, node := range route.path {
+			node.addRoute(route)
 		}
 
 		g.RoutesMap[key] = route
 
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    addEvent,
 			Item: route,
-		}
+		})
 	}
 
 	// increment route's refcount
@@ -335,6 +613,12 @@ func (g *NetworkGraph) DecrRoute(hops []string) (*NetworkRoute, bool) {
 
 	r.refCount--
 	if r.refCount == 0 {
+		for _, link := range r.links {
+			link.removeRoute(r)
+		}
+		for _, node := range r.path {
+			node.removeRoute(r)
+		}
 		// decrement all the links/nodes as well
 		for i, nodeName := range r.Path {
 			g.DecrNode(nodeName)
@@ -344,10 +628,10 @@ func (g *NetworkGraph) DecrRoute(hops []string) (*NetworkRoute, bool) {
 		}
 
 		delete(g.RoutesMap, key)
-		g.internalEvents <- &Event{
+		g.publish(&Event{
 			E:    removeEvent,
 			Item: r,
-		}
+		})
 		return r, true
 	}
 	return r, false
@@ -1,8 +1,11 @@
 package graph
 
 import (
+	"encoding/json"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func validateGraph(t *testing.T, g *NetworkGraph, expectedNodes map[string]int, expectedLinks map[string]int, expectedRoutes []RouteTestSpec) {
@@ -144,3 +147,292 @@ func TestRoutes(t *testing.T) {
 	}
 
 }
+
+// Routes from another graph (like an aggregator's peers) get our ring size
+func TestUnmarshalledRoute(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RingSize = 10
+	g := CreateWithConfig(cfg)
+	defer g.Stop()
+
+	r := &NetworkRoute{}
+	if err := json.Unmarshal([]byte(`{"path": ["1", "2"], "state": 0}`), r); err != nil {
+		t.Fatalf("Unable to unmarshal route: %v", err)
+	}
+	route, _ := g.IncrRoute(r.Hops(), r)
+	if n := route.metricRing.Len(); n != 10 {
+		t.Errorf("Expected a ring of 10, got %d", n)
+	}
+	route.record(RoutePingResponse{}, nil)
+}
+
+func TestStop(t *testing.T) {
+	g := Create()
+	sub := g.Subscribe("test")
+	g.Stop()
+
+	// subscribers are told there is nothing more coming
+	select {
+	case _, ok := <-sub.Events():
+		if ok {
+			t.Errorf("Expected the subscriber channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscriber channel wasn't closed on stop")
+	}
+
+	// the graph still works, it just doesn't publish anything
+	g.IncrRoute([]string{"192.168.1.1", "192.168.1.2"}, nil)
+	if g.GetRouteCount() != 1 {
+		t.Errorf("Wrong number of routes! expected=1 actual=%v", g.GetRouteCount())
+	}
+
+	late := g.Subscribe("late")
+	if _, ok := <-late.Events(); ok {
+		t.Errorf("Expected subscribing after stop to close the channel")
+	}
+	select {
+	case <-g.Done():
+	default:
+		t.Errorf("Expected Done to be closed")
+	}
+}
+
+func TestRoundTrips(t *testing.T) {
+	g := Create()
+	forward, _ := g.IncrRoute([]string{"1", "2", "3"}, nil)
+	reverse, _ := g.IncrRoute([]string{"3", "2", "1"}, nil)
+	g.IncrRoute([]string{"1", "4"}, nil)
+
+	forward.SetReversePath(reverse.Hops())
+	rts := g.RoundTrips()
+	if len(rts) != 1 {
+		t.Fatalf("Expected 1 round trip, got %d", len(rts))
+	}
+	if rts[0].Forward != forward || rts[0].Reverse != reverse || !rts[0].Symmetric {
+		t.Errorf("Wrong round trip: %+v", rts[0])
+	}
+
+	// the reverse route doesn't have to be in the graph
+	forward.SetReversePath([]string{"5", "1"})
+	if rt := g.RoundTrip(forward); rt == nil || rt.Reverse != nil || rt.Symmetric {
+		t.Errorf("Wrong round trip for an unknown reverse route: %+v", rt)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	g := Create()
+	a, _ := g.IncrRoute([]string{"1", "2", "3", "4"}, nil)
+	b, _ := g.IncrRoute([]string{"1", "5", "4"}, nil)
+	g.IncrRoute([]string{"2", "5"}, nil)
+
+	adj := g.Neighbors("2")
+	if adj == nil || len(adj.In) != 1 || len(adj.Out) != 2 {
+		t.Fatalf("Wrong neighbors of 2: %+v", adj)
+	}
+
+	if routes := g.RoutesThroughNode("1"); len(routes) != 2 {
+		t.Errorf("Expected 2 routes through 1, got %d", len(routes))
+	}
+	if routes := g.RoutesThroughLink("2", "3"); len(routes) != 1 || routes[0] != a {
+		t.Errorf("Expected only the first route over 2;3, got %v", routes)
+	}
+
+	if path := g.ShortestPath("1", "4"); strings.Join(path, ",") != "1,5,4" {
+		t.Errorf("Wrong shortest path: %v", path)
+	}
+	if paths := g.AllPaths("1", "4", 0); len(paths) != 3 {
+		t.Errorf("Expected 3 paths from 1 to 4, got %v", paths)
+	}
+	// when we stop early, we still have the shortest
+	if paths := g.AllPaths("1", "4", 1); len(paths) != 1 || strings.Join(paths[0], ",") != "1,5,4" {
+		t.Errorf("Expected just the shortest path from 1 to 4, got %v", paths)
+	}
+	if path := g.ShortestPath("4", "1"); path != nil {
+		t.Errorf("Links only go one way, got %v", path)
+	}
+
+	// removing the route cleans up the indexes
+	g.DecrRoute(b.Hops())
+	if routes := g.RoutesThroughNode("1"); len(routes) != 1 {
+		t.Errorf("Expected 1 route through 1, got %d", len(routes))
+	}
+	if adj := g.Neighbors("1"); len(adj.Out) != 1 {
+		t.Errorf("Expected 1 link out of 1, got %v", adj.Out)
+	}
+}
+
+func TestNodeKinds(t *testing.T) {
+	g := Create()
+	g.SetPeer("10.0.0.2", true)
+	hops := []string{"10.0.0.1", "192.168.1.1", "192.168.1.1|*|10.0.0.2", "10.0.0.2"}
+	g.IncrRoute(hops, nil)
+
+	for name, kind := range map[string]NodeKind{
+		"10.0.0.1":               RouterNode,
+		"192.168.1.1":            RouterNode,
+		"192.168.1.1|*|10.0.0.2": AnonymousNode,
+		"10.0.0.2":               PeerNode,
+	} {
+		if actual := g.GetNode(name).GetKind(); actual != kind {
+			t.Errorf("Wrong kind for %s expected=%s actual=%s", name, kind, actual)
+		}
+	}
+
+	// peers which join after we have their node are updated too
+	g.SetPeer("10.0.0.1", true)
+	if kind := g.GetNode("10.0.0.1").GetKind(); kind != PeerNode {
+		t.Errorf("Expected 10.0.0.1 to be a peer, got %s", kind)
+	}
+	g.SetPeer("10.0.0.2", false)
+	if kind := g.GetNode("10.0.0.2").GetKind(); kind != RouterNode {
+		t.Errorf("Expected 10.0.0.2 to be a router once it isn't a peer, got %s", kind)
+	}
+}
+
+func TestEventReplay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReplaySize = 3
+	g := CreateWithConfig(cfg)
+	sub := g.Subscribe("test")
+	defer sub.Close()
+
+	// wait for the events to go through the publisher, so they have IDs
+	next := func() *Event {
+		select {
+		case e := <-sub.Events():
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for an event")
+		}
+		return nil
+	}
+
+	g.IncrNode("10.0.0.1", nil)
+	first := next()
+	g.IncrNode("10.0.0.2", nil)
+	second := next()
+	if second.ID != first.ID+1 {
+		t.Errorf("Expected sequential IDs, got %d and %d", first.ID, second.ID)
+	}
+
+	events, lastID, ok := g.EventsSince(first.Id())
+	if !ok || len(events) != 1 || events[0] != second || lastID != second.ID {
+		t.Errorf("Expected to replay just the second event, got %v %d %v", events, lastID, ok)
+	}
+	if events, _, ok := g.EventsSince(second.Id()); !ok || len(events) != 0 {
+		t.Errorf("Expected nothing to replay when caught up, got %v %v", events, ok)
+	}
+
+	// once the buffer has moved on we can't replay from the first one
+	g.IncrNode("10.0.0.3", nil)
+	g.IncrNode("10.0.0.4", nil)
+	g.IncrNode("10.0.0.5", nil)
+	next()
+	next()
+	next()
+	if _, _, ok := g.EventsSince(first.Id()); ok {
+		t.Errorf("Expected the gap to be too large to replay")
+	}
+	for _, id := range []string{"", "nope", strconv.FormatUint(g.LastEventID()+1, 10)} {
+		if _, _, ok := g.EventsSince(id); ok {
+			t.Errorf("Expected to be unable to replay from %q", id)
+		}
+	}
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	g := Create()
+	g.IncrNode("10.0.0.1", nil)
+
+	sub, snap := g.SubscribeFrom("test", "")
+	if !snap.Reset || len(snap.Events) != 1 || snap.Events[0].Item != g.GetNode("10.0.0.1") {
+		t.Fatalf("Expected a dump of the one node, got %+v", snap)
+	}
+
+	// the subscription picks up right after the snapshot
+	g.IncrNode("10.0.0.2", nil)
+	select {
+	case e := <-sub.Events():
+		if e.ID != snap.ID+1 || e.Item != g.GetNode("10.0.0.2") {
+			t.Errorf("Expected the add of 10.0.0.2 right after the snapshot, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+
+	// resuming gets just what was missed
+	resumed, next := g.SubscribeFrom("resumed", NewSyncEvent(snap.ID).Id())
+	if next.Reset || len(next.Events) != 1 || next.ID != snap.ID+1 {
+		t.Errorf("Expected to resume with one event, got %+v", next)
+	}
+	if stats := g.Subscriptions(); len(stats) != 2 || stats[0].Name != "resumed" {
+		t.Errorf("Expected both subscriptions, got %+v", stats)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Events(); ok {
+		t.Errorf("Expected unsubscribing to close the channel")
+	}
+	resumed.Close()
+	if stats := g.Subscriptions(); len(stats) != 0 {
+		t.Errorf("Expected no subscriptions, got %+v", stats)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.QueueSize = 2
+	g := CreateWithConfig(cfg)
+	sub := g.Subscribe("slow")
+	defer sub.Close()
+	next := func() *Event {
+		select {
+		case e := <-sub.Events():
+			return e
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for an event")
+		}
+		return nil
+	}
+
+	// the first event is taken off the queue right away, and waits to be
+	// received
+	n, _ := g.IncrNode("10.0.0.1", nil)
+	// repeated updates of an item only take one spot in the queue
+	for i := 0; i < 5; i++ {
+		n.SetKind(PeerNode)
+		n.SetKind(RouterNode)
+	}
+	g.IncrNode("10.0.0.2", nil)
+	for _, name := range []string{"addNodeEvent", "updateNodeEvent", "addNodeEvent"} {
+		if e := next(); e.Event() != name {
+			t.Fatalf("Expected %s, got %s", name, e.Event())
+		}
+	}
+	if stats := sub.Stats(); stats.Coalesced != 9 || stats.Dropped != 0 {
+		t.Errorf("Expected 9 coalesced updates and nothing dropped, got %+v", stats)
+	}
+
+	// once the queue overflows we get told to resync, instead of losing
+	// events without knowing
+	for _, name := range []string{"10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		g.IncrNode(name, nil)
+	}
+	// the ones which made it out before we fell behind come first
+	for e := next(); !e.Resync(); e = next() {
+	}
+	if stats := sub.Stats(); stats.Dropped == 0 || stats.Resyncs != 1 {
+		t.Errorf("Expected dropped events and a resync, got %+v", stats)
+	}
+	snap := sub.Resync()
+	if !snap.Reset || len(snap.Events) != 6 || snap.ID != g.LastEventID() {
+		t.Fatalf("Expected a snapshot of the 6 nodes, got %+v", snap)
+	}
+
+	// and carry on after the snapshot
+	g.IncrNode("10.0.0.7", nil)
+	if e := next(); e.ID != snap.ID+1 {
+		t.Errorf("Expected the event after the snapshot, got %+v", e)
+	}
+}
@@ -1,27 +1,282 @@
 // TODO: better name? network topology?
 package graph
 
+import (
+	"encoding/json"
+	"math"
+	"sync"
+)
+
+// How much the link metrics need to change before we fire an update event
+const (
+	linkLossDelta    = 0.05
+	linkLatencyDelta = 0.1 // percentage
+)
+
+// weight of a new traceroute sample in the link's latency moving average
+const hopLatencyWeight = 0.2
+
+// Health metrics of a link
+type LinkMetrics struct {
+	State GraphState `json:"state"`
+	// estimated loss rate of the link (0-1)
+	LossRate float64 `json:"lossRate"`
+	// estimated latency of the link (ns)
+	Latency float64 `json:"latency"`
+}
+
 type NetworkLink struct {
 	SrcName string `json:"src"`
 	srcNode *NetworkNode
 	DstName string `json:"dst"`
 	dstNode *NetworkNode
 
+	LinkMetrics
+	// the metrics as of the last update event we sent
+	published LinkMetrics
+	lLock     *sync.RWMutex
+
+	// routes that traverse this link
+	routes map[*NetworkRoute]struct{}
+
+	// moving average of the latency between the hops from traceroutes
+	hopLatency float64
+	hopSamples int
+
+	// metrics reported for this link by other graphs (e.g. peers of the
+	// aggregator) source -> metrics
+	reports map[string]LinkMetrics
+
 	refCount int
+
+	// Channel to send update event on
+	updateChan chan *Event
+	// closed once nothing reads updateChan
+	stopChan <-chan struct{}
+}
+
+func newNetworkLink(src, dst *NetworkNode, updateChan chan *Event, stopChan <-chan struct{}) *NetworkLink {
+	l := &NetworkLink{
+		SrcName:    src.Name,
+		srcNode:    src,
+		DstName:    dst.Name,
+		dstNode:    dst,
+		updateChan: updateChan,
+		stopChan:   stopChan,
+	}
+	l.init()
+	return l
+}
+
+func (l *NetworkLink) init() {
+	l.lLock = &sync.RWMutex{}
+	l.routes = make(map[*NetworkRoute]struct{})
+	l.reports = make(map[string]LinkMetrics)
+}
+
+func (l *NetworkLink) Key() string {
+	return l.SrcName + ";" + l.DstName
+}
+
+func (l *NetworkLink) Metrics() LinkMetrics {
+	l.lLock.RLock()
+	defer l.lLock.RUnlock()
+	return l.LinkMetrics
+}
+
+// Routes which go over the link
+func (l *NetworkLink) Routes() []*NetworkRoute {
+	l.lLock.RLock()
+	defer l.lLock.RUnlock()
+	return routeList(l.routes)
+}
+
+func (l *NetworkLink) addRoute(r *NetworkRoute) {
+	l.lLock.Lock()
+	l.routes[r] = struct{}{}
+	l.lLock.Unlock()
+	l.refresh()
+}
+
+func (l *NetworkLink) removeRoute(r *NetworkRoute) {
+	l.lLock.Lock()
+	delete(l.routes, r)
+	l.lLock.Unlock()
+	l.refresh()
+}
+
+// Record the latency between the 2 ends of this link, as measured by a traceroute
+func (l *NetworkLink) RecordHopLatency(latency int64) {
+	if latency < 0 {
+		// the ICMP responses of routers are very much best-effort, so the
+		// next hop can respond faster than the previous one
+		latency = 0
+	}
+	l.lLock.Lock()
+	if l.hopSamples == 0 {
+		l.hopLatency = float64(latency)
+	} else {
+		l.hopLatency = hopLatencyWeight*float64(latency) + (1-hopLatencyWeight)*l.hopLatency
+	}
+	l.hopSamples++
+	l.lLock.Unlock()
+	l.refresh()
+}
+
+// Merge in the metrics some other graph has for this link
+func (l *NetworkLink) MergeReport(source string, m LinkMetrics) {
+	l.lLock.Lock()
+	l.reports[source] = m
+	l.lLock.Unlock()
+	l.refresh()
+}
+
+func (l *NetworkLink) RemoveReport(source string) {
+	l.lLock.Lock()
+	delete(l.reports, source)
+	l.lLock.Unlock()
+	l.refresh()
+}
+
+// Recalculate the metrics of the link, and fire an update event if they
+// changed enough to care about
+func (l *NetworkLink) refresh() {
+	l.lLock.Lock()
+	if len(l.reports) > 0 {
+		l.LinkMetrics = l.fromReports()
+	} else {
+		l.LinkMetrics = l.fromRoutes()
+	}
+	changed := linkMetricsChanged(l.published, l.LinkMetrics)
+	if changed {
+		l.published = l.LinkMetrics
+	}
+	l.lLock.Unlock()
+
+	if changed && l.updateChan != nil {
+		sendEvent(l.updateChan, l.stopChan, &Event{
+			E:    updateEvent,
+			Item: l,
+		})
+	}
+}
+
+// Since we only have end-to-end measurements, we estimate the link based on
+// all of the routes through it:
+//   - if any route through it is up, so is the link
+//   - the link's loss can't be more than the loss of any route through it
+//   - latency comes from the traceroute hops (if we have them) otherwise we
+//     take an even share of the fastest route's latency
+func (l *NetworkLink) fromRoutes() LinkMetrics {
+	states := make([]GraphState, 0, len(l.routes))
+	loss := math.Inf(1)
+	latency := math.Inf(1)
+	for r := range l.routes {
+		states = append(states, r.GetState())
+		m := r.Metrics()
+		if m.NumPoints == 0 {
+			continue
+		}
+		loss = math.Min(loss, m.LossRate)
+		if len(r.Path) > 1 {
+			latency = math.Min(latency, m.Average/float64(len(r.Path)-1))
+		}
+	}
+
+	ret := LinkMetrics{State: mergeStates(states)}
+	if !math.IsInf(loss, 1) {
+		ret.LossRate = loss
+	}
+	if l.hopSamples > 0 {
+		ret.Latency = l.hopLatency
+	} else if !math.IsInf(latency, 1) {
+		ret.Latency = latency
+	}
+	return ret
+}
+
+// Merge all the reports we have using the same rules as `fromRoutes`
+func (l *NetworkLink) fromReports() LinkMetrics {
+	states := make([]GraphState, 0, len(l.reports))
+	loss := math.Inf(1)
+	var latency float64
+	latencyCount := 0
+	for _, m := range l.reports {
+		states = append(states, m.State)
+		loss = math.Min(loss, m.LossRate)
+		if m.Latency > 0 {
+			latency += m.Latency
+			latencyCount++
+		}
+	}
+
+	ret := LinkMetrics{
+		State:    mergeStates(states),
+		LossRate: loss,
+	}
+	if latencyCount > 0 {
+		ret.Latency = latency / float64(latencyCount)
+	}
+	return ret
+}
+
+// Up if anything is Up, Down if everything is down-- otherwise Suspect
+func mergeStates(states []GraphState) GraphState {
+	if len(states) == 0 {
+		return Up
+	}
+	down := 0
+	for _, s := range states {
+		switch s {
+		case Up:
+			return Up
+		case Down:
+			down++
+		}
+	}
+	if down == len(states) {
+		return Down
+	}
+	return Suspect
+}
+
+func linkMetricsChanged(o, n LinkMetrics) bool {
+	if o.State != n.State {
+		return true
+	}
+	if math.Abs(o.LossRate-n.LossRate) >= linkLossDelta {
+		return true
+	}
+	if o.Latency == 0 {
+		return n.Latency != 0
+	}
+	return math.Abs(o.Latency-n.Latency)/o.Latency >= linkLatencyDelta
 }
 
-// TODO: use? right now it embeds the network node in the response-- which is duplicated data
-/*
 // Fancy marshal method
 func (l *NetworkLink) MarshalJSON() ([]byte, error) {
+	l.lLock.RLock()
+	defer l.lLock.RUnlock()
 
 	type Alias NetworkLink
 	return json.Marshal(&struct {
-		Src string
-		Dst string
+		*Alias
 	}{
-		Src: l.Src.Name,
-		Dst: l.Dst.Name,
+		Alias: (*Alias)(l),
 	})
 }
-*/
+
+// Fancy unmashal method
+func (l *NetworkLink) UnmarshalJSON(data []byte) error {
+	type Alias NetworkLink
+	aux := &struct {
+		*Alias
+	}{
+		Alias: (*Alias)(l),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	l.init()
+	return nil
+}
@@ -0,0 +1,58 @@
+package graph
+
+import (
+	"testing"
+)
+
+func TestLinkState(t *testing.T) {
+	g := Create()
+
+	a, _ := g.IncrRoute([]string{"1", "2", "3"}, nil)
+	b, _ := g.IncrRoute([]string{"4", "2", "3"}, nil)
+
+	// take down route a, the shared link should still be up (route b is)
+	for i := 0; i < 10; i++ {
+		a.HandleACK(false, 0)
+	}
+	if s := g.GetLink("1;2").Metrics().State; s != Down {
+		t.Errorf("link 1;2 has the wrong state expected=%d actual=%d", Down, s)
+	}
+	if s := g.GetLink("2;3").Metrics().State; s != Up {
+		t.Errorf("link 2;3 has the wrong state expected=%d actual=%d", Up, s)
+	}
+
+	// take down route b, now the shared link is down as well
+	for i := 0; i < 10; i++ {
+		b.HandleACK(false, 0)
+	}
+	if s := g.GetLink("2;3").Metrics().State; s != Down {
+		t.Errorf("link 2;3 has the wrong state expected=%d actual=%d", Down, s)
+	}
+	if l := g.GetLink("2;3").Metrics().LossRate; l != 1 {
+		t.Errorf("link 2;3 has the wrong lossRate expected=1 actual=%f", l)
+	}
+
+	// once route b is gone, the link reflects just a
+	g.DecrRoute([]string{"4", "2", "3"})
+	if len(g.GetLink("2;3").routes) != 1 {
+		t.Errorf("link 2;3 has the wrong number of routes expected=1 actual=%d", len(g.GetLink("2;3").routes))
+	}
+}
+
+func TestLinkReports(t *testing.T) {
+	g := Create()
+	l, _ := g.IncrLink("1", "2", nil)
+
+	l.MergeReport("a", LinkMetrics{State: Down, LossRate: 1, Latency: 10})
+	l.MergeReport("b", LinkMetrics{State: Up, LossRate: 0.2, Latency: 20})
+
+	m := l.Metrics()
+	if m.State != Up || m.LossRate != 0.2 || m.Latency != 15 {
+		t.Errorf("wrong merged metrics: %v", m)
+	}
+
+	l.RemoveReport("b")
+	if m := l.Metrics(); m.State != Down || m.LossRate != 1 || m.Latency != 10 {
+		t.Errorf("wrong merged metrics: %v", m)
+	}
+}
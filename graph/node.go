@@ -4,32 +4,65 @@ package graph
 import (
 	"encoding/json"
 	"net"
+	"strings"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
 )
 
-// TODO: differentiate between peers and L3devices in the middle
+// What a node is, as far as we can tell
+type NodeKind string
+
+const (
+	// a member of the cluster, at the end of routes
+	PeerNode NodeKind = "peer"
+	// something in the middle that answered the traceroute
+	RouterNode NodeKind = "router"
+	// a hop that didn't answer, named after the hops around it (see FillPath)
+	AnonymousNode NodeKind = "anonymous"
+)
+
+// The kind of the node `name`, if it isn't a peer
+func KindOf(name string) NodeKind {
+	if strings.Contains(name, UNKNOWN_PATH) {
+		return AnonymousNode
+	}
+	return RouterNode
+}
+
 // TODO: handle addr '*' -- to compensate maybe we can just use a compound of the
 // node on either side? so something like A -> * -> * -> B would become A*_B (for the second *)
-// TODO: maintain pointers to NetworkLink for traversal
 type NetworkNode struct {
-	Name string `json:"name"`
+	Name string   `json:"name"`
+	Kind NodeKind `json:"kind"`
 
 	// asynchronously loaded
 	DNSNames []string `json:"dns_names"`
 	nLock    *sync.RWMutex
 
+	// links to and from this node, and the routes through it, for traversal
+	in     map[*NetworkLink]struct{}
+	out    map[*NetworkLink]struct{}
+	routes map[*NetworkRoute]struct{}
+
 	refCount int
 
 	updateChan chan *Event
+	// closed once nothing reads updateChan
+	stopChan <-chan struct{}
 }
 
 func NewNetworkNode(name string, updateChan chan *Event) *NetworkNode {
+	return newNetworkNode(name, updateChan, nil)
+}
+
+func newNetworkNode(name string, updateChan chan *Event, stopChan <-chan struct{}) *NetworkNode {
 	r := &NetworkNode{
 		Name:       name,
+		Kind:       KindOf(name),
 		nLock:      &sync.RWMutex{},
 		updateChan: updateChan,
+		stopChan:   stopChan,
 	}
 
 	// background load DNS names
@@ -43,16 +76,97 @@ func NewNetworkNode(name string, updateChan chan *Event) *NetworkNode {
 			n.nLock.Unlock()
 
 			// Update event if the resolution completes
-			n.updateChan <- &Event{
+			sendEvent(n.updateChan, n.stopChan, &Event{
 				E:    updateEvent,
 				Item: n,
-			}
+			})
 		}
 	}(r)
 
 	return r
 }
 
+func (n *NetworkNode) GetKind() NodeKind {
+	n.nLock.RLock()
+	defer n.nLock.RUnlock()
+	return n.Kind
+}
+
+// Set the kind of the node, firing an update event if it changed
+func (n *NetworkNode) SetKind(kind NodeKind) {
+	n.nLock.Lock()
+	changed := n.Kind != kind
+	n.Kind = kind
+	n.nLock.Unlock()
+
+	if changed {
+		sendEvent(n.updateChan, n.stopChan, &Event{
+			E:    updateEvent,
+			Item: n,
+		})
+	}
+}
+
+func (n *NetworkNode) addLink(l *NetworkLink) {
+	n.nLock.Lock()
+	defer n.nLock.Unlock()
+	if l.srcNode == n {
+		if n.out == nil {
+			n.out = make(map[*NetworkLink]struct{})
+		}
+		n.out[l] = struct{}{}
+	}
+	if l.dstNode == n {
+		if n.in == nil {
+			n.in = make(map[*NetworkLink]struct{})
+		}
+		n.in[l] = struct{}{}
+	}
+}
+
+func (n *NetworkNode) removeLink(l *NetworkLink) {
+	n.nLock.Lock()
+	defer n.nLock.Unlock()
+	delete(n.out, l)
+	delete(n.in, l)
+}
+
+func (n *NetworkNode) addRoute(r *NetworkRoute) {
+	n.nLock.Lock()
+	defer n.nLock.Unlock()
+	if n.routes == nil {
+		n.routes = make(map[*NetworkRoute]struct{})
+	}
+	n.routes[r] = struct{}{}
+}
+
+func (n *NetworkNode) removeRoute(r *NetworkRoute) {
+	n.nLock.Lock()
+	defer n.nLock.Unlock()
+	delete(n.routes, r)
+}
+
+// Links into the node
+func (n *NetworkNode) InLinks() []*NetworkLink {
+	n.nLock.RLock()
+	defer n.nLock.RUnlock()
+	return linkList(n.in)
+}
+
+// Links out of the node
+func (n *NetworkNode) OutLinks() []*NetworkLink {
+	n.nLock.RLock()
+	defer n.nLock.RUnlock()
+	return linkList(n.out)
+}
+
+// Routes which go through the node
+func (n *NetworkNode) Routes() []*NetworkRoute {
+	n.nLock.RLock()
+	defer n.nLock.RUnlock()
+	return routeList(n.routes)
+}
+
 // Fancy marshal method
 func (n *NetworkNode) MarshalJSON() ([]byte, error) {
 	n.nLock.RLock()
@@ -0,0 +1,174 @@
+package graph
+
+import (
+	"sort"
+)
+
+// Max number of paths AllPaths returns, if the caller doesn't say
+const defaultPathLimit = 100
+
+// Max number of partial paths AllPaths queues up looking for paths, as dense
+// parts of the graph have a lot of them
+const pathSearchBudget = 100000
+
+// The links into and out of a node
+type Adjacency struct {
+	Node *NetworkNode   `json:"node"`
+	In   []*NetworkLink `json:"in"`
+	Out  []*NetworkLink `json:"out"`
+}
+
+// The links into and out of `name`, nil if it isn't in the graph
+func (g *NetworkGraph) Neighbors(name string) *Adjacency {
+	n := g.GetNode(name)
+	if n == nil {
+		return nil
+	}
+	return &Adjacency{
+		Node: n,
+		In:   n.InLinks(),
+		Out:  n.OutLinks(),
+	}
+}
+
+// Routes which go through the node `name`
+func (g *NetworkGraph) RoutesThroughNode(name string) []*NetworkRoute {
+	n := g.GetNode(name)
+	if n == nil {
+		return nil
+	}
+	return n.Routes()
+}
+
+// Routes which go over the link `src` -> `dst`
+func (g *NetworkGraph) RoutesThroughLink(src, dst string) []*NetworkRoute {
+	l := g.GetLink(src + ";" + dst)
+	if l == nil {
+		return nil
+	}
+	return l.Routes()
+}
+
+// One of the shortest (fewest links) paths from `src` to `dst` over the links
+// we know about, nil if there isn't one
+func (g *NetworkGraph) ShortestPath(src, dst string) []string {
+	start := g.GetNode(src)
+	if start == nil || g.GetNode(dst) == nil {
+		return nil
+	}
+
+	// node -> the node we got to it from
+	prev := map[*NetworkNode]*NetworkNode{start: nil}
+	queue := []*NetworkNode{start}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.Name == dst {
+			path := make([]string, 0)
+			for ; n != nil; n = prev[n] {
+				path = append(path, n.Name)
+			}
+			reversePath(path)
+			return path
+		}
+		for _, l := range n.OutLinks() {
+			if _, ok := prev[l.dstNode]; !ok {
+				prev[l.dstNode] = n
+				queue = append(queue, l.dstNode)
+			}
+		}
+	}
+	return nil
+}
+
+// All the paths (without loops) from `src` to `dst` over the links we know
+// about, shortest first. At most `limit` are returned, 0 is the default
+func (g *NetworkGraph) AllPaths(src, dst string, limit int) [][]string {
+	if limit <= 0 {
+		limit = defaultPathLimit
+	}
+	ret := make([][]string, 0)
+	start := g.GetNode(src)
+	if start == nil || g.GetNode(dst) == nil {
+		return ret
+	}
+
+	// breadth first, so whenever we run out of limit or budget the paths we
+	// have are the shortest ones. Once we are out of budget we only finish
+	// what is queued
+	queue := [][]*NetworkNode{{start}}
+	queued := 1
+	for len(queue) > 0 && len(ret) < limit {
+		path := queue[0]
+		queue = queue[1:]
+		n := path[len(path)-1]
+		if n.Name == dst {
+			found := make([]string, len(path))
+			for i, hop := range path {
+				found[i] = hop.Name
+			}
+			ret = append(ret, found)
+			continue
+		}
+		for _, l := range n.OutLinks() {
+			if queued >= pathSearchBudget {
+				break
+			}
+			if onPath(path, l.dstNode) {
+				continue
+			}
+			next := make([]*NetworkNode, len(path)+1)
+			copy(next, path)
+			next[len(path)] = l.dstNode
+			queue = append(queue, next)
+			queued++
+		}
+	}
+	return ret
+}
+
+func onPath(path []*NetworkNode, n *NetworkNode) bool {
+	for _, hop := range path {
+		if hop == n {
+			return true
+		}
+	}
+	return false
+}
+
+func reversePath(path []string) {
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+}
+
+// sorted by key, so the results are stable
+func linkList(m map[*NetworkLink]struct{}) []*NetworkLink {
+	ret := make([]*NetworkLink, 0, len(m))
+	for l := range m {
+		ret = append(ret, l)
+	}
+	sort.Sort(linksByKey(ret))
+	return ret
+}
+
+func routeList(m map[*NetworkRoute]struct{}) []*NetworkRoute {
+	ret := make([]*NetworkRoute, 0, len(m))
+	for r := range m {
+		ret = append(ret, r)
+	}
+	sort.Sort(routesByKey(ret))
+	return ret
+}
+
+type linksByKey []*NetworkLink
+
+func (l linksByKey) Len() int           { return len(l) }
+func (l linksByKey) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l linksByKey) Less(i, j int) bool { return l[i].Key() < l[j].Key() }
+
+type routesByKey []*NetworkRoute
+
+func (r routesByKey) Len() int           { return len(r) }
+func (r routesByKey) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r routesByKey) Less(i, j int) bool { return r[i].Key() < r[j].Key() }
@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"sort"
+)
+
+// RoundTripRoute pairs a route with the route the replies to its pings take
+// back. Pings measure both directions, so this is what a ping result is
+// actually about
+type RoundTripRoute struct {
+	Forward *NetworkRoute `json:"forward"`
+	// the peer's route back to us, nil if it isn't in this graph (e.g. we
+	// aren't aggregating the peer)
+	Reverse     *NetworkRoute `json:"reverse,omitempty"`
+	ReversePath []string      `json:"reversePath"`
+	// whether the replies come back the way the pings went
+	Symmetric bool `json:"symmetric"`
+}
+
+func (r *RoundTripRoute) Key() string {
+	return r.Forward.Key()
+}
+
+// The round trip of `route`, nil if we don't know the reverse path
+func (g *NetworkGraph) RoundTrip(route *NetworkRoute) *RoundTripRoute {
+	g.RoutesLock.RLock()
+	defer g.RoutesLock.RUnlock()
+	return g.roundTrip(route)
+}
+
+// All the routes in the graph we know the reverse path of, paired with their
+// reverse route
+func (g *NetworkGraph) RoundTrips() []*RoundTripRoute {
+	g.RoutesLock.RLock()
+	defer g.RoutesLock.RUnlock()
+	ret := make([]*RoundTripRoute, 0)
+	for _, route := range g.RoutesMap {
+		if rt := g.roundTrip(route); rt != nil {
+			ret = append(ret, rt)
+		}
+	}
+	sort.Sort(roundTripsByKey(ret))
+	return ret
+}
+
+// Callers must hold RoutesLock
+func (g *NetworkGraph) roundTrip(route *NetworkRoute) *RoundTripRoute {
+	reverse := route.GetReversePath()
+	if reverse == nil {
+		return nil
+	}
+	return &RoundTripRoute{
+		Forward:     route,
+		Reverse:     g.RoutesMap[g.pathKey(reverse)],
+		ReversePath: reverse,
+		Symmetric:   route.SamePathReverse(reverse),
+	}
+}
+
+type roundTripsByKey []*RoundTripRoute
+
+func (r roundTripsByKey) Len() int           { return len(r) }
+func (r roundTripsByKey) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r roundTripsByKey) Less(i, j int) bool { return r[i].Key() < r[j].Key() }
+
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -7,37 +7,73 @@ import (
 	"encoding/json"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/montanaflynn/stats"
 )
 
-// TODO: measure jitter (diff between 2 packet sends)
+// A single ping (or burst of pings) on a route
 type RoutePingResponse struct {
 	Pass    bool  // Did it ack?
 	Latency int64 // Latency (if it ackd)
+
+	// For bursts, how many pings we sent and how many unique acks we got. Both
+	// are 0 for single pings
+	Sent     int
+	Received int
+	// acks we got more than once, and acks which arrived after a later one
+	Duplicates int
+	Reordered  int
+
+	// RFC 3550 jitter of the route (ns) as of this point
+	Jitter float64
+
+	// for TCP pings, how long the handshake took (ns)
+	Handshake int64
+}
+
+// Number of packets lost and sent
+func (p RoutePingResponse) Loss() (int, int) {
+	if p.Sent == 0 {
+		if p.Pass {
+			return 0, 1
+		}
+		return 1, 1
+	}
+	return p.Sent - p.Received, p.Sent
 }
 
-// TODO: RoundTripRoute? Right now the Route is a single direction since we only
-// have one side of the traceroute. If the peers gossip about the reverse routes
-// then we could potentially have both directions
-// TODO: TTL for routes? If we just start up we don't want to have to re-ping the
-// world before we are useful
+// A NetworkRoute is a single direction, since we only have our side of the
+// traceroute. The peer tells us the path its replies take back to us, which
+// is what a RoundTripRoute pairs it with
 // TODO: stats about route health
 type NetworkRoute struct {
-	Path []string       `json:"path"`
-	path []*NetworkNode `json:"path"`
+	Path []string `json:"path"`
+	// path of the peer's route back to us, nil until the peer tells us
+	ReversePath []string `json:"reversePath,omitempty"`
+	path        []*NetworkNode
+	// links between the hops in `path`
+	links []*NetworkLink
 
 	// Network statistics
-	State graphState `json:"state"` // TODO: better handle in the serialization
+	State GraphState `json:"state"` // TODO: better handle in the serialization
 
 	metricRing *ring.Ring
 	mLock      *sync.RWMutex
+	jitter     jitterEstimator
+	// what decides the State based on the metricRing
+	evaluator StateEvaluator
 
 	// how many are refrencing it
 	refCount int
 
+	// last time the mapper found the route
+	lastSeen time.Time
+
 	// Channel to send update event on
 	updateChan chan *Event
+	// closed once nothing reads updateChan
+	stopChan <-chan struct{}
 }
 
 // TODO: we make the assumption here that the other route goes away-- which since
@@ -45,9 +81,12 @@ type NetworkRoute struct {
 // changes we'll need to be more careful here-- as we are just pointing at
 // another ring-- which has its own pings going on
 func (r *NetworkRoute) Inherit(o *NetworkRoute) {
+	reverse := o.GetReversePath()
 	r.mLock.Lock()
 	defer r.mLock.Unlock()
 	r.metricRing = o.metricRing
+	r.jitter = o.jitter
+	r.ReversePath = reverse
 }
 
 func (r *NetworkRoute) Key() string {
@@ -59,40 +98,199 @@ func (r *NetworkRoute) Key() string {
 }
 
 func (r *NetworkRoute) HandleACK(pass bool, latency int64) {
-	r.mLock.Lock()
-	defer r.mLock.Unlock()
-	r.metricRing.Value = RoutePingResponse{
+	var replies []ProbeReply
+	if pass {
+		replies = []ProbeReply{{Latency: latency}}
+	}
+	r.record(RoutePingResponse{
 		Pass:    pass,
 		Latency: latency,
+	}, replies)
+}
+
+// Handle the replies (in the order they arrived) to a burst of `sent` pings.
+// `timeout` is the latency we record if nothing came back
+func (r *NetworkRoute) HandleBurst(sent int, replies []ProbeReply, timeout int64) {
+	r.record(SummarizeBurst(sent, replies, timeout), replies)
+}
+
+// Same as HandleBurst, for TCP pings where we also measured the `handshake`
+func (r *NetworkRoute) HandleTCPBurst(handshake int64, sent int, replies []ProbeReply, timeout int64) {
+	point := SummarizeBurst(sent, replies, timeout)
+	point.Handshake = handshake
+	r.record(point, replies)
+}
+
+// Record a ping (and the `replies` it got) and let everyone know if the
+// state changed
+func (r *NetworkRoute) record(point RoutePingResponse, replies []ProbeReply) {
+	// TODO: also send updates when metrics change sufficiently?
+	if r.addPoint(point, replies) {
+		sendEvent(r.updateChan, r.stopChan, &Event{
+			E:    updateEvent,
+			Item: r,
+		})
+	}
+
+	// Now that we have new metrics, the links we traverse need to update theirs
+	r.refreshLinks()
+}
+
+// Add the point to the metricRing and update our state, returning whether the
+// state changed
+func (r *NetworkRoute) addPoint(point RoutePingResponse, replies []ProbeReply) bool {
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+
+	// single pings don't count what they sent
+	sent := point.Sent
+	if sent == 0 {
+		sent = 1
 	}
+	r.jitter.addReplies(sent, replies)
+	point.Jitter = r.jitter.Jitter
+
+	r.metricRing.Value = point
 	r.metricRing = r.metricRing.Next()
 
-	// TODO: change to percentage thresholds
-	// update state
 	origState := r.State
-	if pass == true { // Going up
-		switch r.State {
-		case Suspect:
-			r.State = Up
-		case Down:
-			r.State = Suspect
-		}
-	} else { // going down
-		switch r.State {
-		case Up:
-			r.State = Suspect
-		case Suspect:
-			r.State = Down
+	r.State = r.stateEvaluator().Evaluate(r.State, r.window())
+	return origState != r.State
+}
+
+func (r *NetworkRoute) stateEvaluator() StateEvaluator {
+	if r.evaluator == nil {
+		return defaultStateEvaluator
+	}
+	return r.evaluator
+}
+
+// The points in the metricRing, oldest first. Callers must hold mLock
+func (r *NetworkRoute) window() []RoutePingResponse {
+	points := make([]RoutePingResponse, 0, r.metricRing.Len())
+	// the ring is pointing at the next spot to write-- which is the oldest
+	r.metricRing.Do(func(x interface{}) {
+		if x != nil {
+			points = append(points, x.(RoutePingResponse))
 		}
+	})
+	return points
+}
+
+// The points in the metricRing, oldest first
+func (r *NetworkRoute) Points() []RoutePingResponse {
+	r.mLock.RLock()
+	defer r.mLock.RUnlock()
+	return r.window()
+}
+
+// Load the state and points (oldest first) of a route from a snapshot, so we
+// don't have to re-ping it before we know anything about it
+func (r *NetworkRoute) Restore(state GraphState, points []RoutePingResponse) {
+	if r.restore(state, points) {
+		sendEvent(r.updateChan, r.stopChan, &Event{
+			E:    updateEvent,
+			Item: r,
+		})
 	}
+	r.refreshLinks()
+}
 
-	// TODO: also send updates when metrics change sufficiently?
-	if origState != r.State {
-		r.updateChan <- &Event{
+// Load the points and state, returning whether the state changed
+func (r *NetworkRoute) restore(state GraphState, points []RoutePingResponse) bool {
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+
+	// only the newest ones fit
+	if len(points) > r.metricRing.Len() {
+		points = points[len(points)-r.metricRing.Len():]
+	}
+	for _, point := range points {
+		r.metricRing.Value = point
+		r.metricRing = r.metricRing.Next()
+	}
+	if len(points) > 0 {
+		r.jitter.Jitter = points[len(points)-1].Jitter
+	}
+
+	origState := r.State
+	r.State = state
+	return origState != r.State
+}
+
+func (r *NetworkRoute) refreshLinks() {
+	for _, l := range r.links {
+		l.refresh()
+	}
+}
+
+// Mark the route as seen just now
+func (r *NetworkRoute) Touch() {
+	r.SetLastSeen(time.Now())
+}
+
+func (r *NetworkRoute) SetLastSeen(t time.Time) {
+	r.mLock.Lock()
+	defer r.mLock.Unlock()
+	r.lastSeen = t
+}
+
+func (r *NetworkRoute) LastSeen() time.Time {
+	r.mLock.RLock()
+	defer r.mLock.RUnlock()
+	return r.lastSeen
+}
+
+func (r *NetworkRoute) GetState() GraphState {
+	r.mLock.RLock()
+	defer r.mLock.RUnlock()
+	return r.State
+}
+
+// Set the state of the route, firing an update event if it changed. This is
+// for routes whose state is measured somewhere else (e.g. the aggregator)
+func (r *NetworkRoute) SetState(s GraphState) {
+	r.mLock.Lock()
+	origState := r.State
+	r.State = s
+	r.mLock.Unlock()
+
+	if origState != s {
+		sendEvent(r.updateChan, r.stopChan, &Event{
 			E:    updateEvent,
 			Item: r,
-		}
+		})
+		r.refreshLinks()
+	}
+}
+
+// Set the path the replies to pings down this route take back, firing an
+// update event if it changed
+func (r *NetworkRoute) SetReversePath(path []string) {
+	r.mLock.Lock()
+	if samePath(r.ReversePath, path) {
+		r.mLock.Unlock()
+		return
+	}
+	r.ReversePath = make([]string, len(path))
+	copy(r.ReversePath, path)
+	r.mLock.Unlock()
+
+	sendEvent(r.updateChan, r.stopChan, &Event{
+		E:    updateEvent,
+		Item: r,
+	})
+}
+
+func (r *NetworkRoute) GetReversePath() []string {
+	r.mLock.RLock()
+	defer r.mLock.RUnlock()
+	if r.ReversePath == nil {
+		return nil
 	}
+	tmp := make([]string, len(r.ReversePath))
+	copy(tmp, r.ReversePath)
+	return tmp
 }
 
 func (r *NetworkRoute) SamePath(path []string) bool {
@@ -130,57 +328,98 @@ func (r *NetworkRoute) Hops() []string {
 	return tmp
 }
 
-// Fancy marshal method
-func (r *NetworkRoute) MarshalJSON() ([]byte, error) {
+// Summary of the points in the metricRing
+type RouteMetrics struct {
+	NumPoints         int     `json:"numPoints"`
+	Average           float64 `json:"average"`
+	LossRate          float64 `json:"lossRate"`
+	StandardDeviation float64 `json:"standardDeviation,omitempty"`
+
+	// RFC 3550 jitter (ns)
+	Jitter float64 `json:"jitter,omitempty"`
+	// fraction of the acks we got which were duplicates/out of order
+	DuplicateRate float64 `json:"duplicateRate,omitempty"`
+	ReorderRate   float64 `json:"reorderRate,omitempty"`
+
+	// average TCP handshake time (ns) of the TCP pings
+	HandshakeAverage float64 `json:"handshakeAverage,omitempty"`
+}
+
+func (r *NetworkRoute) Metrics() RouteMetrics {
 	r.mLock.RLock()
 	defer r.mLock.RUnlock()
-	// Convert MetricRing to a list of points
-	fail := 0
-	// TODO: re-add raw points
-	metricPoints := make([]RoutePingResponse, 0, r.metricRing.Len())
+	return r.metrics()
+}
+
+// Do all metrics calculations here, callers must hold mLock
+func (r *NetworkRoute) metrics() RouteMetrics {
+	lost, sent := 0, 0
+	received, duplicates, reordered := 0, 0, 0
+	var last *RoutePingResponse
+	var totalHandshake float64
+	handshakes := 0
 	latencies := make([]float64, 0, r.metricRing.Len())
 	r.metricRing.Do(func(x interface{}) {
 		if x != nil {
 			point := x.(RoutePingResponse)
-			metricPoints = append(metricPoints, point)
 			latencies = append(latencies, float64(point.Latency))
-			if !point.Pass {
-				fail++
+			l, s := point.Loss()
+			lost += l
+			sent += s
+			received += s - l
+			duplicates += point.Duplicates
+			reordered += point.Reordered
+			if point.Handshake > 0 {
+				totalHandshake += float64(point.Handshake)
+				handshakes++
 			}
+			last = &point
 		}
 	})
 
-	// Do all metrics calculations here
-	metrics := make(map[string]interface{})
-	metrics["numPoints"] = len(metricPoints)
-	if len(metricPoints) > 0 {
+	metrics := RouteMetrics{NumPoints: len(latencies)}
+	if len(latencies) > 0 {
 		var totalLatency float64 = 0
 		for _, l := range latencies {
 			totalLatency += l
 		}
-		metrics["average"] = float64(totalLatency) / float64(len(metricPoints))
-		metrics["lossRate"] = float64(fail) / float64(len(metricPoints))
-	} else {
-		metrics["average"] = float64(0)
-		metrics["lossRate"] = float64(0)
+		metrics.Average = totalLatency / float64(len(latencies))
+		metrics.LossRate = float64(lost) / float64(sent)
+		metrics.Jitter = last.Jitter
+	}
+	if handshakes > 0 {
+		metrics.HandshakeAverage = totalHandshake / float64(handshakes)
+	}
+	if received > 0 {
+		metrics.DuplicateRate = float64(duplicates) / float64(received+duplicates)
+		metrics.ReorderRate = float64(reordered) / float64(received)
 	}
 	if dev, err := stats.StandardDeviation(latencies); err == nil {
-		metrics["standardDeviation"] = dev
+		metrics.StandardDeviation = dev
 	}
+	return metrics
+}
 
+// Fancy marshal method
+func (r *NetworkRoute) MarshalJSON() ([]byte, error) {
+	r.mLock.RLock()
+	defer r.mLock.RUnlock()
+
+	// TODO: re-add raw points
 	type Alias NetworkRoute
 	return json.Marshal(&struct {
-		//MetricPoints []RoutePingResponse
-		Metrics map[string]interface{} `json:"metrics"`
+		Metrics  RouteMetrics `json:"metrics"`
+		LastSeen time.Time    `json:"lastSeen"`
 		*Alias
 	}{
-		//MetricPoints: metricPoints,
-		Metrics: metrics,
-		Alias:   (*Alias)(r),
+		Metrics:  r.metrics(),
+		LastSeen: r.lastSeen,
+		Alias:    (*Alias)(r),
 	})
 }
 
-// Fancy unmashal method
+// Fancy unmashal method. The points aren't in the JSON, so the route gets its
+// metricRing (of the graph's ring_size) once it's added to a graph
 func (r *NetworkRoute) UnmarshalJSON(data []byte) error {
 	type Alias NetworkRoute
 	aux := &struct {
@@ -191,7 +430,6 @@ func (r *NetworkRoute) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
-	r.metricRing = ring.New(100) // TODO: config
 	r.mLock = &sync.RWMutex{}
 	return nil
 }
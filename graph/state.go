@@ -1,9 +1,154 @@
 package graph
 
-type graphState uint8
+import (
+	"time"
+)
+
+type GraphState uint8
 
 const (
-	Up graphState = iota
+	Up GraphState = iota
 	Suspect
 	Down
 )
+
+// StateEvaluator decides what state a route should be in, given its current
+// state and the ping results in its metric window (oldest first)
+type StateEvaluator interface {
+	Evaluate(current GraphState, window []RoutePingResponse) GraphState
+}
+
+// StepEvaluator moves the route one state at a time on every ping (Up ->
+// Suspect -> Down and back). This is very sensitive, as a single dropped
+// packet will mark the route as Suspect
+type StepEvaluator struct{}
+
+func (e *StepEvaluator) Evaluate(current GraphState, window []RoutePingResponse) GraphState {
+	if len(window) == 0 {
+		return current
+	}
+	if window[len(window)-1].Pass { // Going up
+		switch current {
+		case Suspect:
+			return Up
+		case Down:
+			return Suspect
+		}
+	} else { // going down
+		switch current {
+		case Up:
+			return Suspect
+		case Suspect:
+			return Down
+		}
+	}
+	return current
+}
+
+// ThresholdEvaluator decides the state based on the loss rate, consecutive
+// failures and latency over the last `Window` pings (a burst is a single ping
+// which failed if nothing came back, but all its packets count for loss). To avoid flapping, a route
+// only gets better once it has had `RecoverPasses` passing pings in a row.
+// Any threshold left at 0 is disabled
+type ThresholdEvaluator struct {
+	// number of most recent pings to consider
+	Window int `yaml:"window"`
+	// number of pings we need before we look at the loss rate
+	MinPoints int `yaml:"min_points"`
+
+	// loss rate (0-1) over the window to be Suspect/Down
+	SuspectLoss float64 `yaml:"suspect_loss"`
+	DownLoss    float64 `yaml:"down_loss"`
+
+	// number of consecutive failed pings to be Suspect/Down
+	SuspectFailures int `yaml:"suspect_failures"`
+	DownFailures    int `yaml:"down_failures"`
+
+	// average latency of the passing pings to be Suspect
+	SuspectLatency time.Duration `yaml:"suspect_latency"`
+
+	// number of consecutive passing pings before the state can get better
+	RecoverPasses int `yaml:"recover_passes"`
+}
+
+var defaultStateEvaluator StateEvaluator = DefaultStateEvaluator()
+
+func DefaultStateEvaluator() *ThresholdEvaluator {
+	return &ThresholdEvaluator{
+		Window:          20,
+		MinPoints:       5,
+		SuspectLoss:     0.1,
+		DownLoss:        0.5,
+		SuspectFailures: 2,
+		DownFailures:    5,
+		RecoverPasses:   3,
+	}
+}
+
+func (e *ThresholdEvaluator) Evaluate(current GraphState, window []RoutePingResponse) GraphState {
+	if e.Window > 0 && len(window) > e.Window {
+		window = window[len(window)-e.Window:]
+	}
+	if len(window) == 0 {
+		return current
+	}
+
+	fail := 0
+	lost, sent := 0, 0
+	var totalLatency int64
+	for _, point := range window {
+		if point.Pass {
+			totalLatency += point.Latency
+		} else {
+			fail++
+		}
+		l, s := point.Loss()
+		lost += l
+		sent += s
+	}
+
+	// count the streak at the end of the window
+	trailingFails, trailingPasses := 0, 0
+	for i := len(window) - 1; i >= 0; i-- {
+		if window[i].Pass {
+			if trailingFails > 0 {
+				break
+			}
+			trailingPasses++
+		} else {
+			if trailingPasses > 0 {
+				break
+			}
+			trailingFails++
+		}
+	}
+
+	// bursts count each of their packets towards the loss rate
+	lossRate := float64(lost) / float64(sent)
+	enoughPoints := len(window) >= e.MinPoints
+
+	state := Up
+	if enoughPoints && e.SuspectLoss > 0 && lossRate >= e.SuspectLoss {
+		state = Suspect
+	}
+	if e.SuspectFailures > 0 && trailingFails >= e.SuspectFailures {
+		state = Suspect
+	}
+	if e.SuspectLatency > 0 && fail < len(window) {
+		if time.Duration(totalLatency/int64(len(window)-fail)) >= e.SuspectLatency {
+			state = Suspect
+		}
+	}
+	if enoughPoints && e.DownLoss > 0 && lossRate >= e.DownLoss {
+		state = Down
+	}
+	if e.DownFailures > 0 && trailingFails >= e.DownFailures {
+		state = Down
+	}
+
+	// getting worse happens right away, getting better needs a streak
+	if state < current && trailingPasses < e.RecoverPasses {
+		return current
+	}
+	return state
+}
@@ -0,0 +1,68 @@
+package graph
+
+import (
+	"testing"
+)
+
+func points(passes ...bool) []RoutePingResponse {
+	ret := make([]RoutePingResponse, 0, len(passes))
+	for _, pass := range passes {
+		ret = append(ret, RoutePingResponse{Pass: pass})
+	}
+	return ret
+}
+
+func passes(n int) []RoutePingResponse {
+	ret := make([]RoutePingResponse, n)
+	for i := range ret {
+		ret[i].Pass = true
+	}
+	return ret
+}
+
+func TestThresholdEvaluator(t *testing.T) {
+	e := DefaultStateEvaluator()
+
+	tests := []struct {
+		name     string
+		current  GraphState
+		window   []RoutePingResponse
+		expected GraphState
+	}{
+		{"single drop", Up, append(passes(19), points(false)...), Up},
+		{"consecutive drops", Up, points(true, true, true, false, false), Suspect},
+		{"outage", Up, points(true, false, false, false, false, false), Down},
+		{"loss rate", Up, points(false, true, false, true, false, true, false, true, true, true), Suspect},
+		{"not enough points for loss", Up, points(false, true), Up},
+		{"recovering", Down, points(false, false, false, false, false, true), Down},
+		{"recovered", Down, append(points(false, false, false, false, false), passes(10)...), Suspect},
+		{"no points", Suspect, points(), Suspect},
+	}
+
+	for _, test := range tests {
+		if s := e.Evaluate(test.current, test.window); s != test.expected {
+			t.Errorf("%s: wrong state expected=%d actual=%d", test.name, test.expected, s)
+		}
+	}
+}
+
+func TestStepEvaluator(t *testing.T) {
+	e := &StepEvaluator{}
+	if s := e.Evaluate(Up, points(false)); s != Suspect {
+		t.Errorf("wrong state expected=%d actual=%d", Suspect, s)
+	}
+	if s := e.Evaluate(Down, points(true)); s != Suspect {
+		t.Errorf("wrong state expected=%d actual=%d", Suspect, s)
+	}
+}
+
+func TestRouteStateEvaluator(t *testing.T) {
+	g := Create()
+	g.SetStateEvaluator(&StepEvaluator{})
+	r, _ := g.IncrRoute([]string{"1", "2"}, nil)
+
+	r.HandleACK(false, 0)
+	if s := r.GetState(); s != Suspect {
+		t.Errorf("wrong state expected=%d actual=%d", Suspect, s)
+	}
+}
@@ -0,0 +1,137 @@
+package graphapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+)
+
+// Most paths anyone can ask for with ?limit=
+const maxPathLimit = 1000
+
+// Who uses the routes of the graph, the peer's RouteMap or the aggregated one
+type RouteMap interface {
+	// the route options which go over the link src -> dst
+	Traversing(src, dst string) []*mapper.RouteOption
+}
+
+// Queries answers questions about a graph over HTTP, so nobody needs the whole
+// graph to find out what uses a node
+type Queries struct {
+	Graph    *graph.NetworkGraph
+	RouteMap RouteMap
+}
+
+func NewQueries(g *graph.NetworkGraph, rm RouteMap) *Queries {
+	return &Queries{
+		Graph:    g,
+		RouteMap: rm,
+	}
+}
+
+// Register the queries on `mux` under `prefix` (e.g. /v1/graph)
+func (q *Queries) Register(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/neighbors", q.showNeighbors)
+	mux.HandleFunc(prefix+"/traversing", q.showTraversing)
+	mux.HandleFunc(prefix+"/paths", q.showPaths)
+	mux.HandleFunc(prefix+"/dependents", q.showDependents)
+}
+
+// TODO: better, terrible things are here
+func (q *Queries) setCommonHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+}
+
+// The links into and out of ?node=
+func (q *Queries) showNeighbors(w http.ResponseWriter, r *http.Request) {
+	adj := q.Graph.Neighbors(r.URL.Query().Get("node"))
+	if adj == nil {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	ret, err := json.Marshal(adj)
+	if err != nil {
+		logrus.Errorf("Unable to marshal Neighbors: %v", err)
+	} else {
+		q.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+// The routes through ?node=, or over the link ?src= -> ?dst=
+func (q *Queries) showTraversing(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	var routes []*graph.NetworkRoute
+	switch {
+	case v.Get("node") != "":
+		routes = q.Graph.RoutesThroughNode(v.Get("node"))
+	case v.Get("src") != "" && v.Get("dst") != "":
+		routes = q.Graph.RoutesThroughLink(v.Get("src"), v.Get("dst"))
+	default:
+		http.Error(w, "node, or src and dst are required", http.StatusBadRequest)
+		return
+	}
+	if routes == nil {
+		routes = make([]*graph.NetworkRoute, 0)
+	}
+	ret, err := json.Marshal(routes)
+	if err != nil {
+		logrus.Errorf("Unable to marshal routes: %v", err)
+	} else {
+		q.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+// The shortest path from ?src= to ?dst=, or all of them with ?all=true (up
+// to ?limit=)
+func (q *Queries) showPaths(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	if v.Get("src") == "" || v.Get("dst") == "" {
+		http.Error(w, "src and dst are required", http.StatusBadRequest)
+		return
+	}
+	var paths interface{}
+	if all, _ := strconv.ParseBool(v.Get("all")); all {
+		limit, _ := strconv.Atoi(v.Get("limit"))
+		if limit > maxPathLimit {
+			limit = maxPathLimit
+		}
+		paths = q.Graph.AllPaths(v.Get("src"), v.Get("dst"), limit)
+	} else {
+		path := q.Graph.ShortestPath(v.Get("src"), v.Get("dst"))
+		if path == nil {
+			http.Error(w, "no path", http.StatusNotFound)
+			return
+		}
+		paths = path
+	}
+	ret, err := json.Marshal(paths)
+	if err != nil {
+		logrus.Errorf("Unable to marshal paths: %v", err)
+	} else {
+		q.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+// The pairs of peers whose routes go over the link ?src= -> ?dst=
+func (q *Queries) showDependents(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	if v.Get("src") == "" || v.Get("dst") == "" {
+		http.Error(w, "src and dst are required", http.StatusBadRequest)
+		return
+	}
+	ret, err := json.Marshal(mapper.PeerPairs(q.RouteMap.Traversing(v.Get("src"), v.Get("dst"))))
+	if err != nil {
+		logrus.Errorf("Unable to marshal peer pairs: %v", err)
+	} else {
+		q.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
@@ -0,0 +1,63 @@
+package graphapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+)
+
+type testRouteMap []*mapper.RouteOption
+
+func (r testRouteMap) Traversing(src, dst string) []*mapper.RouteOption {
+	ret := make([]*mapper.RouteOption, 0)
+	for _, o := range r {
+		if o.Traverses(src, dst) {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+func TestQueries(t *testing.T) {
+	g := graph.Create()
+	defer g.Stop()
+	g.IncrRoute([]string{"1", "2", "3"}, nil)
+	rm := testRouteMap{{Src: "a:1", Dst: "b:1", Path: []string{"1", "2", "3"}}}
+	mux := http.NewServeMux()
+	NewQueries(g, rm).Register(mux, "/v1/graph")
+
+	get := func(url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("Unable to unmarshal %s: %v", url, err)
+			}
+		}
+		return w.Code
+	}
+
+	var path []string
+	if code := get("/v1/graph/paths?src=1&dst=3", &path); code != http.StatusOK || len(path) != 3 {
+		t.Errorf("Expected the path 1 -> 3, got %d %v", code, path)
+	}
+	var paths [][]string
+	if code := get("/v1/graph/paths?src=1&dst=3&all=true&limit=1000000000", &paths); code != http.StatusOK || len(paths) != 1 {
+		t.Errorf("Expected the one path 1 -> 3, got %d %v", code, paths)
+	}
+	if code := get("/v1/graph/paths?src=3&dst=1", &path); code != http.StatusNotFound {
+		t.Errorf("Expected no path 3 -> 1, got %d", code)
+	}
+	if code := get("/v1/graph/neighbors?node=4", nil); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown node, got %d", code)
+	}
+
+	var pairs []mapper.PeerPair
+	if code := get("/v1/graph/dependents?src=1&dst=2", &pairs); code != http.StatusOK || len(pairs) != 1 {
+		t.Errorf("Expected one pair over 1 -> 2, got %d %v", code, pairs)
+	}
+}
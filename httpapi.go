@@ -2,34 +2,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/eventstream"
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graphapi"
 	"github.com/jacksontj/dnms/mapper"
-	"github.com/jacksontj/eventsource"
 )
 
 type HTTPApi struct {
 	m *mapper.Mapper
+	l *fault.Locator
+	c *Coordinates
 
-	eventBroker *eventsource.Server
+	events  *eventstream.Server
+	queries *graphapi.Queries
 }
 
-func NewHTTPApi(m *mapper.Mapper) *HTTPApi {
+func NewHTTPApi(m *mapper.Mapper, l *fault.Locator, c *Coordinates) *HTTPApi {
 	api := &HTTPApi{
-		m:           m,
-		eventBroker: eventsource.NewServer(),
+		m:       m,
+		l:       l,
+		c:       c,
+		events:  eventstream.NewServer(m.Graph, m.RouteMap, l),
+		queries: graphapi.NewQueries(m.Graph, m),
 	}
 
 	// TODO: config
-	api.eventBroker.AllowCORS = true
+	api.events.AllowCORS = true
 
 	return api
 }
 
-func (h *HTTPApi) Start(mux *http.ServeMux) {
+// Register our endpoints on `mux` and start streaming events, until `ctx` is
+// done
+func (h *HTTPApi) Start(ctx context.Context, mux *http.ServeMux) {
 	// TODO: think more about the namespacing of this API. Most thing belong to "mapper"
 	// but probably want to separate by "topology" "routing" or something like that
 
@@ -38,34 +49,32 @@ func (h *HTTPApi) Start(mux *http.ServeMux) {
 	mux.HandleFunc("/v1/graph/nodes", h.showNodes)
 	mux.HandleFunc("/v1/graph/edges", h.showEdges)
 	mux.HandleFunc("/v1/graph/routes", h.showRoutes)
+	mux.HandleFunc("/v1/graph/roundtrips", h.showRoundTrips)
+	// queries, so we don't need the whole graph to find out what uses a node
+	h.queries.Register(mux, "/v1/graph")
+	// how the graph's event subscribers are keeping up
+	mux.HandleFunc("/v1/graph/subscribers", h.showSubscribers)
 
 	// Mapper endpoints
 	// all of our peers
 	mux.HandleFunc("/v1/mapper/peers", h.showPeers)
 	// routemap endpoints
 	mux.HandleFunc("/v1/mapper/routemap", h.showRouteMap)
+	// how far along mapping is
+	mux.HandleFunc("/v1/mapper/progress", h.showProgress)
+
+	// Fault endpoints
+	mux.HandleFunc("/v1/faults", h.showFaults)
+
+	// network coordinates, and the RTTs they estimate
+	mux.HandleFunc("/v1/coordinates", h.showCoordinates)
 
 	// events endpoint
-	mux.HandleFunc("/v1/events/graph", h.eventStreamGraph)
-	// Create event listener to pull events from mapper and push into eventBroker
+	mux.Handle("/v1/events/graph", h.events)
+	// disconnect everyone streaming events once we are done
 	go func() {
-		for {
-			// TODO: configurable buffer size?
-			c := make(chan *graph.Event, 100)
-			// subscriber
-			h.m.Graph.Subscribe(c)
-
-			for {
-				event, closed := <-c
-				// TODO: something to catch up? we'll have dropped events at least :/
-				if !closed {
-					logrus.Infof("Graph subscriber channel was closed, we might drop some messages")
-					break
-				}
-				h.eventBroker.Publish([]string{"mapper"}, event)
-			}
-		}
-
+		<-ctx.Done()
+		h.events.Close()
 	}()
 }
 
@@ -115,6 +124,26 @@ func (h *HTTPApi) showRoutes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *HTTPApi) showRoundTrips(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.m.Graph.RoundTrips())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Graph.RoundTrips: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+func (h *HTTPApi) showSubscribers(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.m.Graph.Subscriptions())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Graph.Subscriptions: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
 func (h *HTTPApi) showPeers(w http.ResponseWriter, r *http.Request) {
 	peers := make([]*mapper.Peer, 0)
 	for peer := range h.m.IterPeers() {
@@ -139,30 +168,59 @@ func (h *HTTPApi) showRouteMap(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// TODO: have an event stream per API endpoint?
-func (h *HTTPApi) eventStreamGraph(w http.ResponseWriter, r *http.Request) {
-	graphC := h.m.Graph.EventDumpChannel()
-	preloadChannel := make(chan eventsource.Event, 0)
+func (h *HTTPApi) showProgress(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.m.Scheduler.Progress())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Progress: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
+
+func (h *HTTPApi) showFaults(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(h.l.Faults())
+	if err != nil {
+		logrus.Errorf("Unable to marshal Faults: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
+}
 
-	// goroutine to Convert graph.Event to eventsource.Event
-	go func() {
-		for {
-			e, ok := <-graphC
-			if !ok {
-				break
-			}
-			preloadChannel <- e
-		}
-		close(preloadChannel)
-	}()
-	handler := h.eventBroker.Handler("mapper", preloadChannel)
-	handler(w, r)
+type rttEstimate struct {
+	Src string        `json:"src"`
+	Dst string        `json:"dst"`
+	RTT time.Duration `json:"rtt"`
 }
 
-func httpAPI(m *mapper.Mapper) {
-	// Create helpful HTTP endpoint for debugging
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// All the coordinates we know, or the estimated RTT between ?src= and ?dst=
+// (either defaults to us)
+func (h *HTTPApi) showCoordinates(w http.ResponseWriter, r *http.Request) {
+	var v interface{}
+	src, dst := r.URL.Query().Get("src"), r.URL.Query().Get("dst")
+	if src == "" && dst == "" {
+		v = h.c.Status()
+	} else {
+		if src == "" {
+			src = h.c.Name
+		}
+		if dst == "" {
+			dst = h.c.Name
+		}
+		rtt, err := h.c.EstimateRTT(src, dst)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		v = rttEstimate{Src: src, Dst: dst, RTT: rtt}
+	}
 
-	})
-	go http.ListenAndServe(":12345", nil)
+	ret, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("Unable to marshal Coordinates: %v", err)
+	} else {
+		h.setCommonHeaders(w)
+		w.Write(ret)
+	}
 }
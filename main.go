@@ -1,34 +1,73 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jacksontj/dnms/aggregator"
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
 	"github.com/jacksontj/dnms/mapper"
+	"github.com/jacksontj/dnms/metrics"
 	"github.com/jacksontj/memberlist"
 )
 
+// How long we give memberlist and the HTTP server to shut down cleanly
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	// Some CLI args for better testing
 
+	configPath := flag.String("config", "", "path to config file")
 	advertiseStr := flag.String("gossipAddr", "", "address to advertise gossip on")
 	peerStr := flag.String("peer", "", "address to gossip with")
 	aggNode := flag.Bool("aggregator", false, "are you an aggregator node?")
+	superAggNode := flag.Bool("superAggregator", false, "are you a super aggregator node?")
 
 	flag.Parse()
 
-	// #TODO: load from a config file
+	config := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			logrus.Fatalf("Unable to load config: %v", err)
+		}
+	}
+
+	// Flags that are explicitly set override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "gossipAddr":
+			config.Memberlist.AdvertiseAddr = *advertiseStr
+		case "peer":
+			config.Memberlist.Peers = []string{*peerStr}
+		case "aggregator":
+			config.Aggregator.Enabled = *aggNode
+		case "superAggregator":
+			config.SuperAggregator.Enabled = *superAggNode
+		}
+	})
+
+	if err := config.Validate(); err != nil {
+		logrus.Fatalf("Invalid config: %v", err)
+	}
+
 	cfg := memberlist.DefaultLANConfig()
 
-	// TODO: load from config
-	cfg.BindPort = 33434
-	cfg.AdvertisePort = 33434
-	if *advertiseStr != "" {
-		cfg.AdvertiseAddr = *advertiseStr
+	cfg.BindPort = config.Memberlist.BindPort
+	cfg.AdvertisePort = config.Memberlist.BindPort
+	if config.Memberlist.AdvertiseAddr != "" {
+		cfg.AdvertiseAddr = config.Memberlist.AdvertiseAddr
 	} else {
 		i, err := GetLocalIP()
 		if err != nil {
@@ -38,31 +77,105 @@ func main() {
 	}
 	logrus.Infof("AdvertiseAddr: %v", cfg.AdvertiseAddr)
 
+	// everything runs until this is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+
 	// Start the mapper (at this point no peers-- so it will do nothing)
-	m := mapper.NewMapper(cfg.AdvertiseAddr)
-	m.Start()
+	// super aggregators don't probe, so their graph just stays empty
+	m := mapper.NewMapper(cfg.AdvertiseAddr, config.Mapper, graph.CreateWithConfig(config.Graph))
+	if !config.SuperAggregator.Enabled {
+		m.Start(ctx)
+	}
+
+	// Start looking for faults in the graph the mapper builds
+	l := fault.NewLocator(m.Graph, config.Faults)
+	l.Start(ctx)
+
+	// our network coordinate, updated by the pinger and gossiped through
+	// memberlist
+	coords, err := NewCoordinates(cfg.AdvertiseAddr, config.Coordinates)
+	if err != nil {
+		logrus.Fatalf("Unable to create coordinates: %v", err)
+	}
 
 	// TODO pass additional config
 	// Start HTTP APIs
 	mux := http.NewServeMux()
-	api := NewHTTPApi(m)
-	api.Start(mux)
+	api := NewHTTPApi(m, l, coords)
+	api.Start(ctx, mux)
+
+	// Prometheus metrics for everything we run
+	exporter := metrics.NewExporter()
+	mux.Handle("/metrics", exporter)
+	if !config.SuperAggregator.Enabled {
+		exporter.Register(metrics.NewGraphCollector("local", m.Graph, config.Metrics))
+		exporter.Register(metrics.NewLocatorCollector("local", l))
+		exporter.Register(metrics.NewMapperCollector(m, config.Metrics))
+	}
 
 	// If we are an aggregator start that
+	_, httpPort, _ := net.SplitHostPort(config.HTTP.Addr)
+	localPushURL := "http://127.0.0.1:" + httpPort + "/v1/aggregator/push"
 	var aggMap *aggregator.AggGraphMap
-	if *aggNode {
-		aggMap = aggregator.NewAggGraphMap()
+	if config.Aggregator.Enabled {
+		aggMap = aggregator.NewAggGraphMap(cfg.AdvertiseAddr, &config.Aggregator.Config, config.Graph, config.Faults)
 		api := aggregator.NewHTTPApi(aggMap)
-		api.Start(mux)
+		api.Start(ctx, mux)
+		exporter.Register(metrics.NewAggregatorCollector("aggregator", aggMap, config.Metrics))
+		// we don't get a join event for ourself, so add ourself to the ring
+		aggMap.AddAggregator(cfg.AdvertiseAddr, config.Aggregator.Weight)
 		// TODO: through something better than http, it is local after all
-		// subscribe to ourself
-		aggMap.AddPeer("127.0.0.1")
+		if config.Aggregator.Push {
+			// push to ourself (if sharding, only when we own ourself)
+			if !config.Push.Shard {
+				config.Push.Aggregators = append(config.Push.Aggregators, "127.0.0.1:"+httpPort)
+			}
+		} else {
+			// subscribe to ourself
+			aggMap.AddPeer("127.0.0.1", "")
+		}
+	}
+
+	// push our graph to the aggregators
+	pushers := make([]*aggregator.Pusher, 0, len(config.Push.Aggregators))
+	for _, addr := range config.Push.Aggregators {
+		pusher := aggregator.NewPusher(cfg.AdvertiseAddr, "http://"+addr+"/v1/aggregator/push", m.Graph, m.RouteMap)
+		pusher.Start()
+		pushers = append(pushers, pusher)
+	}
+	// If we are a super aggregator, aggregate all the aggregators. They'll
+	// be added as they join
+	var superMap *aggregator.AggGraphMap
+	if config.SuperAggregator.Enabled {
+		superMap = aggregator.NewSuperAggGraphMap(cfg.AdvertiseAddr, &config.Aggregator.Config, config.Graph, config.Faults)
+		api := aggregator.NewHTTPApi(superMap)
+		api.Start(ctx, mux)
+		exporter.Register(metrics.NewAggregatorCollector("super", superMap, config.Metrics))
+	}
+
+	var shardPusher *aggregator.ShardedPusher
+	if config.Push.Shard {
+		shardPusher = aggregator.NewShardedPusher(cfg.AdvertiseAddr, m.Graph, m.RouteMap, config.Aggregator.HandoffDelay)
+		if config.Aggregator.Enabled {
+			shardPusher.AddAggregator(cfg.AdvertiseAddr, localPushURL, config.Aggregator.Weight)
+		}
 	}
 
-	go http.ListenAndServe(":12345", mux)
+	server := &http.Server{Addr: config.HTTP.Addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Fatalf("Unable to serve HTTP: %v", err)
+		}
+	}()
 
 	// Wire up the delegate-- he'll handle pings and node up/down events
 	delegate := NewDNMSDelegate(m, aggMap)
+	delegate.Pusher = shardPusher
+	delegate.SuperMap = superMap
+	delegate.Coords = coords
+	if err := delegate.SetMeta(localMeta(config)); err != nil {
+		logrus.Fatalf("Unable to encode NodeMeta: %v", err)
+	}
 	cfg.Delegate = delegate
 	cfg.Events = delegate
 
@@ -76,27 +189,112 @@ func main() {
 	// TODO: background thing to join if we end up alone?
 	// or if people disconnect
 	// Join if we can
-	mlist.Join([]string{*peerStr})
+	mlist.Join(config.Memberlist.Peers)
 
 	// start the pinger
-	p := Pinger{
-		M: m,
-		Self: mapper.Peer{
+	var echo *TCPEchoServer
+	var p *Pinger
+	if !config.SuperAggregator.Enabled {
+		// answer TCP pings from others
+		if config.Pinger.TCPPort != 0 {
+			echo = &TCPEchoServer{
+				Addr:    ":" + strconv.Itoa(config.Pinger.TCPPort),
+				Timeout: config.Pinger.Timeout,
+			}
+			if err := echo.Start(); err != nil {
+				logrus.Fatalf("Unable to start TCP echo server: %v", err)
+			}
+		}
+		p = NewPinger(m, mapper.Peer{
 			Name: mlist.LocalNode().Addr.String(),
 			Port: int(mlist.LocalNode().Port),
-		},
+		}, config.Pinger)
+		p.Coords = coords
+		p.Start(ctx)
+		exporter.Register(p)
 	}
-	p.Start()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 
 	// print state of the world for ease of debugging
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second)
-		logrus.Infof("peers=%d nodes=%d links=%d routes=%d",
-			mlist.NumMembers()-1,
-			m.Graph.GetNodeCount(),
-			m.Graph.GetLinkCount(),
-			m.Graph.GetRouteCount(),
-		)
+		select {
+		case <-ticker.C:
+			logrus.Infof("peers=%d nodes=%d links=%d routes=%d",
+				mlist.NumMembers()-1,
+				m.Graph.GetNodeCount(),
+				m.Graph.GetLinkCount(),
+				m.Graph.GetRouteCount(),
+			)
+		case sig := <-sigChan:
+			logrus.Infof("Got %v, shutting down", sig)
+
+			// Leave first, so the rest of the cluster hears we left instead of
+			// suspecting us once we stop answering
+			if err := mlist.Leave(shutdownTimeout); err != nil {
+				logrus.Errorf("Unable to leave the cluster: %v", err)
+			}
+			if err := mlist.Shutdown(); err != nil {
+				logrus.Errorf("Unable to shutdown memberlist: %v", err)
+			}
+
+			// stop probing
+			if p != nil {
+				p.Stop()
+			}
+			if echo != nil {
+				echo.Stop()
+			}
+			m.Stop()
+
+			// stop pushing, and disconnect everyone streaming from us
+			for _, pusher := range pushers {
+				pusher.Stop()
+			}
+			if shardPusher != nil {
+				shardPusher.Stop()
+			}
+			cancel()
+			// drops the push connections of our peers
+			if aggMap != nil {
+				aggMap.Stop()
+			}
+			if superMap != nil {
+				superMap.Stop()
+			}
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				logrus.Errorf("Unable to shutdown HTTP server: %v", err)
+			}
+			shutdownCancel()
+
+			m.Graph.Stop()
+			return
+		}
 	}
+}
 
+// What we tell the rest of the cluster about ourselves
+func localMeta(config *Config) *NodeMeta {
+	meta := &NodeMeta{
+		Role:    ProberRole,
+		Version: Version,
+		Labels:  config.Labels,
+	}
+	if config.Aggregator.Enabled {
+		meta.Role = AggregatorRole
+		meta.Weight = config.Aggregator.Weight
+	}
+	if config.SuperAggregator.Enabled {
+		meta.Role = SuperAggregatorRole
+	} else {
+		meta.TCPPingPort = config.Pinger.TCPPort
+	}
+	host, port, _ := net.SplitHostPort(config.HTTP.Addr)
+	meta.HTTPAddr = host
+	meta.HTTPPort, _ = strconv.Atoi(port)
+	return meta
 }
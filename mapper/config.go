@@ -0,0 +1,155 @@
+package mapper
+
+import (
+	"fmt"
+	"time"
+)
+
+type Config struct {
+	// source ports to map from [SrcPortStart, SrcPortEnd)
+	SrcPortStart int `yaml:"src_port_start"`
+	SrcPortEnd   int `yaml:"src_port_end"`
+
+	// traceroute options
+	MaxTTL       int           `yaml:"max_ttl"`
+	ProbeTimeout time.Duration `yaml:"probe_timeout"`
+	ProbeCount   int           `yaml:"probe_count"`
+
+	// how we traceroute each peer
+	Probes []ProbeConfig `yaml:"probes"`
+
+	// how long each worker waits after mapping a peer
+	Interval time.Duration `yaml:"interval"`
+	// number of traceroutes to run at once
+	Workers int `yaml:"workers"`
+	// budget for all the traceroutes, 0 is unlimited
+	PacketsPerSecond float64 `yaml:"packets_per_second"`
+	// random delay (up to this) before each traceroute, to spread them out
+	Jitter time.Duration `yaml:"jitter"`
+
+	// only map peers which advertise all of these labels
+	PeerLabels map[string]string `yaml:"peer_labels"`
+
+	// keep us and the peer at the ends of the routes, instead of only the
+	// network in the middle
+	KeepEndpoints bool `yaml:"keep_endpoints"`
+
+	// routes which are up but no traceroute has found for this long (the path
+	// moved) are dropped, 0 keeps them until their peer leaves
+	RouteTTL time.Duration `yaml:"route_ttl"`
+
+	// snapshots of what we've mapped, so we are useful right after a restart
+	State StateConfig `yaml:"state"`
+}
+
+type StateConfig struct {
+	// file to keep the snapshot in, no snapshots if empty
+	Path string `yaml:"path"`
+	// how often we write the snapshot
+	Interval time.Duration `yaml:"interval"`
+	// snapshots older than this are ignored. Restored routes to peers which
+	// haven't (re)joined by then are dropped
+	TTL time.Duration `yaml:"ttl"`
+	// if the snapshot is older than this the routes' metrics are too, so we
+	// restore the routes without them
+	MetricTTL time.Duration `yaml:"metric_ttl"`
+}
+
+type ProbeConfig struct {
+	// udp, tcp or icmp
+	Protocol string `yaml:"protocol"`
+	// destination ports to map, if empty we use the peer's (memberlist) port.
+	// Ports don't mean anything for icmp
+	DstPorts []int `yaml:"dst_ports"`
+}
+
+// The destination ports to map `p` on
+func (c *ProbeConfig) ports(p *Peer) []int {
+	if c.Protocol == ICMPProbe {
+		return []int{0}
+	}
+	if len(c.DstPorts) == 0 {
+		return []int{p.Port}
+	}
+	return c.DstPorts
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		SrcPortStart: 33435,
+		SrcPortEnd:   33445,
+		MaxTTL:       30,
+		ProbeTimeout: time.Second,
+		ProbeCount:   1,
+		Probes: []ProbeConfig{
+			{Protocol: UDPProbe},
+		},
+		Interval:         time.Second,
+		Workers:          4,
+		PacketsPerSecond: 200,
+		Jitter:           time.Millisecond * 500,
+		State: StateConfig{
+			Interval:  time.Minute,
+			TTL:       time.Hour,
+			MetricTTL: 5 * time.Minute,
+		},
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.SrcPortStart <= 0 || c.SrcPortStart > 65535 {
+		return fmt.Errorf("src_port_start must be a valid port, got %d", c.SrcPortStart)
+	}
+	if c.SrcPortEnd <= c.SrcPortStart || c.SrcPortEnd > 65536 {
+		return fmt.Errorf("src_port_end must be between src_port_start (%d) and 65536, got %d", c.SrcPortStart, c.SrcPortEnd)
+	}
+	if c.MaxTTL <= 0 || c.MaxTTL > 255 {
+		return fmt.Errorf("max_ttl must be between 1 and 255, got %d", c.MaxTTL)
+	}
+	if c.ProbeTimeout <= 0 {
+		return fmt.Errorf("probe_timeout must be > 0, got %v", c.ProbeTimeout)
+	}
+	if c.ProbeCount <= 0 {
+		return fmt.Errorf("probe_count must be > 0, got %d", c.ProbeCount)
+	}
+	if len(c.Probes) == 0 {
+		return fmt.Errorf("probes must have at least one probe")
+	}
+	for i, probe := range c.Probes {
+		if !validProbe(probe.Protocol) {
+			return fmt.Errorf("probes[%d].protocol must be udp, tcp or icmp, got %q", i, probe.Protocol)
+		}
+		for _, port := range probe.DstPorts {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("probes[%d].dst_ports must be valid ports, got %d", i, port)
+			}
+		}
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must be >= 0, got %v", c.Interval)
+	}
+	if c.Workers <= 0 {
+		return fmt.Errorf("workers must be > 0, got %d", c.Workers)
+	}
+	if c.PacketsPerSecond < 0 {
+		return fmt.Errorf("packets_per_second must be >= 0, got %v", c.PacketsPerSecond)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("jitter must be >= 0, got %v", c.Jitter)
+	}
+	if c.RouteTTL < 0 {
+		return fmt.Errorf("route_ttl must be >= 0, got %v", c.RouteTTL)
+	}
+	if c.State.Path != "" {
+		if c.State.Interval <= 0 {
+			return fmt.Errorf("state.interval must be > 0, got %v", c.State.Interval)
+		}
+		if c.State.TTL <= 0 {
+			return fmt.Errorf("state.ttl must be > 0, got %v", c.State.TTL)
+		}
+		if c.State.MetricTTL < 0 || c.State.MetricTTL > c.State.TTL {
+			return fmt.Errorf("state.metric_ttl must be between 0 and state.ttl (%v), got %v", c.State.TTL, c.State.MetricTTL)
+		}
+	}
+	return nil
+}
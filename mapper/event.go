@@ -0,0 +1,115 @@
+package mapper
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RouteOption is a single entry of the RouteMap: the route that packets from
+// Src to Dst take. This is what we send to aggregators, so they can answer
+// "which routes does A->B use" for the whole cluster
+type RouteOption struct {
+	// see RouteKey
+	Key string `json:"key"`
+	// name:port
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+	// protocol the route was discovered with
+	Protocol string `json:"protocol"`
+	// key of the route in the graph, and its hops
+	Route string   `json:"route"`
+	Path  []string `json:"path"`
+}
+
+// SrcName is the name of the source node, without the port
+func (o *RouteOption) SrcName() string {
+	return hostOf(o.Src)
+}
+
+// DstName is the name of the destination node, without the port
+func (o *RouteOption) DstName() string {
+	return hostOf(o.Dst)
+}
+
+// Whether the route goes over the link src -> dst
+func (o *RouteOption) Traverses(src, dst string) bool {
+	for i := 0; i+1 < len(o.Path); i++ {
+		if o.Path[i] == src && o.Path[i+1] == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// A pair of peers, by name
+type PeerPair struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+type peerPairs []PeerPair
+
+func (p peerPairs) Len() int      { return len(p) }
+func (p peerPairs) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p peerPairs) Less(i, j int) bool {
+	if p[i].Src != p[j].Src {
+		return p[i].Src < p[j].Src
+	}
+	return p[i].Dst < p[j].Dst
+}
+
+// The distinct pairs of peers `options` are between
+func PeerPairs(options []*RouteOption) []PeerPair {
+	seen := make(map[PeerPair]bool)
+	ret := make(peerPairs, 0)
+	for _, o := range options {
+		pair := PeerPair{Src: o.SrcName(), Dst: o.DstName()}
+		if !seen[pair] {
+			seen[pair] = true
+			ret = append(ret, pair)
+		}
+	}
+	sort.Sort(ret)
+	return ret
+}
+
+type EventType uint8
+
+const (
+	// add or replace a route option
+	AddEvent EventType = iota
+	RemoveEvent
+)
+
+// Event is fired whenever the RouteMap changes. It implements
+// eventsource.Event so it can be sent down the same streams as graph events
+type Event struct {
+	E    EventType
+	Item *RouteOption
+}
+
+func (e Event) Id() string {
+	return ""
+}
+
+func (e Event) Event() string {
+	switch e.E {
+	case AddEvent:
+		return "addRouteOptionEvent"
+	case RemoveEvent:
+		return "removeRouteOptionEvent"
+	}
+	logrus.Warning("Unknown event type!")
+	return "unknown"
+}
+
+func (e Event) Data() string {
+	ret, err := json.Marshal(e.Item)
+	if err != nil {
+		logrus.Warningf("Unable to marshal event: %v", err)
+		return ""
+	}
+	return string(ret)
+}
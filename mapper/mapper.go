@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"context"
 	"net"
 	"strconv"
 	"sync"
@@ -15,6 +16,10 @@ import (
 type Peer struct {
 	Name string
 	Port int
+	// port of the peer's TCP echo server, 0 if it doesn't have one
+	TCPPort int
+	// labels the peer advertised (datacenter, rack, etc.)
+	Labels map[string]string
 	// TODO: addr etc.
 }
 
@@ -26,30 +31,61 @@ func (p *Peer) String() string {
 // a configured interval
 type Mapper struct {
 	localName string
+	config    *Config
 	// locking around peers is important-- as there are background jobs mapping
 	// and we don't want them adding nodes back after we remove them
 	// TODO: more scoped lock? or goroutine?
 	peerMap  map[string]*Peer
 	peerLock *sync.RWMutex
 
+	// traceroutes run in parallel, but updating the routes (which can replace
+	// the routes of other route options) is done one at a time
+	updateLock *sync.Mutex
+
 	// graph of the network
 	Graph *graph.NetworkGraph
 	// map of how to send a packet on each route
 	RouteMap *RouteMap
+
+	// runs all the traceroutes
+	Scheduler *Scheduler
+	// shared with the pinger, which pings from the same ports
+	SourcePorts *SourcePorts
+
+	// cancelled when we stop, so in-flight traceroutes don't update anything
+	ctx    context.Context
+	cancel context.CancelFunc
+	// background jobs which aren't the scheduler's
+	wg *sync.WaitGroup
 }
 
-func NewMapper(n string) *Mapper {
+func NewMapper(n string, cfg *Config, g *graph.NetworkGraph) *Mapper {
 	m := &Mapper{
 		localName: n,
+		config:    cfg,
 		peerMap:   make(map[string]*Peer),
-		Graph:     graph.Create(),
+		Graph:     g,
 		RouteMap:  NewRouteMap(),
 		peerLock:  &sync.RWMutex{},
+
+		SourcePorts: NewSourcePorts(),
+
+		updateLock: &sync.Mutex{},
+
+		ctx:    context.Background(),
+		cancel: func() {},
+		wg:     &sync.WaitGroup{},
 	}
+	m.Scheduler = NewScheduler(m)
+	g.SetPeer(n, true)
 
 	return m
 }
 
+func (m *Mapper) Config() *Config {
+	return m.config
+}
+
 func (m *Mapper) AddPeer(p Peer) {
 	logrus.Infof("add peer: %v", p)
 	m.peerLock.Lock()
@@ -60,9 +96,31 @@ func (m *Mapper) AddPeer(p Peer) {
 		return
 	} else {
 		m.peerMap[p.Name] = &p
+		m.Graph.SetPeer(p.Name, true)
 	}
 }
 
+// Whether we should be mapping the given peer, based on the configured PeerLabels
+func (m *Mapper) Selects(p Peer) bool {
+	for k, v := range m.config.PeerLabels {
+		if p.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Update the information we have about an existing peer
+func (m *Mapper) UpdatePeer(p Peer) {
+	m.peerLock.Lock()
+	defer m.peerLock.Unlock()
+	if _, ok := m.peerMap[p.Name]; !ok {
+		logrus.Warningf("Mapper asked to update peer that doesn't exists: %v", p)
+		return
+	}
+	m.peerMap[p.Name] = &p
+}
+
 func (m *Mapper) RemovePeer(p Peer) {
 	m.peerLock.Lock()
 	defer m.peerLock.Unlock()
@@ -78,11 +136,46 @@ func (m *Mapper) RemovePeer(p Peer) {
 		}
 		// delete the peer
 		delete(m.peerMap, p.Name)
+		m.Graph.SetPeer(p.Name, false)
 	} else {
 		logrus.Warning("Mapper asked to remove peer that doesn't exists: %v", p)
 	}
 }
 
+func (m *Mapper) NumPeers() int {
+	m.peerLock.RLock()
+	defer m.peerLock.RUnlock()
+	return len(m.peerMap)
+}
+
+func (m *Mapper) getPeer(name string) *Peer {
+	m.peerLock.RLock()
+	defer m.peerLock.RUnlock()
+	p, _ := m.peerMap[name]
+	return p
+}
+
+// The path of our route back to the peer `name`, for the acks to pings which
+// reached us over `path`. We can't know which of our routes the acks take, so
+// we only say if one of them is `path` in reverse-- otherwise nil
+func (m *Mapper) ReversePath(name string, path []string) []string {
+	p := m.getPeer(name)
+	if p == nil {
+		return nil
+	}
+	for _, route := range m.RouteMap.RoutesTo(p.String()) {
+		if route.SamePathReverse(path) {
+			return route.Hops()
+		}
+	}
+	return nil
+}
+
+// The route options whose routes go over the link `src` -> `dst`
+func (m *Mapper) Traversing(src, dst string) []*RouteOption {
+	return m.RouteMap.OptionsFor(m.Graph.RoutesThroughLink(src, dst))
+}
+
 // TODO: randomize shuffle (since this is used for mapping and pinging
 // TODO: better, since this will be concurrent
 func (m *Mapper) IterPeers() chan *Peer {
@@ -112,39 +205,39 @@ func (m *Mapper) IterPeers() chan *Peer {
 	return peerChan
 }
 
-// Start the mapping
-func (m *Mapper) Start() {
-	go m.mapPeers()
+// Start the mapping, until `ctx` is done or we are stopped
+func (m *Mapper) Start(ctx context.Context) {
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	// load what we knew before we start mapping over it
+	if m.config.State.Path != "" {
+		m.persist(m.ctx)
+	}
+	if m.config.RouteTTL > 0 {
+		m.goRun(func() { m.sweepRoutes(m.ctx) })
+	}
+	m.Scheduler.Start(m.ctx)
 }
 
-// TODO implement stopping
+// Stop mapping, and wait for the scheduler to finish. Traceroutes which are
+// still running are abandoned rather than stopped (the traceroute library has
+// no way to cancel them), so their packets and sockets stay around until they
+// time out on their own
 func (m *Mapper) Stop() {
-
+	m.cancel()
+	m.Scheduler.Wait()
+	m.wg.Wait()
 }
 
-// TODO: parallelize the individual peer mapping
-// Target for background goroutine responsible for doing the actual mapping
-// We specifically map all peers on a given port to effectively get breadth first
-// instead of depth first mapping
-func (m *Mapper) mapPeers() {
-	for {
-		// TODO: config
-		srcPortStart := 33435
-		srcPortEnd := 33445
-
-		for srcPort := srcPortStart; srcPort < srcPortEnd; srcPort++ {
-			peerChan := m.IterPeers()
-			for peer := range peerChan {
-				m.mapPeer(peer, srcPort)
-				// TODO configurable rate
-				time.Sleep(time.Second)
-			}
-		}
-	}
+func (m *Mapper) goRun(f func()) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
 }
 
-// Map a single peer on a single source port
-func (m *Mapper) mapPeer(p *Peer, srcPort int) {
+// Map a single peer with the protocol and ports of `k`
+func (m *Mapper) mapPeer(p *Peer, k RouteKey) {
 
 	srcIP, err := traceroute.GetLocalIP()
 	if err != nil {
@@ -153,32 +246,39 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 	}
 	tracerouteOpts := &traceroute.TracerouteOptions{
 		SourceAddr: srcIP,
-		SourcePort: srcPort,
+		SourcePort: k.SrcPort,
 
 		DestinationAddr: net.ParseIP(p.Name),
-		DestinationPort: p.Port,
+		DestinationPort: k.DstPort,
 
 		// enumerated value of tcp/udp/icmp
-		ProbeType: traceroute.UdpProbe,
+		ProbeType: probeType(k.Protocol),
 
 		// TTL options
 		StartingTTL: 1,
-		MaxTTL:      30,
+		MaxTTL:      m.config.MaxTTL,
 
 		// Probe options
-		ProbeTimeout: time.Second,
-		ProbeCount:   1,
+		ProbeTimeout: m.config.ProbeTimeout,
+		ProbeCount:   m.config.ProbeCount,
 	}
 
-	result, err := traceroute.Traceroute(tracerouteOpts)
+	// icmp doesn't have ports
+	release := func() {}
+	if k.SrcPort != 0 {
+		release = m.SourcePorts.Reserve(k.SrcPort)
+	}
+	result, err := m.traceroute(tracerouteOpts, release)
 	if err != nil {
 		logrus.Infof("Traceroute err: %v", err)
 		return
 	}
 
-	logrus.Infof("Traceroute %d -> %s: complete", srcPort, p.Name)
+	logrus.Infof("Traceroute %s: complete", k)
 
 	path := make([]string, 0, len(result.Hops))
+	// latency to each hop in `path`
+	latencies := make([]int64, 0, len(result.Hops))
 
 	for _, hop := range result.Hops {
 		// if there was no address in the response, lets just keep track of it
@@ -188,20 +288,47 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 		} else {
 			path = append(path, hop.Responses[0].Address.String())
 		}
+		latencies = append(latencies, hop.Responses[0].ElapsedTime.Nanoseconds())
 	}
 
-	// strip out first and last-- this makes the graph more connected, since we
-	// aren't really interested in mapping peers-- so much as the network in the
-	// middle. We don't lose data, because the RouteMap	keeps track of which peers
-	// send down which routes
-	// TLDR; the goal is to not have a peer in a `path`
-	path = path[:len(path)-1]
+	if m.config.KeepEndpoints {
+		// the traceroute doesn't include us, and only ends with the peer if we
+		// got that far. If we didn't, we don't know what is in between
+		path = append([]string{m.localName}, path...)
+		latencies = append([]int64{0}, latencies...)
+		if path[len(path)-1] != p.Name {
+			path = append(path, graph.UNKNOWN_PATH)
+			latencies = append(latencies, 0)
+		}
+	} else {
+		// strip out first and last-- this makes the graph more connected, since we
+		// aren't really interested in mapping peers-- so much as the network in the
+		// middle. We don't lose data, because the RouteMap	keeps track of which peers
+		// send down which routes
+		// TLDR; the goal is to not have a peer in a `path`
+		path = path[:len(path)-1]
+	}
 
 	// Next, fill "*"s with keys to placehold
 	graph.FillPath(path)
 	logrus.Debugf("traceroute path: %v", path)
 
-	currRoute := m.RouteMap.GetRouteOption(m.localName, srcPort, p.Name, p.Port)
+	// Whatever happens to the route, the hops' latencies are still useful for
+	// the links in the path
+	defer m.Graph.RecordHopLatencies(path, latencies)
+
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	// we were stopped while this was running
+	if m.ctx.Err() != nil {
+		return
+	}
+	currRoute := m.RouteMap.GetRouteOption(k)
+
+	// the route is still there
+	if currRoute != nil && currRoute.SamePath(path) {
+		currRoute.Touch()
+	}
 
 	// If we don't have a current route, or the paths differ-- lets update
 	if currRoute == nil || !currRoute.SamePath(path) {
@@ -218,6 +345,7 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 					// if the merged path is no different from the original path
 					// then there is no point in makind any changes
 					if currRoute.SamePath(mergedPath) {
+						currRoute.Touch()
 						return
 					}
 
@@ -225,7 +353,8 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 					// TODO: migrate/inherit the metrics
 					// Add new one
 					newRoute, _ := m.Graph.IncrRoute(mergedPath, nil)
-					m.RouteMap.UpdateRouteOption(m.localName, srcPort, p.String(), newRoute)
+					newRoute.Touch()
+					m.RouteMap.UpdateRouteOption(k, p.String(), newRoute)
 
 					// Remove old one if it exists
 					if currRoute != nil {
@@ -253,7 +382,8 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 
 			// Add new one
 			newRoute, _ := m.Graph.IncrRoute(path, nil)
-			m.RouteMap.UpdateRouteOption(m.localName, srcPort, p.String(), newRoute)
+			newRoute.Touch()
+			m.RouteMap.UpdateRouteOption(k, p.String(), newRoute)
 
 			// Remove old one if it exists
 			if currRoute != nil {
@@ -266,3 +396,59 @@ func (m *Mapper) mapPeer(p *Peer, srcPort int) {
 		}
 	}
 }
+
+// goroutine target to expire routes every so often
+func (m *Mapper) sweepRoutes(ctx context.Context) {
+	// TODO: config
+	ticker := time.NewTicker(m.config.RouteTTL / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.expireRoutes()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Drop the routes which haven't been confirmed by a traceroute within the
+// RouteTTL, along with the route options using them. Routes which aren't up
+// stay, a traceroute can't find a broken route and we still need it to say
+// what is broken
+func (m *Mapper) expireRoutes() {
+	deadline := time.Now().Add(-m.config.RouteTTL)
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	for _, route := range m.RouteMap.Routes() {
+		if route.LastSeen().After(deadline) || route.GetState() != graph.Up {
+			continue
+		}
+		logrus.Infof("Route expired, last seen %v: %v", route.LastSeen(), route.Hops())
+		for x := m.RouteMap.RemoveRoute(route); x > 0; x-- {
+			m.Graph.DecrRoute(route.Hops())
+		}
+	}
+}
+
+// Run a traceroute, giving up on it if we are stopped. The traceroute library
+// has no way to cancel, so it'll finish in the background-- and only then call
+// `release` to give up its source port
+func (m *Mapper) traceroute(opts *traceroute.TracerouteOptions, release func()) (*traceroute.TracerouteResult, error) {
+	type traceResult struct {
+		result *traceroute.TracerouteResult
+		err    error
+	}
+	c := make(chan traceResult, 1)
+	go func() {
+		result, err := traceroute.Traceroute(opts)
+		release()
+		c <- traceResult{result, err}
+	}()
+	select {
+	case r := <-c:
+		return r.result, r.err
+	case <-m.ctx.Done():
+		return nil, m.ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package mapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacksontj/dnms/graph"
+)
+
+func TestExpireRoutes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RouteTTL = 10 * time.Minute
+	m := NewMapper("10.0.0.1", cfg, graph.Create())
+	stale := []string{"10.0.0.1", "192.168.1.1"}
+	fresh := []string{"10.0.0.1", "192.168.1.2"}
+	for i, hops := range [][]string{stale, stale, fresh} {
+		route, _ := m.Graph.IncrRoute(hops, nil)
+		k := RouteKey{Protocol: UDPProbe, SrcName: "10.0.0.1", SrcPort: 33435 + i, DstName: "10.0.0.2", DstPort: 7946}
+		m.RouteMap.UpdateRouteOption(k, "10.0.0.2:7946", route)
+	}
+	m.Graph.GetRoute(stale).SetLastSeen(time.Now().Add(-2 * m.config.RouteTTL))
+
+	// a route which is down stays, the traceroutes can't find it
+	down := m.Graph.GetRoute(fresh)
+	down.SetLastSeen(time.Now().Add(-2 * m.config.RouteTTL))
+	down.SetState(graph.Down)
+
+	m.expireRoutes()
+	if m.Graph.GetRoute(stale) != nil {
+		t.Errorf("Expected the stale route to be removed")
+	}
+	if m.Graph.GetRoute(fresh) == nil {
+		t.Errorf("Expected the down route to stay")
+	}
+	if n := len(m.RouteMap.Options()); n != 1 {
+		t.Errorf("Expected 1 route option left, got %d", n)
+	}
+}
@@ -0,0 +1,60 @@
+package mapper
+
+import (
+	"sync"
+)
+
+// SourcePorts coordinates the traceroutes and pings using our source ports,
+// since pings have to go out from the port of the traceroute which found the
+// route. Any number of pings can share a port, but a traceroute needs it to
+// itself-- so whoever holds the port open is asked to close it first
+type SourcePorts struct {
+	lock  *sync.Mutex
+	ports map[int]*sync.RWMutex
+	// called once nobody is sharing a port, before a traceroute takes it
+	onReserve []func(port int)
+}
+
+func NewSourcePorts() *SourcePorts {
+	return &SourcePorts{
+		lock:  &sync.Mutex{},
+		ports: make(map[int]*sync.RWMutex),
+	}
+}
+
+func (s *SourcePorts) get(port int) (*sync.RWMutex, []func(int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.ports[port]
+	if !ok {
+		l = &sync.RWMutex{}
+		s.ports[port] = l
+	}
+	return l, s.onReserve
+}
+
+// Call `f` with the port before a traceroute takes it, so it can close
+// whatever it has open on it
+func (s *SourcePorts) OnReserve(f func(port int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onReserve = append(s.onReserve, f)
+}
+
+// Share `port` with everyone else sharing it, until the returned func is
+// called
+func (s *SourcePorts) Share(port int) func() {
+	l, _ := s.get(port)
+	l.RLock()
+	return l.RUnlock
+}
+
+// Take `port` to ourselves, until the returned func is called
+func (s *SourcePorts) Reserve(port int) func() {
+	l, callbacks := s.get(port)
+	l.Lock()
+	for _, f := range callbacks {
+		f(port)
+	}
+	return l.Unlock
+}
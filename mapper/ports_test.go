@@ -0,0 +1,37 @@
+package mapper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourcePorts(t *testing.T) {
+	s := NewSourcePorts()
+	closed := make(chan int, 1)
+	s.OnReserve(func(port int) { closed <- port })
+
+	// pings share a port
+	release := s.Share(33435)
+	s.Share(33435)()
+
+	// a traceroute waits for them, and then has whoever has it open close it
+	reserved := make(chan struct{})
+	go func() {
+		s.Reserve(33435)()
+		close(reserved)
+	}()
+	select {
+	case <-reserved:
+		t.Fatalf("Expected the traceroute to wait for the ping")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-reserved:
+	case <-time.After(time.Second):
+		t.Fatalf("Traceroute never got the port")
+	}
+	if port := <-closed; port != 33435 {
+		t.Errorf("Expected port 33435 to be closed, got %d", port)
+	}
+}
@@ -0,0 +1,50 @@
+package mapper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket, which holds up to a second worth of packets
+type RateLimiter struct {
+	// packets per second, 0 is unlimited
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   *sync.Mutex
+}
+
+func NewRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Wait until we can send `n` packets, returns an error if `ctx` is done first
+func (r *RateLimiter) Wait(ctx context.Context, n int) error {
+	if r.rate <= 0 {
+		return ctx.Err()
+	}
+	r.lock.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	// we go into debt, so callers after us wait for it to be paid off
+	r.tokens -= float64(n)
+	wait := time.Duration(0)
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.lock.Unlock()
+	if !sleep(ctx, wait) {
+		return ctx.Err()
+	}
+	return nil
+}
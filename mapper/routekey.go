@@ -0,0 +1,90 @@
+package mapper
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jacksontj/traceroute"
+)
+
+// Protocols we can traceroute with
+const (
+	UDPProbe  = "udp"
+	TCPProbe  = "tcp"
+	ICMPProbe = "icmp"
+)
+
+func probeType(protocol string) traceroute.ProbeType {
+	switch protocol {
+	case TCPProbe:
+		return traceroute.TcpProbe
+	case ICMPProbe:
+		return traceroute.IcmpProbe
+	}
+	return traceroute.UdpProbe
+}
+
+func validProbe(protocol string) bool {
+	return protocol == UDPProbe || protocol == TCPProbe || protocol == ICMPProbe
+}
+
+// RouteKey identifies an entry in the RouteMap: the protocol and ports we
+// discovered a route with. Different protocols (and ports) can be hashed onto
+// different paths, so they are all tracked separately
+type RouteKey struct {
+	Protocol string
+	SrcName  string
+	SrcPort  int
+	DstName  string
+	DstPort  int
+}
+
+// srcName:srcPort
+func (k RouteKey) Src() string {
+	return net.JoinHostPort(k.SrcName, strconv.Itoa(k.SrcPort))
+}
+
+// dstName:dstPort
+func (k RouteKey) Dst() string {
+	return net.JoinHostPort(k.DstName, strconv.Itoa(k.DstPort))
+}
+
+// srcName:srcPort,dstName:dstPort/protocol
+func (k RouteKey) String() string {
+	return k.Src() + "," + k.Dst() + "/" + k.Protocol
+}
+
+func ParseRouteKey(s string) (RouteKey, error) {
+	k := RouteKey{}
+	slash := strings.LastIndex(s, "/")
+	if slash < 0 {
+		return k, fmt.Errorf("route key %q has no protocol", s)
+	}
+	k.Protocol = s[slash+1:]
+	parts := strings.SplitN(s[:slash], ",", 2)
+	if len(parts) != 2 {
+		return k, fmt.Errorf("route key %q has no destination", s)
+	}
+	var err error
+	if k.SrcName, k.SrcPort, err = splitHostPort(parts[0]); err != nil {
+		return k, err
+	}
+	if k.DstName, k.DstPort, err = splitHostPort(parts[1]); err != nil {
+		return k, err
+	}
+	return k, nil
+}
+
+func splitHostPort(s string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q: %v", s, err)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,29 @@
+package mapper
+
+import (
+	"testing"
+)
+
+func TestRouteKey(t *testing.T) {
+	keys := []RouteKey{
+		{Protocol: UDPProbe, SrcName: "10.0.0.1", SrcPort: 33435, DstName: "10.0.0.2", DstPort: 33434},
+		{Protocol: ICMPProbe, SrcName: "10.0.0.1", DstName: "10.0.0.2"},
+		{Protocol: TCPProbe, SrcName: "::1", SrcPort: 33435, DstName: "fe80::1", DstPort: 443},
+	}
+	for _, k := range keys {
+		parsed, err := ParseRouteKey(k.String())
+		if err != nil {
+			t.Errorf("unable to parse %s: %v", k, err)
+			continue
+		}
+		if parsed != k {
+			t.Errorf("expected %+v, got %+v", k, parsed)
+		}
+	}
+
+	for _, bad := range []string{"", "10.0.0.1:1,10.0.0.2:2", "10.0.0.1:1/udp", "10.0.0.1,10.0.0.2:2/udp"} {
+		if _, err := ParseRouteKey(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package mapper
 // Map for port + node -> route
 import (
 	"encoding/json"
-	"strconv"
 	"sync"
 
 	"github.com/Sirupsen/logrus"
@@ -12,24 +11,109 @@ import (
 
 // TODO: do our own route refcounting (up and down)
 type RouteMap struct {
-	// key == srcName:srcPort,dstName:dstPort
+	// key == srcName:srcPort,dstName:dstPort/protocol (see RouteKey)
 	// key -> route
 	NodeRouteMap map[string]*graph.NetworkRoute
 
-	// dstNodeKey -> NodeRouteMap-Key
+	// dstNodeKey (the peer's name:port) -> NodeRouteMap-Key
 	dstNodeMap map[string]map[string]interface{}
 
 	// TODO srcNodeMap
 
 	lock *sync.RWMutex
+
+	// event stuff
+	eventChannels map[chan *Event]bool
+	eventLock     *sync.Mutex
+	// subscribers we've kicked off for not keeping up
+	dropped int
 }
 
 func NewRouteMap() *RouteMap {
 	return &RouteMap{
-		NodeRouteMap: make(map[string]*graph.NetworkRoute),
-		dstNodeMap:   make(map[string]map[string]interface{}),
-		lock:         &sync.RWMutex{},
+		NodeRouteMap:  make(map[string]*graph.NetworkRoute),
+		dstNodeMap:    make(map[string]map[string]interface{}),
+		lock:          &sync.RWMutex{},
+		eventChannels: make(map[chan *Event]bool),
+		eventLock:     &sync.Mutex{},
+	}
+}
+
+func (r *RouteMap) publish(e *Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	for c := range r.eventChannels {
+		select {
+		case c <- e:
+		default:
+			delete(r.eventChannels, c)
+			close(c)
+			r.dropped++
+		}
+	}
+}
+
+// Number of subscribers we've dropped because they couldn't keep up
+func (r *RouteMap) DroppedSubscribers() int {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	return r.dropped
+}
+
+// add subscriber to our events
+func (r *RouteMap) Subscribe(c chan *Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	r.eventChannels[c] = true
+}
+
+// remove a subscriber, closing its channel
+func (r *RouteMap) Unsubscribe(c chan *Event) {
+	r.eventLock.Lock()
+	defer r.eventLock.Unlock()
+	if _, ok := r.eventChannels[c]; ok {
+		delete(r.eventChannels, c)
+		close(c)
+	}
+}
+
+// Dump everything in the RouteMap into a channel
+func (r *RouteMap) EventDumpChannel() chan *Event {
+	options := r.Options()
+	c := make(chan *Event)
+	go func() {
+		for _, o := range options {
+			c <- &Event{
+				E:    AddEvent,
+				Item: o,
+			}
+		}
+		close(c)
+	}()
+	return c
+}
+
+// All the route options we have
+func (r *RouteMap) Options() []*RouteOption {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]*RouteOption, 0, len(r.NodeRouteMap))
+	for key, route := range r.NodeRouteMap {
+		ret = append(ret, newRouteOption(key, route))
+	}
+	return ret
+}
+
+func newRouteOption(key string, route *graph.NetworkRoute) *RouteOption {
+	o := &RouteOption{Key: key}
+	if k, err := ParseRouteKey(key); err == nil {
+		o.Src, o.Dst, o.Protocol = k.Src(), k.Dst(), k.Protocol
 	}
+	if route != nil {
+		o.Route = route.Key()
+		o.Path = route.Hops()
+	}
+	return o
 }
 
 func (r *RouteMap) GetRoute(key string) *graph.NetworkRoute {
@@ -47,12 +131,104 @@ func (r *RouteMap) ReplaceRoute(o, n *graph.NetworkRoute) int {
 	for k, v := range r.NodeRouteMap {
 		if v == o {
 			r.NodeRouteMap[k] = n
+			r.publish(&Event{E: AddEvent, Item: newRouteOption(k, n)})
 			ret++
 		}
 	}
 	return ret
 }
 
+// All the keys pointing at `route`
+func (r *RouteMap) KeysFor(route *graph.NetworkRoute) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]string, 0)
+	for k, v := range r.NodeRouteMap {
+		if v == route {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// Number of route options to each peer (name:port)
+func (r *RouteMap) PeerOptions() map[string]int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make(map[string]int, len(r.dstNodeMap))
+	for dst, keys := range r.dstNodeMap {
+		ret[dst] = len(keys)
+	}
+	return ret
+}
+
+// All the distinct routes in the map
+func (r *RouteMap) Routes() []*graph.NetworkRoute {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	seen := make(map[*graph.NetworkRoute]bool)
+	ret := make([]*graph.NetworkRoute, 0)
+	for _, route := range r.NodeRouteMap {
+		if route != nil && !seen[route] {
+			seen[route] = true
+			ret = append(ret, route)
+		}
+	}
+	return ret
+}
+
+// The route options using any of `routes`
+func (r *RouteMap) OptionsFor(routes []*graph.NetworkRoute) []*RouteOption {
+	want := make(map[*graph.NetworkRoute]bool, len(routes))
+	for _, route := range routes {
+		want[route] = true
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ret := make([]*RouteOption, 0)
+	for key, route := range r.NodeRouteMap {
+		if want[route] {
+			ret = append(ret, newRouteOption(key, route))
+		}
+	}
+	return ret
+}
+
+// The distinct routes to the peer `dstKey` (name:port)
+func (r *RouteMap) RoutesTo(dstKey string) []*graph.NetworkRoute {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	seen := make(map[*graph.NetworkRoute]bool)
+	ret := make([]*graph.NetworkRoute, 0)
+	for key := range r.dstNodeMap[dstKey] {
+		route := r.NodeRouteMap[key]
+		if route != nil && !seen[route] {
+			seen[route] = true
+			ret = append(ret, route)
+		}
+	}
+	return ret
+}
+
+// Remove all the route options using `route`, and return how many there were
+func (r *RouteMap) RemoveRoute(route *graph.NetworkRoute) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := 0
+	for key, v := range r.NodeRouteMap {
+		if v != route {
+			continue
+		}
+		delete(r.NodeRouteMap, key)
+		for _, nMap := range r.dstNodeMap {
+			delete(nMap, key)
+		}
+		r.publish(&Event{E: RemoveEvent, Item: newRouteOption(key, v)})
+		ret++
+	}
+	return ret
+}
+
 // TODO: embed the key in the route struct, so we can return a channel of *NetworkRoute
 func (r *RouteMap) IterRoutes(dstKey string, keysChan chan string) {
 	go func() {
@@ -109,18 +285,16 @@ func (r *RouteMap) removeNodeKey(dstKey, key string) {
 	delete(nMap, key)
 }
 
-func (r *RouteMap) GetRouteOption(srcName string, srcPort int, dstName string, dstPort int) *graph.NetworkRoute {
-	key := srcName + ":" + strconv.Itoa(srcPort) + "," + dstName + ":" + strconv.Itoa(dstPort)
-
+func (r *RouteMap) GetRouteOption(k RouteKey) *graph.NetworkRoute {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
-	route, _ := r.NodeRouteMap[key]
+	route, _ := r.NodeRouteMap[k.String()]
 	return route
 }
 
-//
-func (r *RouteMap) UpdateRouteOption(srcName string, srcPort int, dst string, newRoute *graph.NetworkRoute) {
-	key := srcName + ":" + strconv.Itoa(srcPort) + "," + dst
+// Set the route for `k`, `dst` is the name:port of the peer it is to
+func (r *RouteMap) UpdateRouteOption(k RouteKey, dst string, newRoute *graph.NetworkRoute) {
+	key := k.String()
 
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -130,6 +304,7 @@ func (r *RouteMap) UpdateRouteOption(srcName string, srcPort int, dst string, ne
 	// if it doesn't exist, lets make it
 	if !ok || route != newRoute {
 		r.NodeRouteMap[key] = newRoute
+		r.publish(&Event{E: AddEvent, Item: newRouteOption(key, newRoute)})
 	}
 	r.addNodeKey(dst, key)
 }
@@ -150,7 +325,9 @@ func (r *RouteMap) RemoveDst(dst string) []*graph.NetworkRoute {
 		v, _ := r.NodeRouteMap[key]
 		ret = append(ret, v)
 		delete(r.NodeRouteMap, key)
+		r.publish(&Event{E: RemoveEvent, Item: newRouteOption(key, v)})
 	}
+	delete(r.dstNodeMap, dst)
 	return ret
 }
 
@@ -0,0 +1,356 @@
+package mapper
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// A single traceroute for the scheduler to run
+type mapJob struct {
+	peer *Peer
+	key  RouteKey
+	// the round the job is part of, nil for priority jobs
+	round *sync.WaitGroup
+}
+
+// MapProgress is what the scheduler has been up to
+type MapProgress struct {
+	// number of times we've started mapping all the peers
+	Round int `json:"round"`
+	// jobs in the current round, and how many of them are done
+	RoundJobs int `json:"roundJobs"`
+	RoundDone int `json:"roundDone"`
+	// how long the last full round took
+	LastRoundDuration time.Duration `json:"lastRoundDuration"`
+
+	// traceroutes running right now
+	InFlight int `json:"inFlight"`
+	// peers waiting to be re-mapped since their routes changed state
+	PriorityQueued int `json:"priorityQueued"`
+	// traceroutes done since we started (including priority ones)
+	Completed int `json:"completed"`
+	Priority  int `json:"priority"`
+}
+
+// Scheduler runs the traceroutes of the mapper on a pool of workers, within
+// a packets per second budget. Every round maps all the peers (breadth first
+// over the source ports), and peers whose routes change state jump the queue
+type Scheduler struct {
+	m       *Mapper
+	limiter *RateLimiter
+
+	jobs     chan *mapJob
+	priority chan *mapJob
+
+	// route keys queued or running, so we never map the same one twice at once
+	pending map[string]bool
+
+	progress     MapProgress
+	progressLock *sync.RWMutex
+
+	// all the goroutines we started
+	wg *sync.WaitGroup
+}
+
+func NewScheduler(m *Mapper) *Scheduler {
+	return &Scheduler{
+		m:            m,
+		limiter:      NewRateLimiter(m.config.PacketsPerSecond),
+		jobs:         make(chan *mapJob),
+		priority:     make(chan *mapJob, 1000), // TODO: config
+		pending:      make(map[string]bool),
+		progressLock: &sync.RWMutex{},
+		wg:           &sync.WaitGroup{},
+	}
+}
+
+// Start scheduling, until `ctx` is done
+func (s *Scheduler) Start(ctx context.Context) {
+	s.goRun(func() { s.watchRoutes(ctx) })
+	for i := 0; i < s.m.config.Workers; i++ {
+		s.goRun(func() { s.worker(ctx) })
+	}
+	s.goRun(func() { s.run(ctx) })
+}
+
+// Wait for everything to exit, after the context passed to Start is done
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) goRun(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+func (s *Scheduler) Progress() MapProgress {
+	s.progressLock.RLock()
+	defer s.progressLock.RUnlock()
+	return s.progress
+}
+
+// Feed all the jobs of each round to the workers
+func (s *Scheduler) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		start := time.Now()
+		jobs := s.roundJobs()
+		round := &sync.WaitGroup{}
+
+		s.progressLock.Lock()
+		s.progress.Round++
+		s.progress.RoundJobs = len(jobs)
+		s.progress.RoundDone = 0
+		s.progressLock.Unlock()
+
+		for _, j := range jobs {
+			if !s.claim(j) {
+				// it is already being (re-)mapped
+				s.progressLock.Lock()
+				s.progress.RoundDone++
+				s.progressLock.Unlock()
+				continue
+			}
+			j.round = round
+			round.Add(1)
+			select {
+			case s.jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// wait for the last ones to finish, so the duration means something
+		finished := make(chan struct{})
+		go func() {
+			round.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return
+		}
+
+		s.progressLock.Lock()
+		s.progress.LastRoundDuration = time.Since(start)
+		s.progressLock.Unlock()
+
+		// nothing to map, don't spin
+		if len(jobs) == 0 {
+			sleep(ctx, s.m.config.Interval)
+		}
+	}
+}
+
+// We map all peers on a given port to effectively get breadth first instead
+// of depth first mapping
+func (s *Scheduler) roundJobs() []*mapJob {
+	config := s.m.config
+	peers := make([]*Peer, 0)
+	for peer := range s.m.IterPeers() {
+		peers = append(peers, peer)
+	}
+
+	jobs := make([]*mapJob, 0)
+	for srcPort := config.SrcPortStart; srcPort < config.SrcPortEnd; srcPort++ {
+		for _, peer := range peers {
+			for _, probe := range config.Probes {
+				// there are no ports to hash on with icmp, so there is
+				// no point in doing it from each source port
+				if probe.Protocol == ICMPProbe && srcPort != config.SrcPortStart {
+					continue
+				}
+				for _, dstPort := range probe.ports(peer) {
+					k := RouteKey{
+						Protocol: probe.Protocol,
+						SrcName:  s.m.localName,
+						SrcPort:  srcPort,
+						DstName:  peer.Name,
+						DstPort:  dstPort,
+					}
+					if probe.Protocol == ICMPProbe {
+						k.SrcPort = 0
+					}
+					jobs = append(jobs, &mapJob{peer: peer, key: k})
+				}
+			}
+		}
+	}
+	return jobs
+}
+
+func (s *Scheduler) worker(ctx context.Context) {
+	for {
+		// priority jobs always go first
+		var j *mapJob
+		isPriority := false
+		select {
+		case j = <-s.priority:
+			isPriority = true
+		default:
+			select {
+			case j = <-s.priority:
+				isPriority = true
+			case j = <-s.jobs:
+			case <-ctx.Done():
+				return
+			}
+		}
+		s.work(ctx, j)
+		s.done(j, isPriority)
+		if !sleep(ctx, s.m.config.Interval) {
+			return
+		}
+	}
+}
+
+func (s *Scheduler) work(ctx context.Context, j *mapJob) {
+	s.progressLock.Lock()
+	s.progress.InFlight++
+	s.progressLock.Unlock()
+	defer func() {
+		s.progressLock.Lock()
+		s.progress.InFlight--
+		s.progressLock.Unlock()
+	}()
+
+	// spread the peers out, so we don't hit them all at once
+	if s.m.config.Jitter > 0 {
+		if !sleep(ctx, time.Duration(rand.Int63n(int64(s.m.config.Jitter)))) {
+			return
+		}
+	}
+	// worst case, we send every probe of every TTL
+	if s.limiter.Wait(ctx, s.m.config.MaxTTL*s.m.config.ProbeCount) != nil {
+		return
+	}
+	s.m.mapPeer(j.peer, j.key)
+}
+
+// Mark `j` as queued, returns false if it already was
+func (s *Scheduler) claim(j *mapJob) bool {
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	key := j.key.String()
+	if s.pending[key] {
+		return false
+	}
+	s.pending[key] = true
+	return true
+}
+
+func (s *Scheduler) done(j *mapJob, isPriority bool) {
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	delete(s.pending, j.key.String())
+	if j.round != nil {
+		defer j.round.Done()
+	}
+	if isPriority {
+		s.progress.Priority++
+		s.progress.PriorityQueued--
+	} else {
+		s.progress.RoundDone++
+	}
+	s.progress.Completed++
+}
+
+// Re-map the route options of routes which change state, since the state
+// change might be because the route itself changed
+func (s *Scheduler) watchRoutes(ctx context.Context) {
+	// update events are for anything about the route, we only re-map when its
+	// state changes
+	states := make(map[*graph.NetworkRoute]graph.GraphState)
+	load := func(snap *graph.Snapshot) {
+		states = make(map[*graph.NetworkRoute]graph.GraphState)
+		for _, e := range snap.Events {
+			if route, ok := e.Item.(*graph.NetworkRoute); ok {
+				states[route] = route.GetState()
+			}
+		}
+	}
+
+	sub, snap := s.m.Graph.SubscribeFrom("scheduler", "")
+	defer sub.Close()
+	load(snap)
+	for {
+		var e *graph.Event
+		var ok bool
+		select {
+		case e, ok = <-sub.Events():
+		case <-ctx.Done():
+			return
+		}
+		// the graph is gone, there is nothing more to watch
+		if !ok {
+			return
+		}
+		// the state changes we missed will be picked up by the regular rounds
+		// of mapping
+		if e.Resync() {
+			logrus.Infof("Scheduler fell behind on graph events, some re-mapping will wait for the next round")
+			snap := sub.Resync()
+			if snap == nil {
+				return
+			}
+			load(snap)
+			continue
+		}
+		route, ok := e.Item.(*graph.NetworkRoute)
+		if !ok {
+			continue
+		}
+		switch e.Event() {
+		case "addRouteEvent":
+			states[route] = route.GetState()
+		case "removeRouteEvent":
+			delete(states, route)
+		case "updateRouteEvent":
+			state := route.GetState()
+			if last, ok := states[route]; ok && last == state {
+				continue
+			}
+			states[route] = state
+			for _, key := range s.m.RouteMap.KeysFor(route) {
+				s.Prioritize(key)
+			}
+		}
+	}
+}
+
+// Prioritize re-mapping the route option `key`
+func (s *Scheduler) Prioritize(key string) {
+	k, err := ParseRouteKey(key)
+	if err != nil {
+		logrus.Warningf("Unable to prioritize mapping: %v", err)
+		return
+	}
+	peer := s.m.getPeer(k.DstName)
+	if peer == nil {
+		return
+	}
+	j := &mapJob{peer: peer, key: k}
+	if !s.claim(j) {
+		return
+	}
+	s.progressLock.Lock()
+	s.progress.PriorityQueued++
+	s.progressLock.Unlock()
+	select {
+	case s.priority <- j:
+	default:
+		// the next round will get to it
+		s.progressLock.Lock()
+		s.progress.PriorityQueued--
+		delete(s.pending, key)
+		s.progressLock.Unlock()
+	}
+}
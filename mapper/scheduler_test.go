@@ -0,0 +1,57 @@
+package mapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/dnms/graph"
+)
+
+func TestRoundJobs(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SrcPortStart = 1000
+	cfg.SrcPortEnd = 1003
+	cfg.Probes = []ProbeConfig{
+		{Protocol: UDPProbe},
+		{Protocol: TCPProbe, DstPorts: []int{22, 443}},
+		{Protocol: ICMPProbe},
+	}
+	m := NewMapper("a", cfg, graph.Create())
+	m.AddPeer(Peer{Name: "b", Port: 33434})
+	m.AddPeer(Peer{Name: "c", Port: 33434})
+
+	jobs := m.Scheduler.roundJobs()
+	// per peer: 3 udp + 6 tcp + 1 icmp
+	if len(jobs) != 20 {
+		t.Fatalf("expected 20 jobs, got %d", len(jobs))
+	}
+	keys := make(map[string]bool)
+	for _, j := range jobs {
+		keys[j.key.String()] = true
+	}
+	if len(keys) != len(jobs) {
+		t.Errorf("expected every job to have its own route key")
+	}
+	// breadth first over the source ports
+	if jobs[0].key.SrcPort != 1000 || jobs[len(jobs)-1].key.SrcPort != 1002 {
+		t.Errorf("expected jobs to be ordered by source port")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(100)
+	start := time.Now()
+	// the first second is free, then we have to wait for the rest
+	r.Wait(context.Background(), 100)
+	r.Wait(context.Background(), 10)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait ~100ms for the budget, waited %v", elapsed)
+	}
+
+	start = time.Now()
+	NewRateLimiter(0).Wait(context.Background(), 1000000)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("unlimited rate shouldn't wait, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,243 @@
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// Bump this whenever State changes in a way older versions can't read
+const StateVersion = 1
+
+// State is a snapshot of what the mapper knows: the route options in the
+// RouteMap, and the routes (with their metrics) they point at
+type State struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+
+	Routes  []RouteState  `json:"routes"`
+	Options []OptionState `json:"options"`
+}
+
+type RouteState struct {
+	// key of the route in the graph
+	Key    string                    `json:"key"`
+	Path   []string                  `json:"path"`
+	State  graph.GraphState          `json:"state"`
+	Points []graph.RoutePingResponse `json:"points"`
+	// so routes don't live longer than the RouteTTL just because we restarted
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type OptionState struct {
+	// see RouteKey
+	Key string `json:"key"`
+	// name:port of the peer the option is to
+	Peer string `json:"peer"`
+	// key of the route it uses
+	Route string `json:"route"`
+}
+
+// Snapshot everything in the RouteMap
+func (m *Mapper) Snapshot() *State {
+	s := &State{
+		Version: StateVersion,
+		Time:    time.Now(),
+		Routes:  make([]RouteState, 0),
+		Options: make([]OptionState, 0),
+	}
+
+	routes := make(map[*graph.NetworkRoute]bool)
+	m.RouteMap.lock.RLock()
+	for dst, keys := range m.RouteMap.dstNodeMap {
+		for key := range keys {
+			route, ok := m.RouteMap.NodeRouteMap[key]
+			if !ok || route == nil {
+				continue
+			}
+			s.Options = append(s.Options, OptionState{
+				Key:   key,
+				Peer:  dst,
+				Route: route.Key(),
+			})
+			routes[route] = true
+		}
+	}
+	m.RouteMap.lock.RUnlock()
+
+	for route := range routes {
+		s.Routes = append(s.Routes, RouteState{
+			Key:    route.Key(),
+			Path:   route.Hops(),
+			State:  route.GetState(),
+			Points: route.Points(),
+
+			LastSeen: route.LastSeen(),
+		})
+	}
+	return s
+}
+
+// Load a snapshot into the RouteMap and graph, returns the peers (name:port)
+// it had route options for. Options we've already mapped are left alone
+func (m *Mapper) Restore(s *State) []string {
+	age := time.Since(s.Time)
+	if age > m.config.State.TTL {
+		logrus.Infof("Ignoring state from %v ago, it is too old", age)
+		return nil
+	}
+	// the metrics are too old to tell us anything, the pings will have to
+	staleMetrics := age > m.config.State.MetricTTL
+
+	routeStates := make(map[string]*RouteState, len(s.Routes))
+	for i := range s.Routes {
+		routeStates[s.Routes[i].Key] = &s.Routes[i]
+	}
+
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+
+	peers := make(map[string]bool)
+	restored := make(map[*graph.NetworkRoute]*RouteState)
+	for _, o := range s.Options {
+		rs, ok := routeStates[o.Route]
+		if !ok {
+			logrus.Warningf("Route option %s in state has no route", o.Key)
+			continue
+		}
+		k, err := ParseRouteKey(o.Key)
+		if err != nil {
+			logrus.Warningf("Unable to restore route option: %v", err)
+			continue
+		}
+		if m.RouteMap.GetRouteOption(k) != nil {
+			continue
+		}
+		route, created := m.Graph.IncrRoute(rs.Path, nil)
+		if created && !rs.LastSeen.IsZero() {
+			route.SetLastSeen(rs.LastSeen)
+		}
+		m.RouteMap.UpdateRouteOption(k, o.Peer, route)
+		restored[route] = rs
+		peers[o.Peer] = true
+	}
+
+	if !staleMetrics {
+		for route, rs := range restored {
+			route.Restore(rs.State, rs.Points)
+		}
+	}
+	logrus.Infof("Restored %d routes to %d peers from %v ago (metrics=%v)", len(restored), len(peers), age, !staleMetrics)
+
+	ret := make([]string, 0, len(peers))
+	for peer := range peers {
+		ret = append(ret, peer)
+	}
+	return ret
+}
+
+// Drop the route options to the `restored` peers which aren't peers anymore
+func (m *Mapper) pruneRestored(restored []string) {
+	m.updateLock.Lock()
+	defer m.updateLock.Unlock()
+	m.peerLock.RLock()
+	defer m.peerLock.RUnlock()
+	for _, dst := range restored {
+		if p, ok := m.peerMap[hostOf(dst)]; ok && p.String() == dst {
+			continue
+		}
+		logrus.Infof("Restored peer %s never showed up, removing its routes", dst)
+		for _, route := range m.RouteMap.RemoveDst(dst) {
+			if route == nil {
+				continue
+			}
+			m.Graph.DecrRoute(route.Hops())
+		}
+	}
+}
+
+func SaveState(path string, s *State) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	// write somewhere else first, so we never leave a partial snapshot behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func LoadState(path string) (*State, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &State{}
+	if err := json.Unmarshal(buf, s); err != nil {
+		return nil, err
+	}
+	if s.Version != StateVersion {
+		return nil, fmt.Errorf("unsupported state version %d (expected %d)", s.Version, StateVersion)
+	}
+	return s, nil
+}
+
+// Restore the snapshot (if we have one), and then keep it up to date until
+// `ctx` is done
+func (m *Mapper) persist(ctx context.Context) {
+	cfg := m.config.State
+	s, err := LoadState(cfg.Path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		logrus.Warningf("Unable to load state from %s, starting from scratch: %v", cfg.Path, err)
+	default:
+		if restored := m.Restore(s); len(restored) > 0 {
+			// peers come back as they join, give them until the snapshot
+			// would have expired
+			m.goRun(func() {
+				if sleep(ctx, cfg.TTL-time.Since(s.Time)) {
+					m.pruneRestored(restored)
+				}
+			})
+		}
+	}
+
+	m.goRun(func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				// one last time, so we have the latest on the way down
+				m.saveState()
+				return
+			}
+			m.saveState()
+		}
+	})
+}
+
+func (m *Mapper) saveState() {
+	if err := SaveState(m.config.State.Path, m.Snapshot()); err != nil {
+		logrus.Errorf("Unable to save state to %s: %v", m.config.State.Path, err)
+	}
+}
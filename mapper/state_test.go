@@ -0,0 +1,102 @@
+package mapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jacksontj/dnms/graph"
+)
+
+func testStateMapper() *Mapper {
+	cfg := DefaultConfig()
+	cfg.State.Path = "unused"
+	return NewMapper("10.0.0.1", cfg, graph.Create())
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnms-state")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	m := testStateMapper()
+	hops := []string{"10.0.0.1", "192.168.1.1", "192.168.1.2"}
+	route, _ := m.Graph.IncrRoute(hops, nil)
+	for _, port := range []int{33435, 33436} {
+		k := RouteKey{Protocol: UDPProbe, SrcName: "10.0.0.1", SrcPort: port, DstName: "10.0.0.2", DstPort: 7946}
+		if port != 33435 {
+			m.Graph.IncrRoute(hops, nil)
+		}
+		m.RouteMap.UpdateRouteOption(k, "10.0.0.2:7946", route)
+	}
+	for i := 0; i < 10; i++ {
+		route.HandleACK(true, 1000)
+	}
+
+	if err := SaveState(path, m.Snapshot()); err != nil {
+		t.Fatalf("Unable to save state: %v", err)
+	}
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("Unable to load state: %v", err)
+	}
+
+	restoredMapper := testStateMapper()
+	peers := restoredMapper.Restore(s)
+	if len(peers) != 1 || peers[0] != "10.0.0.2:7946" {
+		t.Errorf("Wrong restored peers: %v", peers)
+	}
+	if len(restoredMapper.RouteMap.Options()) != 2 {
+		t.Errorf("Expected 2 route options, got %d", len(restoredMapper.RouteMap.Options()))
+	}
+	restored := restoredMapper.Graph.GetRoute(hops)
+	if restored == nil {
+		t.Fatalf("Route wasn't restored")
+	}
+	if n := restored.Metrics().NumPoints; n != 10 {
+		t.Errorf("Expected 10 points to be restored, got %d", n)
+	}
+
+	// restored peers which never show up get dropped
+	restoredMapper.pruneRestored(peers)
+	if restoredMapper.Graph.GetRouteCount() != 0 {
+		t.Errorf("Expected the routes of the missing peer to be removed, have %d", restoredMapper.Graph.GetRouteCount())
+	}
+}
+
+func TestStateStaleness(t *testing.T) {
+	m := testStateMapper()
+	hops := []string{"10.0.0.1", "192.168.1.1"}
+	route, _ := m.Graph.IncrRoute(hops, nil)
+	k := RouteKey{Protocol: UDPProbe, SrcName: "10.0.0.1", SrcPort: 33435, DstName: "10.0.0.2", DstPort: 7946}
+	m.RouteMap.UpdateRouteOption(k, "10.0.0.2:7946", route)
+	route.HandleACK(true, 1000)
+
+	// old metrics aren't worth anything, but the routes are
+	s := m.Snapshot()
+	s.Time = time.Now().Add(-m.config.State.MetricTTL - time.Minute)
+	restoredMapper := testStateMapper()
+	restoredMapper.Restore(s)
+	restored := restoredMapper.Graph.GetRoute(hops)
+	if restored == nil {
+		t.Fatalf("Route wasn't restored")
+	}
+	if n := restored.Metrics().NumPoints; n != 0 {
+		t.Errorf("Expected stale metrics not to be restored, got %d points", n)
+	}
+
+	// too old for anything
+	s.Time = time.Now().Add(-m.config.State.TTL - time.Minute)
+	restoredMapper = testStateMapper()
+	if peers := restoredMapper.Restore(s); len(peers) != 0 {
+		t.Errorf("Expected nothing to be restored, got %v", peers)
+	}
+	if restoredMapper.Graph.GetRouteCount() != 0 {
+		t.Errorf("Expected no routes, got %d", restoredMapper.Graph.GetRouteCount())
+	}
+}
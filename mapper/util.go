@@ -1,6 +1,11 @@
 package mapper
 
-import "math/rand"
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+)
 
 func Shuffle(a []string) {
 	for i := range a {
@@ -8,3 +13,27 @@ func Shuffle(a []string) {
 		a[i], a[j] = a[j], a[i]
 	}
 }
+
+// host of a name:port, or the whole thing if it has no port
+func hostOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// Sleep for `d`, returns false if `ctx` was done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"github.com/jacksontj/dnms/coordinate"
+)
+
 // messageType is an integer ID of a type of message that can be received
 // on network channels from other members.
 type messageType uint8
@@ -15,17 +19,28 @@ type ping struct {
 
 	DstName string
 	DstPort int
-	// TODO: don't send? seems that the peers don't usually share paths
+	// the route the ping takes, so the peer can pick its route back
 	Path []string
 
 	// Note: we can't use the times anywhere but where they where measured-- due
 	// to clock drift
 	PingTimeNS int64
+
+	// which burst this ping is part of, and its sequence number in the burst
+	Burst int64
+	Seq   int
 }
 
 type ack struct {
 	PingTimeNS int64
 
-	// TODO: don't send? seems that the peers don't usually share paths
+	// echoed back from the ping
+	Burst int64
+	Seq   int
+
+	// the route the ack takes back, nil if the peer doesn't have one to us
 	Path []string
+
+	// network coordinate of whoever answered, nil from older versions
+	Coord *coordinate.Coordinate
 }
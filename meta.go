@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// Version of dnms, advertised to the rest of the cluster
+const Version = "0.1.0"
+
+// Version of the NodeMeta encoding, this is the first byte of the meta
+const nodeMetaVersion uint8 = 1
+
+// Roles a node can have in the cluster
+const (
+	// maps and pings the rest of the cluster
+	ProberRole = "prober"
+	// prober which also aggregates the graphs of other probers
+	AggregatorRole = "aggregator"
+	// aggregates the graphs of aggregators, doesn't probe
+	SuperAggregatorRole = "super-aggregator"
+)
+
+// NodeMeta is what we tell the rest of the cluster about ourselves through
+// memberlist
+type NodeMeta struct {
+	Role string
+
+	// where our HTTP API is, if HTTPAddr is empty it is the node's gossip address
+	HTTPAddr string
+	HTTPPort int
+
+	// Version of dnms the node is running
+	Version string
+
+	// arbitrary labels (datacenter, rack, etc.)
+	Labels map[string]string
+
+	// for aggregators, the weight on the hash ring of aggregators
+	Weight int
+
+	// port of our TCP echo server for TCP pings, 0 if we don't have one
+	TCPPingPort int
+}
+
+// Meta we assume for nodes which don't send any (e.g. older versions)
+func defaultNodeMeta() *NodeMeta {
+	return &NodeMeta{
+		Role:     ProberRole,
+		HTTPPort: 12345,
+	}
+}
+
+// Whether the node should be mapped and pinged
+func (m *NodeMeta) Probes() bool {
+	return m.Role == ProberRole || m.Role == AggregatorRole
+}
+
+// host:port of the HTTP API of the node with gossip address `addr`
+func (m *NodeMeta) HTTPEndpoint(addr string) string {
+	host := m.HTTPAddr
+	if host == "" {
+		host = addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(m.HTTPPort))
+}
+
+// URL aggregators receive pushed graph events on
+func (m *NodeMeta) PushURL(addr string) string {
+	return "http://" + m.HTTPEndpoint(addr) + "/v1/aggregator/push"
+}
+
+func encodeMeta(m *NodeMeta) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(nodeMetaVersion)
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	err := enc.Encode(m)
+	return buf.Bytes(), err
+}
+
+func decodeMeta(buf []byte) (*NodeMeta, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("no meta")
+	}
+	// Newer versions only ever add fields, so we can decode anything
+	// with a version we know about or later
+	if buf[0] < nodeMetaVersion {
+		return nil, fmt.Errorf("unknown meta version %d", buf[0])
+	}
+	m := defaultNodeMeta()
+	if err := decode(buf[1:], m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,277 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/jacksontj/dnms/aggregator"
+	"github.com/jacksontj/dnms/fault"
+	"github.com/jacksontj/dnms/graph"
+	"github.com/jacksontj/dnms/mapper"
+)
+
+// nanoseconds -> seconds
+const nsPerSecond = 1e9
+
+// GraphCollector exports the nodes, links and routes of a graph. `Name` ends
+// up in the graph label, so the local and aggregated graphs can be told apart
+type GraphCollector struct {
+	Name   string
+	Graph  *graph.NetworkGraph
+	Config *Config
+}
+
+func NewGraphCollector(name string, g *graph.NetworkGraph, cfg *Config) *GraphCollector {
+	return &GraphCollector{Name: name, Graph: g, Config: cfg}
+}
+
+// A route and the metrics we export for it
+type routeSample struct {
+	route   *graph.NetworkRoute
+	state   graph.GraphState
+	metrics graph.RouteMetrics
+}
+
+// worst routes first, so those are the ones we keep when limiting
+type byRouteHealth []routeSample
+
+func (s byRouteHealth) Len() int      { return len(s) }
+func (s byRouteHealth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRouteHealth) Less(i, j int) bool {
+	if s[i].state != s[j].state {
+		return s[i].state > s[j].state
+	}
+	if s[i].metrics.LossRate != s[j].metrics.LossRate {
+		return s[i].metrics.LossRate > s[j].metrics.LossRate
+	}
+	return s[i].metrics.Average > s[j].metrics.Average
+}
+
+type linkSample struct {
+	link    *graph.NetworkLink
+	metrics graph.LinkMetrics
+}
+
+type byLinkHealth []linkSample
+
+func (s byLinkHealth) Len() int      { return len(s) }
+func (s byLinkHealth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLinkHealth) Less(i, j int) bool {
+	if s[i].metrics.State != s[j].metrics.State {
+		return s[i].metrics.State > s[j].metrics.State
+	}
+	return s[i].metrics.LossRate > s[j].metrics.LossRate
+}
+
+func (c *GraphCollector) Collect(w *Writer) {
+	g := c.Graph
+	w.Gauge("dnms_graph_nodes", "Number of nodes in the graph.", float64(g.GetNodeCount()), "graph", c.Name)
+	w.Gauge("dnms_graph_links", "Number of links in the graph.", float64(g.GetLinkCount()), "graph", c.Name)
+	w.Gauge("dnms_graph_routes", "Number of routes in the graph.", float64(g.GetRouteCount()), "graph", c.Name)
+	for _, s := range g.Subscriptions() {
+		labels := []string{"graph", c.Name, "subscriber", s.Name}
+		w.Gauge("dnms_graph_subscriber_queued_events", "Graph events waiting to go out to the subscriber.", float64(s.Queued), labels...)
+		w.Counter("dnms_graph_subscriber_coalesced_events_total", "Graph updates folded into one already queued for the subscriber.", float64(s.Coalesced), labels...)
+		w.Counter("dnms_graph_subscriber_dropped_events_total", "Graph events dropped because the subscriber's queue was full.", float64(s.Dropped), labels...)
+		w.Counter("dnms_graph_subscriber_resyncs_total", "Times the subscriber fell behind and had to resync.", float64(s.Resyncs), labels...)
+	}
+
+	c.collectRoutes(w)
+	c.collectLinks(w)
+}
+
+func (c *GraphCollector) collectRoutes(w *Writer) {
+	g := c.Graph
+	g.RoutesLock.RLock()
+	routes := make([]*graph.NetworkRoute, 0, len(g.RoutesMap))
+	for _, route := range g.RoutesMap {
+		routes = append(routes, route)
+	}
+	g.RoutesLock.RUnlock()
+
+	samples := make([]routeSample, 0, len(routes))
+	for _, route := range routes {
+		samples = append(samples, routeSample{
+			route:   route,
+			state:   route.GetState(),
+			metrics: route.Metrics(),
+		})
+	}
+	sort.Sort(byRouteHealth(samples))
+	n := limit(len(samples), c.Config.MaxRoutes)
+	w.Gauge("dnms_metrics_dropped_series", "Items not exported because of the cardinality limits.",
+		float64(len(samples)-n), "graph", c.Name, "kind", "route")
+
+	for _, s := range samples[:n] {
+		labels := []string{"graph", c.Name, "route", s.route.Key()}
+		if hops := s.route.Hops(); c.Config.HopLabels && len(hops) > 0 {
+			labels = append(labels, "src", hops[0], "dst", hops[len(hops)-1])
+		}
+		w.Gauge("dnms_route_state", "State of the route (0=up, 1=suspect, 2=down).", float64(s.state), labels...)
+		w.Gauge("dnms_route_hops", "Number of hops in the route.", float64(len(s.route.Path)), labels...)
+		// routes of the aggregated graphs have no pings of their own
+		if s.metrics.NumPoints == 0 {
+			continue
+		}
+		w.Gauge("dnms_route_loss_ratio", "Fraction of the pings on the route which were lost.", s.metrics.LossRate, labels...)
+		w.Gauge("dnms_route_latency_seconds", "Average latency of the pings on the route.", s.metrics.Average/nsPerSecond, labels...)
+		w.Gauge("dnms_route_latency_stddev_seconds", "Standard deviation of the latency of the route.", s.metrics.StandardDeviation/nsPerSecond, labels...)
+		w.Gauge("dnms_route_jitter_seconds", "RFC 3550 jitter of the route.", s.metrics.Jitter/nsPerSecond, labels...)
+	}
+}
+
+func (c *GraphCollector) collectLinks(w *Writer) {
+	g := c.Graph
+	g.LinksLock.RLock()
+	links := make([]*graph.NetworkLink, 0, len(g.LinksMap))
+	for _, link := range g.LinksMap {
+		links = append(links, link)
+	}
+	g.LinksLock.RUnlock()
+
+	samples := make([]linkSample, 0, len(links))
+	for _, link := range links {
+		samples = append(samples, linkSample{link: link, metrics: link.Metrics()})
+	}
+	sort.Sort(byLinkHealth(samples))
+	n := limit(len(samples), c.Config.MaxLinks)
+	w.Gauge("dnms_metrics_dropped_series", "Items not exported because of the cardinality limits.",
+		float64(len(samples)-n), "graph", c.Name, "kind", "link")
+
+	for _, s := range samples[:n] {
+		labels := []string{"graph", c.Name, "src", s.link.SrcName, "dst", s.link.DstName}
+		w.Gauge("dnms_link_state", "State of the link (0=up, 1=suspect, 2=down).", float64(s.metrics.State), labels...)
+		w.Gauge("dnms_link_loss_ratio", "Estimated loss rate of the link.", s.metrics.LossRate, labels...)
+		w.Gauge("dnms_link_latency_seconds", "Estimated latency of the link.", s.metrics.Latency/nsPerSecond, labels...)
+	}
+}
+
+// LocatorCollector exports the faults we suspect
+type LocatorCollector struct {
+	Name    string
+	Locator *fault.Locator
+}
+
+func NewLocatorCollector(name string, l *fault.Locator) *LocatorCollector {
+	return &LocatorCollector{Name: name, Locator: l}
+}
+
+func (c *LocatorCollector) Collect(w *Writer) {
+	counts := map[string]int{fault.LinkFault: 0, fault.NodeFault: 0}
+	for _, f := range c.Locator.Faults() {
+		counts[f.Kind]++
+	}
+	for _, kind := range []string{fault.LinkFault, fault.NodeFault} {
+		w.Gauge("dnms_faults", "Number of items we suspect are at fault.", float64(counts[kind]), "graph", c.Name, "kind", kind)
+	}
+	w.Counter("dnms_fault_subscriber_resets_total", "Times a fault subscriber fell behind and had to reset.",
+		float64(c.Locator.SubscriberResets()), "graph", c.Name)
+}
+
+// MapperCollector exports what the mapper is up to, and who it is mapping
+type MapperCollector struct {
+	Mapper *mapper.Mapper
+	Config *Config
+}
+
+func NewMapperCollector(m *mapper.Mapper, cfg *Config) *MapperCollector {
+	return &MapperCollector{Mapper: m, Config: cfg}
+}
+
+func (c *MapperCollector) Collect(w *Writer) {
+	m := c.Mapper
+	w.Gauge("dnms_peers", "Number of peers we are mapping.", float64(m.NumPeers()))
+
+	p := m.Scheduler.Progress()
+	w.Counter("dnms_mapper_rounds_total", "Rounds of mapping all the peers.", float64(p.Round))
+	w.Gauge("dnms_mapper_round_duration_seconds", "How long the last round of mapping took.", p.LastRoundDuration.Seconds())
+	w.Gauge("dnms_mapper_round_progress_ratio", "Fraction of the current round which is done.", ratio(p.RoundDone, p.RoundJobs))
+	w.Gauge("dnms_mapper_traceroutes_in_flight", "Traceroutes running right now.", float64(p.InFlight))
+	w.Gauge("dnms_mapper_priority_queued", "Route options waiting to be re-mapped.", float64(p.PriorityQueued))
+	w.Counter("dnms_mapper_traceroutes_total", "Traceroutes done since we started.", float64(p.Completed))
+
+	w.Gauge("dnms_route_options", "Number of route options in the route map.", float64(len(m.RouteMap.Options())), "graph", "local")
+	w.Counter("dnms_event_subscribers_dropped_total", "Event subscribers dropped for not keeping up.",
+		float64(m.RouteMap.DroppedSubscribers()), "graph", "local", "bus", "routemap")
+
+	collectPeerOptions(w, "local", m.RouteMap.PeerOptions(), c.Config.MaxPeers)
+}
+
+// AggregatorCollector exports who an aggregator is aggregating, along with
+// its graph and faults
+type AggregatorCollector struct {
+	Name   string
+	Map    *aggregator.AggGraphMap
+	Config *Config
+
+	graph  *GraphCollector
+	faults *LocatorCollector
+}
+
+func NewAggregatorCollector(name string, a *aggregator.AggGraphMap, cfg *Config) *AggregatorCollector {
+	return &AggregatorCollector{
+		Name:   name,
+		Map:    a,
+		Config: cfg,
+		graph:  NewGraphCollector(name, a.Graph, cfg),
+		faults: NewLocatorCollector(name, a.Faults),
+	}
+}
+
+func (c *AggregatorCollector) Collect(w *Writer) {
+	peers := c.Map.Peers()
+	options := make(map[string]int, len(peers))
+	handoffs := 0
+	for _, p := range peers {
+		options[p.Name] = p.RouteOptions
+		if p.HandingOff {
+			handoffs++
+		}
+	}
+	w.Gauge("dnms_aggregator_peers", "Number of peers we are aggregating.", float64(len(peers)), "graph", c.Name)
+	w.Gauge("dnms_aggregator_handoffs", "Peers we are handing off to another aggregator.", float64(handoffs), "graph", c.Name)
+	w.Gauge("dnms_route_options", "Number of route options in the route map.", float64(len(c.Map.RouteMap.Options())), "graph", c.Name)
+	w.Counter("dnms_event_subscribers_dropped_total", "Event subscribers dropped for not keeping up.",
+		float64(c.Map.RouteMap.DroppedSubscribers()), "graph", c.Name, "bus", "routemap")
+	collectPeerOptions(w, c.Name, options, c.Config.MaxPeers)
+
+	c.graph.Collect(w)
+	c.faults.Collect(w)
+}
+
+type peerOptions struct {
+	peer    string
+	options int
+}
+
+// peers with the most route options go first
+type byOptions []peerOptions
+
+func (s byOptions) Len() int      { return len(s) }
+func (s byOptions) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byOptions) Less(i, j int) bool {
+	if s[i].options != s[j].options {
+		return s[i].options > s[j].options
+	}
+	return s[i].peer < s[j].peer
+}
+
+func collectPeerOptions(w *Writer, graphName string, options map[string]int, max int) {
+	peers := make([]peerOptions, 0, len(options))
+	for peer, n := range options {
+		peers = append(peers, peerOptions{peer, n})
+	}
+	sort.Sort(byOptions(peers))
+	n := limit(len(peers), max)
+	w.Gauge("dnms_metrics_dropped_series", "Items not exported because of the cardinality limits.",
+		float64(len(peers)-n), "graph", graphName, "kind", "peer")
+	for _, p := range peers[:n] {
+		w.Gauge("dnms_peer_route_options", "Number of route options to the peer.", float64(p.options), "graph", graphName, "peer", p.peer)
+	}
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"fmt"
+)
+
+// Every route, link and peer is its own set of series, so big clusters need
+// limits. When there are too many we export the worst ones
+type Config struct {
+	// max routes/links/peers to export per graph, 0 is unlimited
+	MaxRoutes int `yaml:"max_routes"`
+	MaxLinks  int `yaml:"max_links"`
+	MaxPeers  int `yaml:"max_peers"`
+
+	// label routes with their first and last hop, on top of the route key
+	HopLabels bool `yaml:"hop_labels"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MaxRoutes: 1000,
+		MaxLinks:  1000,
+		MaxPeers:  1000,
+		HopLabels: true,
+	}
+}
+
+func (c *Config) Validate() error {
+	for name, v := range map[string]int{
+		"max_routes": c.MaxRoutes,
+		"max_links":  c.MaxLinks,
+		"max_peers":  c.MaxPeers,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must be >= 0, got %d", name, v)
+		}
+	}
+	return nil
+}
+
+// how many of `n` items we can export with a limit of `max`
+func limit(n, max int) int {
+	if max > 0 && n > max {
+		return max
+	}
+	return n
+}
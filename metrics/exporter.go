@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// A Collector adds its metrics to the Writer on every scrape
+type Collector interface {
+	Collect(w *Writer)
+}
+
+// CollectorFunc lets a plain function be a Collector
+type CollectorFunc func(w *Writer)
+
+func (f CollectorFunc) Collect(w *Writer) {
+	f(w)
+}
+
+// Exporter serves the metrics of all the registered collectors
+type Exporter struct {
+	collectors []Collector
+	lock       *sync.RWMutex
+}
+
+func NewExporter() *Exporter {
+	return &Exporter{
+		collectors: make([]Collector, 0),
+		lock:       &sync.RWMutex{},
+	}
+}
+
+func (e *Exporter) Register(c Collector) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.collectors = append(e.collectors, c)
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mw := NewWriter()
+	e.lock.RLock()
+	for _, c := range e.collectors {
+		c.Collect(mw)
+	}
+	e.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := mw.Write(w); err != nil {
+		logrus.Debugf("Unable to write metrics: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jacksontj/dnms/graph"
+)
+
+func TestWriter(t *testing.T) {
+	w := NewWriter()
+	w.Gauge("a", "first", 1, "x", "1")
+	w.Counter("b", "second", 2.5)
+	w.Gauge("a", "first", 3, "x", "quote\"back\\slash\nnewline")
+
+	buf := &bytes.Buffer{}
+	if err := w.Write(buf); err != nil {
+		t.Fatalf("Unable to write: %v", err)
+	}
+	expected := `# HELP a first
+# TYPE a gauge
+a{x="1"} 1
+a{x="quote\"back\\slash\nnewline"} 3
+# HELP b second
+# TYPE b counter
+b 2.5
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong output, expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestGraphCollectorLimits(t *testing.T) {
+	g := graph.Create()
+	healthy, _ := g.IncrRoute([]string{"10.0.0.1", "192.168.1.1"}, nil)
+	healthy.HandleACK(true, 1000)
+	failing, _ := g.IncrRoute([]string{"10.0.0.1", "192.168.1.2"}, nil)
+	failing.SetState(graph.Down)
+
+	cfg := DefaultConfig()
+	cfg.MaxRoutes = 1
+	w := NewWriter()
+	NewGraphCollector("local", g, cfg).Collect(w)
+	buf := &bytes.Buffer{}
+	w.Write(buf)
+	out := buf.String()
+
+	// the worst route is the one we keep
+	if !strings.Contains(out, `dnms_route_state{graph="local",route="`+failing.Key()+`",src="10.0.0.1",dst="192.168.1.2"} 2`) {
+		t.Errorf("Expected the down route to be exported:\n%s", out)
+	}
+	if strings.Contains(out, healthy.Key()) {
+		t.Errorf("Expected the healthy route to be dropped:\n%s", out)
+	}
+	if !strings.Contains(out, `dnms_metrics_dropped_series{graph="local",kind="route"} 1`) {
+		t.Errorf("Expected the dropped route to be counted:\n%s", out)
+	}
+}
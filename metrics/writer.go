@@ -0,0 +1,92 @@
+// Exports the state of dnms in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Writer collects metrics, grouped into families, and writes them out in the
+// Prometheus text exposition format
+type Writer struct {
+	families map[string]*family
+	// names of the families, in the order we first saw them
+	order []string
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	// name, value pairs
+	labels []string
+	value  float64
+}
+
+func NewWriter() *Writer {
+	return &Writer{
+		families: make(map[string]*family),
+		order:    make([]string, 0),
+	}
+}
+
+// Add a sample of the gauge `name`, `labels` are name, value pairs
+func (w *Writer) Gauge(name, help string, value float64, labels ...string) {
+	w.add("gauge", name, help, value, labels)
+}
+
+// Add a sample of the counter `name`, `labels` are name, value pairs
+func (w *Writer) Counter(name, help string, value float64, labels ...string) {
+	w.add("counter", name, help, value, labels)
+}
+
+func (w *Writer) add(typ, name, help string, value float64, labels []string) {
+	f, ok := w.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		w.families[name] = f
+		w.order = append(w.order, name)
+	}
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+func (w *Writer) Write(out io.Writer) error {
+	buf := bufio.NewWriter(out)
+	for _, name := range w.order {
+		f := w.families[name]
+		buf.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		buf.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, s := range f.samples {
+			buf.WriteString(f.name)
+			if len(s.labels) > 0 {
+				buf.WriteString("{")
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						buf.WriteString(",")
+					}
+					buf.WriteString(s.labels[i] + "=\"" + escapeLabel(s.labels[i+1]) + "\"")
+				}
+				buf.WriteString("}")
+			}
+			buf.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+		}
+	}
+	return buf.Flush()
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -1,134 +1,357 @@
 package main
 
 import (
-	"net"
-	"strconv"
-	"strings"
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
 	"github.com/jacksontj/dnms/mapper"
+	"github.com/jacksontj/dnms/metrics"
 )
 
 // TODO: move to another package??
 
+// Pinger pings every route in the RouteMap every RouteInterval, no matter how
+// many peers there are. Pings run concurrently (up to Concurrency at once,
+// within PacketsPerSecond) and UDP pings share a socket per source port. The
+// mapper's traceroutes use the same ports, so we close the socket whenever
+// one of them needs it
 type Pinger struct {
 	M *mapper.Mapper
 
 	Self mapper.Peer
+
+	Config PingerConfig
+
+	// fed the RTTs we measure, may be nil
+	Coords *Coordinates
+
+	// route -> when it should be pinged next
+	schedule map[*graph.NetworkRoute]time.Time
+	// limits the pings in flight
+	sem     chan struct{}
+	limiter *mapper.RateLimiter
+
+	// source port -> socket
+	sockets    map[int]*pingSocket
+	socketLock *sync.Mutex
+	// source port -> lock held by the TCP ping using it
+	tcpPorts map[int]*sync.Mutex
+
+	// last burst ID we used, so we can match acks to bursts
+	lastBurst int64
+
+	// how long the last check for due routes took (ns), and pings sent
+	lastCycle int64
+	pings     int64
+
+	// cancelled when we stop, and all the pings in flight
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+}
+
+func NewPinger(m *mapper.Mapper, self mapper.Peer, config PingerConfig) *Pinger {
+	p := &Pinger{
+		M:          m,
+		Self:       self,
+		Config:     config,
+		schedule:   make(map[*graph.NetworkRoute]time.Time),
+		sem:        make(chan struct{}, config.Concurrency),
+		limiter:    mapper.NewRateLimiter(config.PacketsPerSecond),
+		sockets:    make(map[int]*pingSocket),
+		socketLock: &sync.Mutex{},
+		tcpPorts:   make(map[int]*sync.Mutex),
+		// acks for bursts from before a restart shouldn't match ours
+		lastBurst: time.Now().UnixNano(),
+		cancel:    func() {},
+		wg:        &sync.WaitGroup{},
+	}
+	// get out of the way of traceroutes
+	m.SourcePorts.OnReserve(p.closeSocket)
+	return p
 }
 
-func (p *Pinger) Start() {
-	go p.PingPeers()
+// Start pinging, until `ctx` is done or we are stopped
+func (p *Pinger) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.PingPeers(ctx)
+	}()
 }
 
-// TODO implement
+// Stop pinging, pings in flight are dropped without recording anything
 func (p *Pinger) Stop() {
+	p.cancel()
+	p.wg.Wait()
 
+	p.socketLock.Lock()
+	defer p.socketLock.Unlock()
+	for port, sock := range p.sockets {
+		sock.close()
+		delete(p.sockets, port)
+	}
 }
 
-// ping all the things
-func (p *Pinger) PingPeers() {
+// ping all the things, each route whenever it is due
+func (p *Pinger) PingPeers(ctx context.Context) {
+	ticker := time.NewTicker(p.Config.PeerInterval)
+	defer ticker.Stop()
 	for {
-		peerChan := p.M.IterPeers()
-		for peer := range peerChan {
-			p.PingPeer(peer)
-			// TODO configurable rate
-			time.Sleep(time.Millisecond * 100)
+		start := time.Now()
+		p.pingDue(ctx)
+		atomic.StoreInt64(&p.lastCycle, int64(time.Since(start)))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (p *Pinger) PingPeer(peer *mapper.Peer) {
-	c := make(chan string)
-	p.M.RouteMap.IterRoutes(peer.String(), c)
-	for routeKey := range c {
-		route := p.M.RouteMap.GetRoute(routeKey)
-		// TODO: better
-		if route == nil {
-			continue
-		}
-		routeKeyParts := strings.SplitN(routeKey, ",", 2)
-		srcKeyParts := strings.SplitN(routeKeyParts[0], ":", 2)
-		srcPort, _ := strconv.Atoi(srcKeyParts[1])
-		logrus.Debugf("Ping src=%s dst=%s", routeKeyParts[0], routeKeyParts[1])
-
-		p := ping{
-			SrcName:    p.Self.Name,
-			SrcPort:    srcPort,
-			DstName:    peer.Name,
-			DstPort:    peer.Port,
-			Path:       route.Hops(),
-			PingTimeNS: time.Now().UnixNano(),
-		}
-		// TODO: major cleanup to encapsulate all this message sending
-		// Encode as a user message
-		encodedBuf, err := encode(pingMsg, p)
-		if err != nil {
-			logrus.Infof("Unable to encode pingMsg: %v", err)
-			continue
+// Start pings for all the routes which are due
+func (p *Pinger) pingDue(ctx context.Context) {
+	now := time.Now()
+	seen := make(map[*graph.NetworkRoute]bool)
+	for peer := range p.M.IterPeers() {
+		c := make(chan string)
+		p.M.RouteMap.IterRoutes(peer.String(), c)
+		for routeKey := range c {
+			// once we are stopped we just drain the iterators
+			if ctx.Err() != nil {
+				continue
+			}
+			k, err := mapper.ParseRouteKey(routeKey)
+			if err != nil {
+				logrus.Errorf("Unable to parse route key: %v", err)
+				continue
+			}
+			if !p.canPing(peer, k) {
+				continue
+			}
+			route := p.M.RouteMap.GetRoute(routeKey)
+			// TODO: better
+			if route == nil || seen[route] {
+				continue
+			}
+			seen[route] = true
+
+			// new routes get spread out over the interval, so we don't ping
+			// everything at once on startup
+			next, ok := p.schedule[route]
+			if !ok {
+				next = now.Add(time.Duration(float64(p.Config.RouteInterval) * rand.Float64()))
+			}
+			if next.After(now) {
+				p.schedule[route] = next
+				continue
+			}
+			p.schedule[route] = now.Add(p.Config.RouteInterval)
+
+			// wait for a slot, and for the budget to send the burst
+			select {
+			case p.sem <- struct{}{}:
+			case <-ctx.Done():
+				continue
+			}
+			if p.limiter.Wait(ctx, p.Config.BurstSize) != nil {
+				<-p.sem
+				continue
+			}
+			atomic.AddInt64(&p.pings, 1)
+			p.wg.Add(1)
+			go func(peer *mapper.Peer, k mapper.RouteKey, route *graph.NetworkRoute) {
+				defer p.wg.Done()
+				defer func() { <-p.sem }()
+				p.PingRoute(ctx, peer, k, route)
+			}(peer, k, route)
 		}
-		msg := encodedBuf.Bytes()
-		buf := make([]byte, 1, len(msg)+1)
-		buf[0] = byte(8) // TODO: add sendFrom API to memberlist
-		buf = append(buf, msg...)
+	}
 
-		LocalAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+srcKeyParts[1])
-		if err != nil {
-			logrus.Errorf("unable to resolve source addr %v", err)
+	// forget about the routes which went away
+	for route := range p.schedule {
+		if !seen[route] {
+			delete(p.schedule, route)
 		}
-		RemoteEP := net.UDPAddr{
-			IP:   net.ParseIP(peer.Name), // TODO: have ip field
-			Port: peer.Port,
+	}
+}
+
+// Whether we ping the route `k` of `peer`. A ping has to take the same path as
+// the traceroute which found the route, so it goes out with the same protocol
+// and ports-- which rules out icmp routes, and udp ones to a port the peer
+// isn't acking on. Of the rest, we only ping the ones found with the protocol
+// we ping the peer with
+func (p *Pinger) canPing(peer *mapper.Peer, k mapper.RouteKey) bool {
+	if k.Protocol != p.Config.ProtocolFor(peer.Name) {
+		return false
+	}
+	switch k.Protocol {
+	case mapper.UDPProbe:
+		return k.DstPort == peer.Port
+	case mapper.TCPProbe:
+		return true
+	}
+	return false
+}
+
+// Ping a single route of `peer`, which we know as `k`. If `ctx` is done
+// before we have the result, the route is left alone
+func (p *Pinger) PingRoute(ctx context.Context, peer *mapper.Peer, k mapper.RouteKey, route *graph.NetworkRoute) {
+	config := p.Config
+	srcPort := k.SrcPort
+	logrus.Debugf("Ping src=%s dst=%s protocol=%s", k.Src(), k.Dst(), k.Protocol)
+	// the mapper's traceroutes use the same ports
+	defer p.M.SourcePorts.Share(srcPort)()
+
+	if k.Protocol == mapper.TCPProbe {
+		// only our echo server echos, anywhere else we just get the handshake
+		echo := k.DstPort == peer.TCPPort
+		lock := p.tcpPort(srcPort)
+		lock.Lock()
+		handshake, sent, replies, err := tcpPing(ctx, srcPort, peer.Name, k.DstPort, echo, config.BurstSize, config.Timeout)
+		lock.Unlock()
+		if ctx.Err() != nil {
+			return
 		}
-		conn, err := net.DialUDP("udp", LocalAddr, &RemoteEP)
 		if err != nil {
-			// If we got a non-retryable error, lets log it
-			if netErr, ok := err.(net.Error); !(ok && netErr.Temporary()) {
-				logrus.Errorf("unable to connect to peer: %v", err)
-			} else {
-				logrus.Debugf("Temporarily unable to connect to peer: %v", err)
-			}
-			continue
+			// we'll try again next time, this isn't the route's fault
+			logrus.Debugf("Unable to TCP ping %s from port %d: %v", peer.Name, srcPort, err)
+			return
 		}
-		// TODO: configurable time
-		conn.SetDeadline(time.Now().Add(time.Second))
-
-		// TODO: check for error
-		conn.Write(buf)
-
-		// get a response from the ping
-		retBuf := make([]byte, 2048)
-		// TODO: something with err
-		readRet, err := conn.Read(retBuf)
-
-		// Whether we got an ACK
-		passed := false
-
-		// if there was a response
-		if readRet > 0 {
-			// Note: throwing away the first byte-- as its the memberlist header
-			msgType := messageType(retBuf[1])
-			retBuf = retBuf[2:]
-
-			switch msgType {
-
-			case ackMsg:
-				a := ack{}
-				err := decode(retBuf, &a)
-				if err != nil {
-					logrus.Warning("Unable to decode message: %v", err)
-				} else {
-					passed = true
+		route.HandleTCPBurst(handshake, sent, replies, int64(config.Timeout))
+		p.updateCoordinate(peer, replies)
+		return
+	}
+
+	sock, err := p.socket(srcPort)
+	if err != nil {
+		// we'll try again next time, this isn't the route's fault
+		logrus.Debugf("Unable to get a socket on port %d: %v", srcPort, err)
+		return
+	}
+
+	msg := ping{
+		SrcName: p.Self.Name,
+		SrcPort: srcPort,
+		DstName: peer.Name,
+		DstPort: k.DstPort,
+		Path:    route.Hops(),
+		Burst:   atomic.AddInt64(&p.lastBurst, 1),
+	}
+	replyChan := sock.register(msg.Burst, config.BurstSize)
+	defer sock.unregister(msg.Burst)
+
+	// the last ping of the burst gets the full timeout
+	burstDuration := time.Duration(config.BurstSize-1) * config.BurstInterval
+	timeout := time.NewTimer(burstDuration + config.Timeout)
+	defer timeout.Stop()
+
+	// send the burst in the background, so we can collect the acks as they
+	// come in
+	go func(msg ping) {
+		for seq := 0; seq < config.BurstSize; seq++ {
+			if seq > 0 {
+				select {
+				case <-time.After(config.BurstInterval):
+				case <-ctx.Done():
+					return
 				}
+			}
+			msg.Seq = seq
+			msg.PingTimeNS = time.Now().UnixNano()
+			if err := sock.send(msg); err != nil {
+				logrus.Debugf("Unable to send ping to %s: %v", peer.Name, err)
+			}
+		}
+	}(msg)
 
-			default:
-				logrus.Infof("Got unknown response type from ack: %v", msgType)
+	// get the responses to the burst, until we have them all or we time out
+	replies := make([]graph.ProbeReply, 0, config.BurstSize)
+	seen := make(map[int]bool, config.BurstSize)
+	var reversePath []string
+collect:
+	for len(seen) < config.BurstSize {
+		select {
+		case reply := <-replyChan:
+			seen[reply.Seq] = true
+			replies = append(replies, reply.ProbeReply)
+			if len(reply.Path) > 0 {
+				reversePath = reply.Path
 			}
+		case <-timeout.C:
+			break collect
+		case <-ctx.Done():
+			return
 		}
-		route.HandleACK(passed, time.Now().UnixNano()-p.PingTimeNS)
-		conn.Close()
-		// TODO: configurable ping sleep
-		time.Sleep(time.Second)
 	}
+	route.HandleBurst(config.BurstSize, replies, int64(config.Timeout))
+	if reversePath != nil {
+		route.SetReversePath(reversePath)
+	}
+	p.updateCoordinate(peer, replies)
+}
+
+// Feed the fastest reply of a burst to our coordinate, the rest of the burst
+// is mostly queueing
+func (p *Pinger) updateCoordinate(peer *mapper.Peer, replies []graph.ProbeReply) {
+	if p.Coords == nil || len(replies) == 0 {
+		return
+	}
+	rtt := replies[0].Latency
+	for _, reply := range replies[1:] {
+		if reply.Latency < rtt {
+			rtt = reply.Latency
+		}
+	}
+	p.Coords.Update(peer.Name, time.Duration(rtt))
+}
+
+func (p *Pinger) Collect(w *metrics.Writer) {
+	w.Gauge("dnms_pinger_cycle_duration_seconds", "How long the last pass over the routes due to be pinged took.",
+		time.Duration(atomic.LoadInt64(&p.lastCycle)).Seconds())
+	w.Counter("dnms_pinger_pings_total", "Routes pinged since we started.", float64(atomic.LoadInt64(&p.pings)))
+	w.Gauge("dnms_pinger_pings_in_flight", "Pings waiting for their acks right now.", float64(len(p.sem)))
+}
+
+// The lock for TCP pings from `srcPort`, only one connection can use it
+func (p *Pinger) tcpPort(srcPort int) *sync.Mutex {
+	p.socketLock.Lock()
+	defer p.socketLock.Unlock()
+	lock, ok := p.tcpPorts[srcPort]
+	if !ok {
+		lock = &sync.Mutex{}
+		p.tcpPorts[srcPort] = lock
+	}
+	return lock
+}
+
+// Close our socket on `srcPort` (if we have one), the next ping from the port
+// will open a new one
+func (p *Pinger) closeSocket(srcPort int) {
+	p.socketLock.Lock()
+	defer p.socketLock.Unlock()
+	if sock, ok := p.sockets[srcPort]; ok {
+		sock.close()
+		delete(p.sockets, srcPort)
+	}
+}
+
+// The shared socket for `srcPort`, opening it if we don't have one
+func (p *Pinger) socket(srcPort int) (*pingSocket, error) {
+	p.socketLock.Lock()
+	defer p.socketLock.Unlock()
+	if sock, ok := p.sockets[srcPort]; ok && !sock.Dead() {
+		return sock, nil
+	}
+	sock, err := newPingSocket(srcPort, p.Coords)
+	if err != nil {
+		return nil, err
+	}
+	p.sockets[srcPort] = sock
+	return sock, nil
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// pingSocket is a UDP socket on a single source port, shared by all the pings
+// from that port. Acks are matched to the burst that is waiting for them by
+// the burst ID they echo back. The port is the one of the route's traceroute,
+// so the socket is closed whenever a traceroute needs it (see
+// mapper.SourcePorts)
+type pingSocket struct {
+	conn *net.UDPConn
+
+	// burst ID -> where to send its replies
+	pending     map[int64]chan ackReply
+	pendingLock *sync.RWMutex
+
+	// set once the socket can't be read from anymore
+	dead int32
+
+	// where to keep the coordinates the acks carry, may be nil
+	coords *Coordinates
+}
+
+// A reply to a ping, and the path the peer says it took back
+type ackReply struct {
+	graph.ProbeReply
+	Path []string
+}
+
+func newPingSocket(srcPort int, coords *Coordinates) (*pingSocket, error) {
+	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+strconv.Itoa(srcPort))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &pingSocket{
+		conn:        conn,
+		pending:     make(map[int64]chan ackReply),
+		pendingLock: &sync.RWMutex{},
+		coords:      coords,
+	}
+	go s.read()
+	return s, nil
+}
+
+// Start waiting for the acks of `burst`
+func (s *pingSocket) register(burst int64, size int) chan ackReply {
+	// room for every ack twice, so duplicates don't block the reader
+	c := make(chan ackReply, size*2)
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.pending[burst] = c
+	return c
+}
+
+func (s *pingSocket) unregister(burst int64) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	delete(s.pending, burst)
+}
+
+// Whether the socket is broken, and needs to be replaced
+func (s *pingSocket) Dead() bool {
+	return atomic.LoadInt32(&s.dead) == 1
+}
+
+func (s *pingSocket) close() {
+	atomic.StoreInt32(&s.dead, 1)
+	s.conn.Close()
+}
+
+func (s *pingSocket) send(p ping) error {
+	buf, err := pingPacket(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(buf, &net.UDPAddr{
+		IP:   net.ParseIP(p.DstName), // TODO: have ip field
+		Port: p.DstPort,
+	})
+	return err
+}
+
+// goroutine target to hand all the acks we get to whoever is waiting on them
+func (s *pingSocket) read() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			// no need to complain if we closed it ourselves
+			if !s.Dead() {
+				logrus.Errorf("Ping socket closed: %v", err)
+			}
+			s.close()
+			return
+		}
+		now := time.Now().UnixNano()
+		if n < 2 {
+			continue
+		}
+
+		// Note: throwing away the first byte-- as its the memberlist header
+		msgType := messageType(buf[1])
+		if msgType != ackMsg {
+			logrus.Infof("Got unknown response type from ack: %v", msgType)
+			continue
+		}
+		a := ack{}
+		if err := decode(buf[2:n], &a); err != nil {
+			logrus.Warningf("Unable to decode message: %v", err)
+			continue
+		}
+		if a.Coord != nil && s.coords != nil {
+			s.coords.Set(addr.IP.String(), a.Coord)
+		}
+
+		s.pendingLock.RLock()
+		c, ok := s.pending[a.Burst]
+		if ok {
+			select {
+			case c <- ackReply{graph.ProbeReply{Seq: a.Seq, Latency: now - a.PingTimeNS}, a.Path}:
+			default:
+			}
+		}
+		s.pendingLock.RUnlock()
+	}
+}
+
+// Encode a ping as a packet for the memberlist UDP listener of the peer
+func pingPacket(p ping) ([]byte, error) {
+	// TODO: major cleanup to encapsulate all this message sending
+	// Encode as a user message
+	encodedBuf, err := encode(pingMsg, p)
+	if err != nil {
+		return nil, err
+	}
+	msg := encodedBuf.Bytes()
+	buf := make([]byte, 1, len(msg)+1)
+	buf[0] = byte(8) // TODO: add sendFrom API to memberlist
+	return append(buf, msg...), nil
+}
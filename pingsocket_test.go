@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Send `a` to the socket on `port` the way the peer's memberlist would
+func sendAck(t *testing.T, conn *net.UDPConn, port int, a ack) {
+	buf, err := encode(ackMsg, a)
+	if err != nil {
+		t.Fatalf("Unable to encode ack: %v", err)
+	}
+	// memberlist's header
+	msg := append([]byte{0}, buf.Bytes()...)
+	if _, err := conn.WriteToUDP(msg, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}); err != nil {
+		t.Fatalf("Unable to send ack: %v", err)
+	}
+}
+
+func waitReply(t *testing.T, c chan ackReply) ackReply {
+	select {
+	case reply := <-c:
+		return reply
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for an ack")
+	}
+	return ackReply{}
+}
+
+func TestPingSocket(t *testing.T) {
+	sock, err := newPingSocket(0, nil)
+	if err != nil {
+		t.Fatalf("Unable to open ping socket: %v", err)
+	}
+	defer sock.close()
+	port := sock.conn.LocalAddr().(*net.UDPAddr).Port
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Unable to open peer socket: %v", err)
+	}
+	defer peer.Close()
+
+	first := sock.register(1, 1)
+	second := sock.register(2, 2)
+
+	// acks go to the burst they echo, with their sequence number. Duplicates
+	// beyond what the burst has room for are dropped instead of blocking
+	pingTime := time.Now().Add(-time.Millisecond).UnixNano()
+	for i := 0; i < 3; i++ {
+		sendAck(t, peer, port, ack{PingTimeNS: pingTime, Burst: 1, Seq: 0})
+	}
+	sendAck(t, peer, port, ack{PingTimeNS: pingTime, Burst: 3, Seq: 0})
+	sendAck(t, peer, port, ack{PingTimeNS: pingTime, Burst: 2, Seq: 1, Path: []string{"a", "b"}})
+
+	reply := waitReply(t, second)
+	if reply.Seq != 1 || len(reply.Path) != 2 {
+		t.Errorf("Wrong reply for the second burst: %+v", reply)
+	}
+	if reply.Latency < int64(time.Millisecond) {
+		t.Errorf("Expected a latency of at least 1ms, got %d", reply.Latency)
+	}
+	if n := len(first); n != 2 {
+		t.Errorf("Expected the first burst to have 2 of its 3 acks, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		if reply := waitReply(t, first); reply.Seq != 0 {
+			t.Errorf("Wrong reply for the first burst: %+v", reply)
+		}
+	}
+
+	// once a burst is done, its acks go nowhere
+	sock.unregister(2)
+	sendAck(t, peer, port, ack{PingTimeNS: pingTime, Burst: 2, Seq: 0})
+	sendAck(t, peer, port, ack{PingTimeNS: pingTime, Burst: 1, Seq: 1})
+	if reply := waitReply(t, first); reply.Seq != 1 {
+		t.Errorf("Wrong reply for the first burst: %+v", reply)
+	}
+	if n := len(second); n != 0 {
+		t.Errorf("Expected no acks after unregistering, got %d", n)
+	}
+}
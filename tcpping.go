@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/jacksontj/dnms/graph"
+)
+
+// Protocols the pinger can ping routes with
+const (
+	UDPProtocol = "udp"
+	TCPProtocol = "tcp"
+)
+
+// Each echo on a TCP ping connection is a frame of the sequence number and
+// the number of echos left after it. The server closes the connection after
+// the last one, so the TIME_WAIT ends up on its side and we can reuse our
+// source port right away
+const tcpEchoFrameSize = 8
+
+// TCPEchoServer echoes frames back to TCP pingers
+type TCPEchoServer struct {
+	Addr string
+
+	// how long a connection can be idle
+	Timeout time.Duration
+
+	listener net.Listener
+	stopChan chan struct{}
+}
+
+func (s *TCPEchoServer) Start() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	s.stopChan = make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-s.stopChan:
+					return
+				default:
+				}
+				logrus.Errorf("Unable to accept TCP ping: %v", err)
+				continue
+			}
+			go s.handle(conn)
+		}
+	}()
+	return nil
+}
+
+// Stop accepting TCP pings, connections in progress finish on their own
+func (s *TCPEchoServer) Stop() {
+	if s.listener == nil {
+		return
+	}
+	close(s.stopChan)
+	s.listener.Close()
+}
+
+func (s *TCPEchoServer) handle(conn net.Conn) {
+	defer conn.Close()
+	frame := make([]byte, tcpEchoFrameSize)
+	for {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+		// that was the last one
+		if binary.BigEndian.Uint32(frame[4:]) == 0 {
+			return
+		}
+	}
+}
+
+// Ping `host`:`dstPort` over TCP from `srcPort`. We measure the handshake,
+// and then (if it is an echo server) the round trip of `count` echos on the
+// connection. Otherwise the handshake is the only ping.
+// Only one ping can use `srcPort` at a time. An error means we couldn't ping
+// at all (e.g. we couldn't bind the port), which says nothing about the route
+func tcpPing(ctx context.Context, srcPort int, host string, dstPort int, echo bool, count int, timeout time.Duration) (int64, int, []graph.ProbeReply, error) {
+	if !echo {
+		count = 1
+	}
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{Port: srcPort},
+		Timeout:   timeout,
+		// the last connection from the port may still be in TIME_WAIT
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(dstPort)))
+	if err != nil {
+		// the peer not answering is loss, anything else isn't
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, count, nil, nil
+		}
+		return 0, 0, nil, err
+	}
+	defer conn.Close()
+	handshake := time.Since(start).Nanoseconds()
+
+	// nothing to echo with, so the handshake is the ping. We close first, so
+	// reset the connection instead of leaving the port in TIME_WAIT
+	if !echo {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		return handshake, count, []graph.ProbeReply{{Seq: 0, Latency: handshake}}, nil
+	}
+
+	replies := make([]graph.ProbeReply, 0, count)
+	frame := make([]byte, tcpEchoFrameSize)
+	reply := make([]byte, tcpEchoFrameSize)
+	for seq := 0; seq < count; seq++ {
+		binary.BigEndian.PutUint32(frame, uint32(seq))
+		binary.BigEndian.PutUint32(frame[4:], uint32(count-seq-1))
+		conn.SetDeadline(time.Now().Add(timeout))
+		sent := time.Now()
+		if _, err := conn.Write(frame); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			break
+		}
+		replies = append(replies, graph.ProbeReply{
+			Seq:     int(binary.BigEndian.Uint32(reply)),
+			Latency: time.Since(sent).Nanoseconds(),
+		})
+	}
+	// wait for the server to close first
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.Copy(ioutil.Discard, conn)
+	return handshake, count, replies, nil
+}
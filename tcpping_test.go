@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// A free TCP port on localhost
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPPing(t *testing.T) {
+	s := &TCPEchoServer{Addr: "127.0.0.1:0", Timeout: time.Second}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unable to start echo server: %v", err)
+	}
+	defer s.Stop()
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	srcPort := freePort(t)
+
+	// the same source port, back to back
+	for i := 0; i < 2; i++ {
+		handshake, sent, replies, err := tcpPing(context.Background(), srcPort, "127.0.0.1", port, true, 3, time.Second)
+		if err != nil {
+			t.Fatalf("Unable to ping: %v", err)
+		}
+		if handshake <= 0 || sent != 3 || len(replies) != 3 {
+			t.Errorf("Expected a handshake and 3 echos, got %d %d %v", handshake, sent, replies)
+		}
+	}
+
+	// without an echo server, the handshake is all we get
+	_, sent, replies, err := tcpPing(context.Background(), srcPort, "127.0.0.1", port, false, 3, time.Second)
+	if err != nil || sent != 1 || len(replies) != 1 {
+		t.Errorf("Expected just the handshake, got %d %v %v", sent, replies, err)
+	}
+
+	// nobody listening isn't loss
+	_, sent, _, err = tcpPing(context.Background(), srcPort, "127.0.0.1", freePort(t), true, 3, time.Second)
+	if err == nil || sent != 0 {
+		t.Errorf("Expected an error for a closed port, got %d %v", sent, err)
+	}
+}